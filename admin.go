@@ -0,0 +1,108 @@
+package nrelay
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+type adminTapResponse struct {
+	Taps map[string]bool `json:"taps"`
+}
+
+type adminLeaderResponse struct {
+	Leader bool `json:"leader"`
+}
+
+type adminStateResponse struct {
+	Topics map[string]TopicState `json:"topics"`
+}
+
+type adminErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminTapHandler
+//
+//	GET  /tap                          -> status of all taps
+//	POST /tap?topic=foo.>&enable=true  -> toggle tap
+func adminTapHandler(svr *DefaultServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeAdminJSON(w, http.StatusOK, adminTapResponse{svr.TapEnabled()})
+		case http.MethodPost, http.MethodPut:
+			topic := r.FormValue("topic")
+			enable, err := strconv.ParseBool(r.FormValue("enable"))
+			if err != nil {
+				writeAdminJSON(w, http.StatusBadRequest, adminErrorResponse{"enable must be bool"})
+				return
+			}
+			if err := svr.SetTapEnabled(topic, enable); err != nil {
+				if errors.Is(err, ErrTapNotFound) {
+					writeAdminJSON(w, http.StatusNotFound, adminErrorResponse{err.Error()})
+					return
+				}
+				writeAdminJSON(w, http.StatusInternalServerError, adminErrorResponse{err.Error()})
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, adminTapResponse{svr.TapEnabled()})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// adminLeaderHandler
+//
+//	GET /leader -> whether this instance relays
+func adminLeaderHandler(svr *DefaultServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, adminLeaderResponse{svr.IsLeader()})
+	}
+}
+
+// adminStateHandler
+//
+//	GET /state -> relay position and statistics of topics
+func adminStateHandler(svr *DefaultServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		states, err := svr.TopicStates()
+		if err != nil {
+			if errors.Is(err, ErrStateNotConfigured) {
+				writeAdminJSON(w, http.StatusNotFound, adminErrorResponse{err.Error()})
+				return
+			}
+			writeAdminJSON(w, http.StatusInternalServerError, adminErrorResponse{err.Error()})
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, adminStateResponse{states})
+	}
+}
+
+// NewAdminHandler returns http.Handler for runtime administration of svr
+func NewAdminHandler(svr *DefaultServer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tap", adminTapHandler(svr))
+	mux.HandleFunc("/leader", adminLeaderHandler(svr))
+	mux.HandleFunc("/state", adminStateHandler(svr))
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
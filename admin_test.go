@@ -0,0 +1,93 @@
+package nrelay
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type testAdminLogWriter struct {
+	t *testing.T
+}
+
+func (w *testAdminLogWriter) Write(p []byte) (int, error) {
+	if testing.Verbose() {
+		w.t.Logf("%s", p)
+	}
+	return len(p), nil
+}
+
+func TestAdminTap(t *testing.T) {
+	lg := log.New(&testAdminLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	svr := NewDefaultServer(
+		ServerOptRelayConfig(RelayConfig{
+			Topics: Topics(
+				Topic("foo.>", Tap(TapConfig{Subject: "debug.foo"})),
+				Topic("bar.>"),
+			),
+		}),
+		ServerOptLogger(lg),
+	)
+	ts := httptest.NewServer(NewAdminHandler(svr))
+	defer ts.Close()
+
+	getStatus := func(tt *testing.T) map[string]bool {
+		resp, err := http.Get(ts.URL + "/tap")
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer resp.Body.Close()
+
+		r := adminTapResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		return r.Taps
+	}
+
+	t.Run("status", func(tt *testing.T) {
+		taps := getStatus(tt)
+		if len(taps) != 1 {
+			tt.Errorf("only configured tap: %v", taps)
+		}
+		if enabled, ok := taps["foo.>"]; ok != true || enabled {
+			tt.Errorf("tap foo.> must be disabled: %v", taps)
+		}
+	})
+	t.Run("toggle", func(tt *testing.T) {
+		resp, err := http.PostForm(ts.URL+"/tap", url.Values{"topic": {"foo.>"}, "enable": {"true"}})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			tt.Errorf("expect:200 actual:%d", resp.StatusCode)
+		}
+		if getStatus(tt)["foo.>"] != true {
+			tt.Errorf("tap foo.> must be enabled")
+		}
+	})
+	t.Run("notfound", func(tt *testing.T) {
+		resp, err := http.PostForm(ts.URL+"/tap", url.Values{"topic": {"bar.>"}, "enable": {"true"}})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			tt.Errorf("expect:404 actual:%d", resp.StatusCode)
+		}
+	})
+	t.Run("badrequest", func(tt *testing.T) {
+		resp, err := http.PostForm(ts.URL+"/tap", url.Values{"topic": {"foo.>"}, "enable": {"yes please"}})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			tt.Errorf("expect:400 actual:%d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,451 @@
+package nrelay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	AggregateModeAggregate string = "aggregate"
+	AggregateModeSplit     string = "split"
+	AggregateFormatJSON    string = "json"
+	AggregateFormatBinary  string = "binary"
+)
+
+const (
+	HeaderAggregateFormat string = "Nrelay-Aggregate-Format"
+	HeaderAggregateCount  string = "Nrelay-Aggregate-Count"
+)
+
+const (
+	defaultAggregateWindow   time.Duration = time.Second
+	defaultAggregateMaxCount int           = 1000
+	defaultAggregateMaxBytes int           = 512 * 1024
+	defaultAggregateKeyTTL   time.Duration = 5 * time.Minute
+)
+
+const (
+	metricAggregateIn      string = "aggregate_in"
+	metricAggregateOut     string = "aggregate_out"
+	metricSplitOut         string = "split_out"
+	metricSplitErrors      string = "split_errors"
+	metricSplitPassthrough string = "split_passthrough"
+)
+
+var (
+	ErrUnknownAggregateMode   = errors.New("unknown aggregate mode")
+	ErrUnknownAggregateFormat = errors.New("unknown aggregate format")
+)
+
+// encodeAggregateRecord encodes a record of combined payload,
+// "json" is element of array of Record and "binary" is uvarint length prefixed record of binary capture (without magic)
+func encodeAggregateRecord(format string, r Record) ([]byte, error) {
+	switch format {
+	case AggregateFormatJSON:
+		data, err := json.Marshal(r)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return data, nil
+	case AggregateFormatBinary:
+		buf := bytes.NewBuffer(nil)
+		if err := newBinaryRecordWriter(buf).Write(r); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.Wrapf(ErrUnknownAggregateFormat, "format: %s", format)
+}
+
+// aggregateSize returns size of combined payload of encoded records
+func aggregateSize(format string, count int, size int) int {
+	if format == AggregateFormatJSON {
+		if count < 1 {
+			return 2 // []
+		}
+		return size + count - 1 + 2 // commas and brackets
+	}
+	return size
+}
+
+// joinAggregate combines encoded records into a payload
+func joinAggregate(format string, encoded [][]byte, size int) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, aggregateSize(format, len(encoded), size)))
+	if format == AggregateFormatJSON {
+		buf.WriteByte('[')
+	}
+	for i, e := range encoded {
+		if format == AggregateFormatJSON && 0 < i {
+			buf.WriteByte(',')
+		}
+		buf.Write(e)
+	}
+	if format == AggregateFormatJSON {
+		buf.WriteByte(']')
+	}
+	return buf.Bytes()
+}
+
+// decodeAggregate returns records of combined payload
+func decodeAggregate(format string, data []byte) ([]Record, error) {
+	switch format {
+	case AggregateFormatJSON:
+		records := make([]Record, 0)
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return records, nil
+	case AggregateFormatBinary:
+		records := make([]Record, 0)
+		// a record can not be larger than the combined payload
+		r := &BinaryRecordReader{bufio.NewReader(bytes.NewReader(data)), nil, uint64(len(data))}
+		for {
+			rec, err := r.Read()
+			if err != nil {
+				if err == io.EOF {
+					return records, nil
+				}
+				return nil, errors.WithStack(err)
+			}
+			records = append(records, rec)
+		}
+	}
+	return nil, errors.Wrapf(ErrUnknownAggregateFormat, "format: %s", format)
+}
+
+// aggregateKey is window of a partition key, records are kept encoded
+type aggregateKey struct {
+	mutex     *sync.Mutex
+	subject   string
+	encoded   [][]byte
+	size      int
+	next      RelayHandler
+	startedAt time.Time
+	lastSeen  time.Time
+}
+
+// aggregation combines messages per partition key into a message
+// when window elapsed, maxCount messages or maxBytes of combined payload collected
+type aggregation struct {
+	topic      string
+	conf       AggregateConfig
+	prefixSize int
+	keyHeader  string
+	window     time.Duration
+	maxCount   int
+	maxBytes   int
+	logger     *log.Logger
+	metrics    *expvar.Map
+	mutex      *sync.RWMutex
+	keys       map[string]*aggregateKey
+	done       chan struct{}
+	wg         *sync.WaitGroup
+}
+
+func (a *aggregation) state(key string) *aggregateKey {
+	a.mutex.RLock()
+	st, ok := a.keys[key]
+	a.mutex.RUnlock()
+	if ok {
+		return st
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if st, ok := a.keys[key]; ok {
+		return st
+	}
+	st = &aggregateKey{mutex: new(sync.Mutex), encoded: make([][]byte, 0)}
+	a.keys[key] = st
+	return st
+}
+
+func (a *aggregation) Middleware(topic string, next RelayHandler) RelayHandler {
+	return func(msg *nats.Msg) error {
+		a.metrics.Add(metricAggregateIn, 1)
+
+		now := time.Now()
+		encoded, err := encodeAggregateRecord(a.conf.Format, Record{Subject: msg.Subject, Header: msg.Header, Data: msg.Data, ReceivedAt: now})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		key := partitionKey(msg, a.prefixSize, a.keyHeader)
+		st := a.state(key)
+		st.mutex.Lock()
+		defer st.mutex.Unlock()
+
+		// combined payload must not exceed maxBytes
+		if 0 < len(st.encoded) && a.maxBytes < aggregateSize(a.conf.Format, len(st.encoded)+1, st.size+len(encoded)) {
+			err = a.flush(key, st)
+		}
+		if len(st.encoded) == 0 {
+			st.subject = msg.Subject
+			if 0 < len(a.conf.Subject) {
+				st.subject = a.conf.Subject
+			}
+			st.startedAt = now
+		}
+		st.encoded = append(st.encoded, encoded)
+		st.size += len(encoded)
+		st.next = next
+		st.lastSeen = now
+
+		if a.maxCount <= len(st.encoded) {
+			if e := a.flush(key, st); e != nil && err == nil {
+				err = e
+			}
+		}
+		return err
+	}
+}
+
+// take returns combined message of collected messages, st must be locked
+func (a *aggregation) take(st *aggregateKey) (*nats.Msg, RelayHandler) {
+	if len(st.encoded) < 1 {
+		return nil, nil
+	}
+	msg := nats.NewMsg(st.subject)
+	msg.Header.Set(HeaderAggregateFormat, a.conf.Format)
+	msg.Header.Set(HeaderAggregateCount, strconv.Itoa(len(st.encoded)))
+	msg.Data = joinAggregate(a.conf.Format, st.encoded, st.size)
+
+	st.encoded = make([][]byte, 0, len(st.encoded))
+	st.size = 0
+	return msg, st.next
+}
+
+// flush publishes collected messages of key as a message, st must be locked to keep order of key
+func (a *aggregation) flush(key string, st *aggregateKey) error {
+	msg, next := a.take(st)
+	if msg == nil {
+		return nil
+	}
+	a.metrics.Add(metricAggregateOut, 1)
+	if err := next(msg); err != nil {
+		return errors.Wrapf(err, "topic:%s key:%s", a.topic, key)
+	}
+	return nil
+}
+
+// expire flushes windows elapsed and removes idle keys
+func (a *aggregation) expire(now time.Time) {
+	a.mutex.RLock()
+	keys := make(map[string]*aggregateKey, len(a.keys))
+	for k, st := range a.keys {
+		keys[k] = st
+	}
+	a.mutex.RUnlock()
+
+	idle := make([]string, 0)
+	for k, st := range keys {
+		st.mutex.Lock()
+		if 0 < len(st.encoded) && a.window <= now.Sub(st.startedAt) {
+			if err := a.flush(k, st); err != nil {
+				a.logger.Printf("warn: aggregate flush error topic:%s key:%s err:%+v", a.topic, k, err)
+			}
+		}
+		if len(st.encoded) == 0 && defaultAggregateKeyTTL <= now.Sub(st.lastSeen) {
+			idle = append(idle, k)
+		}
+		st.mutex.Unlock()
+	}
+	if len(idle) < 1 {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, k := range idle {
+		if st, ok := a.keys[k]; ok {
+			st.mutex.Lock()
+			if len(st.encoded) == 0 && defaultAggregateKeyTTL <= now.Sub(st.lastSeen) {
+				delete(a.keys, k)
+			}
+			st.mutex.Unlock()
+		}
+	}
+}
+
+// flushAll publishes all collected messages, handlers are called after unlocking
+func (a *aggregation) flushAll() {
+	msgs := make([]*nats.Msg, 0)
+	nexts := make([]RelayHandler, 0)
+
+	a.mutex.Lock()
+	for _, st := range a.keys {
+		st.mutex.Lock()
+		if msg, next := a.take(st); msg != nil {
+			msgs = append(msgs, msg)
+			nexts = append(nexts, next)
+		}
+		st.mutex.Unlock()
+	}
+	a.mutex.Unlock()
+
+	for i, msg := range msgs {
+		a.metrics.Add(metricAggregateOut, 1)
+		if err := nexts[i](msg); err != nil {
+			a.logger.Printf("warn: aggregate flush error topic:%s subj:%s err:%+v", a.topic, msg.Subject, err)
+		}
+	}
+}
+
+func (a *aggregation) run() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(a.window / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case now := <-ticker.C:
+			a.expire(now)
+		}
+	}
+}
+
+// Close stops window timer, collected messages are flushed
+func (a *aggregation) Close() error {
+	close(a.done)
+	a.wg.Wait()
+	a.flushAll()
+	return nil
+}
+
+// split relays each message combined by aggregation, other messages are relayed as is.
+// Inbound payload transforms (decrypt, decompress) are applied before split
+// because combined payload is encrypted or compressed as a whole
+type split struct {
+	topic      string
+	transforms []payloadTransform
+	metrics    *expvar.Map
+}
+
+func (s *split) Middleware(topic string, next RelayHandler) RelayHandler {
+	return func(msg *nats.Msg) error {
+		for _, t := range s.transforms {
+			if err := t.Apply(msg); err != nil {
+				s.metrics.Add(metricSplitErrors, 1)
+				return errors.Wrapf(err, "topic:%s subj:%s", s.topic, msg.Subject)
+			}
+		}
+
+		format := ""
+		if msg.Header != nil {
+			format = msg.Header.Get(HeaderAggregateFormat)
+		}
+		if len(format) < 1 {
+			s.metrics.Add(metricSplitPassthrough, 1)
+			return next(msg)
+		}
+
+		records, err := decodeAggregate(format, msg.Data)
+		if err != nil {
+			s.metrics.Add(metricSplitErrors, 1)
+			return errors.Wrapf(err, "topic:%s subj:%s", s.topic, msg.Subject)
+		}
+		for _, r := range records {
+			s.metrics.Add(metricSplitOut, 1)
+			if err := next(r.Msg()); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	}
+}
+
+func (s *split) Close() error {
+	for _, t := range s.transforms {
+		t.Close()
+	}
+	return nil
+}
+
+// splitPayloadConfig returns inbound payload transforms of conf applied by split,
+// and the rest applied by destination
+func splitPayloadConfig(conf RelayClientConfig) (CodecConfig, EncryptionConfig, CodecConfig, EncryptionConfig) {
+	if conf.Aggregate.Configured() != true || conf.Aggregate.Mode != AggregateModeSplit {
+		return CodecConfig{}, EncryptionConfig{}, conf.Codec, conf.Encryption
+	}
+	splitCodec, dstCodec := CodecConfig{}, conf.Codec
+	if conf.Codec.Mode == CodecModeDecompress {
+		splitCodec, dstCodec = conf.Codec, CodecConfig{}
+	}
+	splitEnc, dstEnc := EncryptionConfig{}, conf.Encryption
+	if conf.Encryption.Mode == EncryptionModeDecrypt {
+		splitEnc, dstEnc = conf.Encryption, EncryptionConfig{}
+	}
+	return splitCodec, splitEnc, dstCodec, dstEnc
+}
+
+func newSplit(topic string, conf RelayClientConfig, metrics *expvar.Map) (*split, error) {
+	codec, encryption, _, _ := splitPayloadConfig(conf)
+	transforms, err := newPayloadTransforms(codec, encryption)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &split{topic, transforms, metrics}, nil
+}
+
+func newAggregation(topic string, conf RelayClientConfig, logger *log.Logger, metrics *expvar.Map) (*aggregation, error) {
+	aggConf := conf.Aggregate
+	if 0 < len(aggConf.Mode) && aggConf.Mode != AggregateModeAggregate {
+		return nil, errors.Wrapf(ErrUnknownAggregateMode, "mode: %s", aggConf.Mode)
+	}
+	if len(aggConf.Format) < 1 {
+		aggConf.Format = AggregateFormatJSON
+	}
+	if aggConf.Format != AggregateFormatJSON && aggConf.Format != AggregateFormatBinary {
+		return nil, errors.Wrapf(ErrUnknownAggregateFormat, "format: %s", aggConf.Format)
+	}
+	window := aggConf.Window
+	if window <= 0 {
+		window = defaultAggregateWindow
+	}
+	maxCount := aggConf.MaxCount
+	if maxCount < 1 {
+		maxCount = defaultAggregateMaxCount
+	}
+	maxBytes := aggConf.MaxBytes
+	if maxBytes < 1 {
+		maxBytes = defaultAggregateMaxBytes
+	}
+	keyHeader := ""
+	if conf.Partition.Strategy == PartitionHeader {
+		keyHeader = conf.Partition.Header
+	}
+
+	a := &aggregation{
+		topic:      topic,
+		conf:       aggConf,
+		prefixSize: conf.PrefixSize,
+		keyHeader:  keyHeader,
+		window:     window,
+		maxCount:   maxCount,
+		maxBytes:   maxBytes,
+		logger:     logger,
+		metrics:    metrics,
+		mutex:      new(sync.RWMutex),
+		keys:       make(map[string]*aggregateKey),
+		done:       make(chan struct{}),
+		wg:         new(sync.WaitGroup),
+	}
+	a.wg.Add(1)
+	go a.run()
+	return a, nil
+}
@@ -0,0 +1,286 @@
+package nrelay
+
+import (
+	"encoding/binary"
+	"expvar"
+	"log"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+type testAggregateCollector struct {
+	mutex *sync.Mutex
+	msgs  []*nats.Msg
+}
+
+func (c *testAggregateCollector) next(msg *nats.Msg) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+func (c *testAggregateCollector) get() []*nats.Msg {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]*nats.Msg(nil), c.msgs...)
+}
+
+func testNewAggregation(t *testing.T, conf RelayClientConfig) (*aggregation, RelayHandler, *testAggregateCollector, *expvar.Map) {
+	lg := log.New(&testTapLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	metrics := new(expvar.Map).Init()
+	a, err := newAggregation("test.>", conf, lg, metrics)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	c := &testAggregateCollector{mutex: new(sync.Mutex)}
+	return a, a.Middleware("test.>", c.next), c, metrics
+}
+
+func testAggregateMsg(subject string, data string) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set("X-Data", data)
+	msg.Data = []byte(data)
+	return msg
+}
+
+func testNewSplit(t *testing.T, conf RelayClientConfig, metrics *expvar.Map) *split {
+	conf.Aggregate.Mode = AggregateModeSplit
+	sp, err := newSplit("test.>", conf, metrics)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	return sp
+}
+
+func testSplitData(t *testing.T, msg *nats.Msg) []string {
+	return testSplitDataWith(t, testNewSplit(t, RelayClientConfig{}, new(expvar.Map).Init()), msg)
+}
+
+func testSplitDataWith(t *testing.T, sp *split, msg *nats.Msg) []string {
+	c := &testAggregateCollector{mutex: new(sync.Mutex)}
+	h := sp.Middleware("test.>", c.next)
+	if err := h(msg); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	data := make([]string, 0)
+	for _, m := range c.get() {
+		if m.Header.Get("X-Data") != string(m.Data) {
+			t.Errorf("header must be kept: %v", m.Header)
+		}
+		data = append(data, m.Subject+":"+string(m.Data))
+	}
+	return data
+}
+
+func TestAggregation(t *testing.T) {
+	t.Run("max-count", func(tt *testing.T) {
+		a, h, c, metrics := testNewAggregation(tt, RelayClientConfig{Aggregate: AggregateConfig{Window: time.Minute, MaxCount: 3}})
+		defer a.Close()
+
+		for i := 0; i < 7; i += 1 {
+			h(testAggregateMsg("test.a", strconv.Itoa(i)))
+		}
+		msgs := c.get()
+		if len(msgs) != 2 {
+			tt.Fatalf("expect:2 actual:%d", len(msgs))
+		}
+		if msgs[0].Subject != "test.a" {
+			tt.Errorf("subject of the first message: %s", msgs[0].Subject)
+		}
+		if v := msgs[0].Header.Get(HeaderAggregateCount); v != "3" {
+			tt.Errorf("expect:3 actual:%s", v)
+		}
+		if v := msgs[0].Header.Get(HeaderAggregateFormat); v != AggregateFormatJSON {
+			tt.Errorf("json is default: %s", v)
+		}
+		testEqualSeqs(tt, []string{"test.a:0", "test.a:1", "test.a:2"}, testSplitData(tt, msgs[0]))
+		testEqualSeqs(tt, []string{"test.a:3", "test.a:4", "test.a:5"}, testSplitData(tt, msgs[1]))
+		if v := metrics.Get(metricAggregateIn).String(); v != "7" {
+			tt.Errorf("expect:7 actual:%s", v)
+		}
+	})
+	t.Run("window", func(tt *testing.T) {
+		a, h, c, _ := testNewAggregation(tt, RelayClientConfig{Aggregate: AggregateConfig{Window: 20 * time.Millisecond}})
+		defer a.Close()
+
+		h(testAggregateMsg("test.a", "1"))
+		h(testAggregateMsg("test.a", "2"))
+		if len(c.get()) != 0 {
+			tt.Errorf("must wait window")
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		msgs := c.get()
+		if len(msgs) != 1 {
+			tt.Fatalf("expect:1 actual:%d", len(msgs))
+		}
+		testEqualSeqs(tt, []string{"test.a:1", "test.a:2"}, testSplitData(tt, msgs[0]))
+	})
+	t.Run("max-bytes", func(tt *testing.T) {
+		for _, format := range []string{AggregateFormatJSON, AggregateFormatBinary} {
+			rec, _ := encodeAggregateRecord(format, Record{Subject: "test.a", Header: nats.Header{"X-Data": []string{"aa"}}, Data: []byte("aa"), ReceivedAt: time.Now()})
+			maxBytes := aggregateSize(format, 2, len(rec)*2) + 8 // received_at of json varies in length
+			a, h, c, _ := testNewAggregation(tt, RelayClientConfig{Aggregate: AggregateConfig{Window: time.Minute, MaxBytes: maxBytes, Format: format}})
+
+			h(testAggregateMsg("test.a", "aa"))
+			h(testAggregateMsg("test.a", "bb"))
+			h(testAggregateMsg("test.a", "cc"))
+			msgs := c.get()
+			if len(msgs) != 1 {
+				tt.Fatalf("%s expect:1 actual:%d", format, len(msgs))
+			}
+			if maxBytes < len(msgs[0].Data) {
+				tt.Errorf("%s encoded size must be limited: %d < %d", format, maxBytes, len(msgs[0].Data))
+			}
+			testEqualSeqs(tt, []string{"test.a:aa", "test.a:bb"}, testSplitData(tt, msgs[0]))
+			a.Close()
+		}
+	})
+	t.Run("per/key", func(tt *testing.T) {
+		conf := RelayClientConfig{
+			Aggregate: AggregateConfig{Window: time.Minute, MaxCount: 2, Subject: "test.combined"},
+			Partition: PartitionConfig{Strategy: PartitionHeader, Header: "X-Device"},
+		}
+		a, h, c, _ := testNewAggregation(tt, conf)
+		defer a.Close()
+
+		for i, dev := range []string{"d1", "d2", "d1", "d2"} {
+			msg := testAggregateMsg("test."+dev, strconv.Itoa(i))
+			msg.Header.Set("X-Device", dev)
+			h(msg)
+		}
+		msgs := c.get()
+		if len(msgs) != 2 {
+			tt.Fatalf("expect:2 actual:%d", len(msgs))
+		}
+		if msgs[0].Subject != "test.combined" {
+			tt.Errorf("subject configured: %s", msgs[0].Subject)
+		}
+		testEqualSeqs(tt, []string{"test.d1:0", "test.d1:2"}, testSplitData(tt, msgs[0]))
+		testEqualSeqs(tt, []string{"test.d2:1", "test.d2:3"}, testSplitData(tt, msgs[1]))
+	})
+	t.Run("binary", func(tt *testing.T) {
+		a, h, c, _ := testNewAggregation(tt, RelayClientConfig{PrefixSize: len("test."), Aggregate: AggregateConfig{Window: time.Minute, MaxCount: 2, Format: AggregateFormatBinary}})
+		defer a.Close()
+
+		h(testAggregateMsg("test.a", "1"))
+		h(testAggregateMsg("test.b", "2"))
+		msgs := c.get()
+		if len(msgs) != 1 {
+			tt.Fatalf("expect:1 actual:%d", len(msgs))
+		}
+		if v := msgs[0].Header.Get(HeaderAggregateFormat); v != AggregateFormatBinary {
+			tt.Errorf("expect:binary actual:%s", v)
+		}
+		testEqualSeqs(tt, []string{"test.a:1", "test.b:2"}, testSplitData(tt, msgs[0]))
+	})
+	t.Run("close/flush", func(tt *testing.T) {
+		a, h, c, _ := testNewAggregation(tt, RelayClientConfig{Aggregate: AggregateConfig{Window: time.Minute}})
+
+		h(testAggregateMsg("test.a", "1"))
+		if err := a.Close(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if len(c.get()) != 1 {
+			tt.Errorf("collected messages must be flushed")
+		}
+	})
+	t.Run("unknown", func(tt *testing.T) {
+		lg := log.New(&testTapLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+		_, err := newAggregation("test.>", RelayClientConfig{Aggregate: AggregateConfig{Format: "xml"}}, lg, new(expvar.Map).Init())
+		if errors.Is(err, ErrUnknownAggregateFormat) != true {
+			tt.Errorf("unknown format: %+v", err)
+		}
+		_, err = newAggregation("test.>", RelayClientConfig{Aggregate: AggregateConfig{Mode: "merge"}}, lg, new(expvar.Map).Init())
+		if errors.Is(err, ErrUnknownAggregateMode) != true {
+			tt.Errorf("unknown mode: %+v", err)
+		}
+	})
+}
+
+func TestSplit(t *testing.T) {
+	t.Run("decrypt", func(tt *testing.T) {
+		keys := map[string]string{"key1": testWriteEncryptionKey(tt, tt.TempDir(), "key1", func(b []byte) []byte { return b })}
+		a, h, c, _ := testNewAggregation(tt, RelayClientConfig{Aggregate: AggregateConfig{Window: time.Minute, MaxCount: 2}})
+		defer a.Close()
+
+		h(testAggregateMsg("test.a", "1"))
+		h(testAggregateMsg("test.a", "2"))
+		msgs := c.get()
+		if len(msgs) != 1 {
+			tt.Fatalf("expect:1 actual:%d", len(msgs))
+		}
+		enc, err := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeEncrypt, Cipher: CipherAESGCM, KeyId: "key1", Keys: keys})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if err := enc.Apply(msgs[0]); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		conf := RelayClientConfig{Encryption: EncryptionConfig{Mode: EncryptionModeDecrypt, Cipher: CipherAESGCM, Keys: keys}}
+		sp := testNewSplit(tt, conf, new(expvar.Map).Init())
+		defer sp.Close()
+
+		testEqualSeqs(tt, []string{"test.a:1", "test.a:2"}, testSplitDataWith(tt, sp, msgs[0]))
+
+		// destination does not decrypt split messages again
+		conf.Aggregate.Mode = AggregateModeSplit
+		if _, _, _, dstEnc := splitPayloadConfig(conf); dstEnc.Configured() {
+			tt.Errorf("decrypt is applied by split: %+v", dstEnc)
+		}
+	})
+	t.Run("passthrough", func(tt *testing.T) {
+		metrics := new(expvar.Map).Init()
+		c := &testAggregateCollector{mutex: new(sync.Mutex)}
+		h := testNewSplit(tt, RelayClientConfig{}, metrics).Middleware("test.>", c.next)
+		if err := h(testAggregateMsg("test.a", "1")); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if len(c.get()) != 1 {
+			tt.Errorf("not combined message is relayed as is")
+		}
+		if v := metrics.Get(metricSplitPassthrough).String(); v != "1" {
+			tt.Errorf("expect:1 actual:%s", v)
+		}
+	})
+	t.Run("broken", func(tt *testing.T) {
+		metrics := new(expvar.Map).Init()
+		c := &testAggregateCollector{mutex: new(sync.Mutex)}
+		h := testNewSplit(tt, RelayClientConfig{}, metrics).Middleware("test.>", c.next)
+
+		msg := nats.NewMsg("test.a")
+		msg.Header.Set(HeaderAggregateFormat, AggregateFormatBinary)
+		msg.Data = []byte{0xff}
+		if err := h(msg); err == nil {
+			tt.Errorf("broken data must be error")
+		}
+		if v := metrics.Get(metricSplitErrors).String(); v != "1" {
+			tt.Errorf("expect:1 actual:%s", v)
+		}
+	})
+	t.Run("forged", func(tt *testing.T) {
+		c := &testAggregateCollector{mutex: new(sync.Mutex)}
+		h := testNewSplit(tt, RelayClientConfig{}, new(expvar.Map).Init()).Middleware("test.>", c.next)
+
+		// record size larger than payload
+		tmp := make([]byte, binary.MaxVarintLen64)
+		msg := nats.NewMsg("test.a")
+		msg.Header.Set(HeaderAggregateFormat, AggregateFormatBinary)
+		msg.Data = append(tmp[:binary.PutUvarint(tmp, 1<<40)], 0x00)
+		if err := h(msg); errors.Is(err, ErrInvalidBinaryRecord) != true {
+			tt.Errorf("forged size must be ErrInvalidBinaryRecord: %+v", err)
+		}
+		if len(c.get()) != 0 {
+			tt.Errorf("nothing relayed")
+		}
+	})
+}
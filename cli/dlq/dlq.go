@@ -0,0 +1,21 @@
+package dlq
+
+import (
+	"gopkg.in/urfave/cli.v1"
+)
+
+var subcommands []cli.Command
+
+func addSubcommand(cmd cli.Command) {
+	subcommands = append(subcommands, cmd)
+}
+
+func Command() []cli.Command {
+	return []cli.Command{
+		{
+			Name:        "dlq",
+			Usage:       "dead-letter queue operations",
+			Subcommands: subcommands,
+		},
+	}
+}
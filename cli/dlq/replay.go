@@ -0,0 +1,254 @@
+package dlq
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/comail/colog"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/octu0/nats-relay"
+)
+
+const (
+	replayFetchSize int = 100
+)
+
+type replayFilter struct {
+	reason string
+	max    int
+	count  int
+}
+
+// accept returns true if msg should be replayed
+func (f *replayFilter) accept(msg *nats.Msg) bool {
+	if 0 < len(f.reason) && msg.Header.Get(nrelay.HeaderDeadLetterReason) != f.reason {
+		return false
+	}
+	return true
+}
+
+func (f *replayFilter) done() bool {
+	return 0 < f.max && f.max <= f.count
+}
+
+func replay(conn *nats.Conn, msg *nats.Msg, filter *replayFilter, dryRun bool, logger *log.Logger) error {
+	if filter.accept(msg) != true {
+		return nil
+	}
+	out := nrelay.RestoreDeadLetter(msg)
+	filter.count += 1
+	logger.Printf("debug: replay subj:%s reason:%s", out.Subject, msg.Header.Get(nrelay.HeaderDeadLetterReason))
+	if dryRun {
+		return nil
+	}
+	if err := conn.PublishMsg(out); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func replayFile(conn *nats.Conn, path string, filter *replayFilter, dryRun bool, logger *log.Logger) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	r := nrelay.NewRecordReader(f)
+	for filter.done() != true {
+		rec, err := r.Read()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		if err := replay(conn, rec.Msg(), filter, dryRun, logger); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// streamBySubject returns the name of stream whose subjects store all of subject
+func streamBySubject(js nats.JetStreamContext, subject string) (string, bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // stop listing when found
+
+	for info := range js.StreamsInfo(nats.Context(ctx)) {
+		for _, stored := range info.Config.Subjects {
+			if subjectCovers(stored, subject) {
+				return info.Config.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// subjectCovers returns true if all subjects matching pattern also match stored(NATS wildcards)
+func subjectCovers(stored, pattern string) bool {
+	sts := strings.Split(stored, ".")
+	pts := strings.Split(pattern, ".")
+	for i, st := range sts {
+		if st == ">" {
+			return i < len(pts)
+		}
+		if len(pts) <= i {
+			return false
+		}
+		switch pts[i] {
+		case ">":
+			return false
+		case "*":
+			if st != "*" {
+				return false
+			}
+		default:
+			if st != "*" && st != pts[i] {
+				return false
+			}
+		}
+	}
+	return len(sts) == len(pts)
+}
+
+// replaySubject consumes stored DLQ messages of the stream bound to subject by durable pull consumer
+// until no message arrives within idle. Replayed messages are acked so that they are not replayed again,
+// messages filtered out (or dry-run) are left unacked and delivered on the next run
+func replaySubject(conn *nats.Conn, subject, durable string, idle time.Duration, filter *replayFilter, dryRun bool, logger *log.Logger) error {
+	js, err := conn.JetStream()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stream, ok := streamBySubject(js, subject)
+	if ok != true {
+		return errors.Errorf("no stream stores subject: %s", subject)
+	}
+	sub, err := js.PullSubscribe(subject, durable, nats.BindStream(stream), nats.DeliverAll(), nats.AckExplicit())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer sub.Unsubscribe()
+
+	logger.Printf("info: replay stream:%s subject:%s durable:%s", stream, subject, durable)
+	for filter.done() != true {
+		msgs, err := sub.Fetch(replayFetchSize, nats.MaxWait(idle))
+		if err != nil {
+			if err == nats.ErrTimeout {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		for _, msg := range msgs {
+			if filter.done() {
+				return nil
+			}
+			replayed := filter.count
+			if err := replay(conn, msg, filter, dryRun, logger); err != nil {
+				return errors.WithStack(err)
+			}
+			if dryRun || replayed == filter.count {
+				continue
+			}
+			if err := msg.Ack(); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+func replayAction(c *cli.Context) error {
+	if c.GlobalBool("debug") {
+		colog.SetMinLevel(colog.LDebug)
+		if c.GlobalBool("verbose") {
+			colog.SetMinLevel(colog.LTrace)
+		}
+	}
+	logger := log.New(os.Stdout, "nrelay ", log.Ldate|log.Ltime|log.Lshortfile)
+
+	file := c.String("file")
+	subject := c.String("subject")
+	if (0 < len(file)) == (0 < len(subject)) {
+		return errors.New("either --file or --subject is required")
+	}
+
+	conn, err := nats.Connect(c.String("nats"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	filter := &replayFilter{reason: c.String("reason"), max: c.Int("max")}
+	dryRun := c.Bool("dry-run")
+	if 0 < len(file) {
+		err = replayFile(conn, file, filter, dryRun, logger)
+	} else {
+		err = replaySubject(conn, subject, c.String("durable"), c.Duration("idle-timeout"), filter, dryRun, logger)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := conn.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	logger.Printf("info: replayed %d messages", filter.count)
+	return nil
+}
+
+func init() {
+	addSubcommand(cli.Command{
+		Name:   "replay",
+		Usage:  "re-inject dead-lettered messages to original subject",
+		Action: replayAction,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "nats",
+				Usage:  "nats url to publish replayed messages(and to consume --subject)",
+				Value:  nats.DefaultURL,
+				EnvVar: "NRELAY_DLQ_NATS",
+			},
+			cli.StringFlag{
+				Name:  "file, f",
+				Usage: "dead-letter NDJSON file path",
+				Value: "",
+			},
+			cli.StringFlag{
+				Name:  "subject, s",
+				Usage: "dead-letter subject stored by JetStream stream",
+				Value: "",
+			},
+			cli.StringFlag{
+				Name:  "durable",
+				Usage: "durable consumer name of --subject, replayed messages are acked",
+				Value: "nrelay-dlq-replay",
+			},
+			cli.DurationFlag{
+				Name:  "idle-timeout",
+				Usage: "stop consuming --subject when no stored message is left within timeout",
+				Value: 1 * time.Second,
+			},
+			cli.StringFlag{
+				Name:  "reason",
+				Usage: "replay only messages of reason(publish, queue_full, transform, validation), all if empty",
+				Value: "",
+			},
+			cli.IntFlag{
+				Name:  "max",
+				Usage: "max number of messages to replay, unlimited if 0",
+				Value: 0,
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "print messages without publishing",
+			},
+		},
+	})
+}
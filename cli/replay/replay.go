@@ -0,0 +1,151 @@
+package replay
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/comail/colog"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/octu0/nats-relay"
+)
+
+type replayOpt struct {
+	prefix string
+	max    int
+	dryRun bool
+}
+
+func replayRecords(ctx context.Context, conn *nats.Conn, dec nrelay.RecordDecoder, pacer *nrelay.ReplayPacer, opt replayOpt, logger *log.Logger) (int, error) {
+	count := 0
+	for opt.max < 1 || count < opt.max {
+		rec, err := dec.Read()
+		if err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, errors.WithStack(err)
+		}
+		if err := pacer.Wait(ctx, rec.ReceivedAt); err != nil {
+			return count, errors.WithStack(err)
+		}
+
+		msg := rec.Msg()
+		if 0 < len(opt.prefix) {
+			msg.Subject = opt.prefix + "." + msg.Subject
+		}
+		count += 1
+		logger.Printf("debug: replay subj:%s source:%s received_at:%s", msg.Subject, rec.Source, rec.ReceivedAt)
+		if opt.dryRun {
+			continue
+		}
+		if err := conn.PublishMsg(msg); err != nil {
+			return count, errors.WithStack(err)
+		}
+	}
+	return count, nil
+}
+
+func replayAction(c *cli.Context) error {
+	if c.GlobalBool("debug") {
+		colog.SetMinLevel(colog.LDebug)
+		if c.GlobalBool("verbose") {
+			colog.SetMinLevel(colog.LTrace)
+		}
+	}
+	logger := log.New(os.Stdout, "nrelay ", log.Ldate|log.Ltime|log.Lshortfile)
+
+	path := c.String("file")
+	if len(path) < 1 {
+		return errors.New("--file is required")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	dec, err := nrelay.NewRecordDecoder(f)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	speed := c.Float64("speed")
+	if c.Bool("fast") {
+		speed = 0
+	}
+
+	conn, err := nats.Connect(c.String("nats"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	opt := replayOpt{
+		prefix: c.String("prefix"),
+		max:    c.Int("max"),
+		dryRun: c.Bool("dry-run"),
+	}
+	count, err := replayRecords(ctx, conn, dec, nrelay.NewReplayPacer(speed), opt, logger)
+	if err != nil && errors.Is(err, context.Canceled) != true {
+		return errors.WithStack(err)
+	}
+	if err := conn.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	logger.Printf("info: replayed %d messages", count)
+	return nil
+}
+
+func init() {
+	addCommand(cli.Command{
+		Name:   "replay",
+		Usage:  "republish recorded capture to nats",
+		Action: replayAction,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "nats",
+				Usage:  "nats url to publish replayed messages",
+				Value:  nats.DefaultURL,
+				EnvVar: "NRELAY_REPLAY_NATS",
+			},
+			cli.StringFlag{
+				Name:  "file, f",
+				Usage: "capture file path (NDJSON or binary)",
+				Value: "",
+			},
+			cli.Float64Flag{
+				Name:  "speed",
+				Usage: "replay speed, 1.0 is original speed, 2.0 is twice as fast",
+				Value: 1.0,
+			},
+			cli.BoolFlag{
+				Name:  "fast",
+				Usage: "replay as fast as possible",
+			},
+			cli.StringFlag{
+				Name:  "prefix",
+				Usage: "subject prefix of replayed messages (e.g. 'replay' publishes foo.bar to replay.foo.bar)",
+				Value: "",
+			},
+			cli.IntFlag{
+				Name:  "max",
+				Usage: "max number of messages to replay, unlimited if 0",
+				Value: 0,
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "print messages without publishing",
+			},
+		},
+	})
+}
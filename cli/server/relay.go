@@ -3,12 +3,17 @@ package server
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/comail/colog"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"gopkg.in/urfave/cli.v1"
 	"gopkg.in/yaml.v2"
 
@@ -16,6 +21,82 @@ import (
 	"github.com/octu0/nats-relay"
 )
 
+func newTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", nrelay.AppName),
+			attribute.String("service.version", nrelay.Version),
+		)),
+	), nil
+}
+
+func runAdminServer(ctx context.Context, addr string, svr *nrelay.DefaultServer, logger *log.Logger) {
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: nrelay.NewAdminHandler(svr),
+	}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+	go func() {
+		logger.Printf("info: admin server listen %s", addr)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Printf("error: admin server: %+v", err)
+		}
+	}()
+}
+
+func readRelayConfig(path string) (nrelay.RelayConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nrelay.RelayConfig{}, errors.WithStack(err)
+	}
+
+	relayConfig := nrelay.RelayConfig{}
+	if err := yaml.Unmarshal(data, &relayConfig); err != nil {
+		return nrelay.RelayConfig{}, errors.WithStack(err)
+	}
+	if err := relayConfig.Validate(); err != nil {
+		return nrelay.RelayConfig{}, errors.Wrapf(err, "path: %s", path)
+	}
+	return relayConfig, nil
+}
+
+// reloadOnSignal reloads relay.yaml on SIGHUP
+func reloadOnSignal(ctx context.Context, path string, svr *nrelay.DefaultServer, logger *log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				logger.Printf("info: reload %s", path)
+				relayConfig, err := readRelayConfig(path)
+				if err != nil {
+					logger.Printf("error: failed to read %s: %+v", path, err)
+					continue
+				}
+				if err := svr.Reload(relayConfig); err != nil {
+					logger.Printf("error: failed to reload: %+v", err)
+				}
+			}
+		}
+	}()
+}
+
 func relayServerAction(c *cli.Context) error {
 	if c.GlobalBool("debug") {
 		colog.SetMinLevel(colog.LDebug)
@@ -25,16 +106,11 @@ func relayServerAction(c *cli.Context) error {
 	}
 	path := c.String("yaml")
 
-	data, err := os.ReadFile(path)
+	relayConfig, err := readRelayConfig(path)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	relayConfig := nrelay.RelayConfig{}
-	if err := yaml.Unmarshal(data, &relayConfig); err != nil {
-		return errors.WithStack(err)
-	}
-
 	executor := chanque.NewExecutor(c.Int("pool-min"), c.Int("pool-max"))
 	defer executor.Release()
 
@@ -43,11 +119,27 @@ func relayServerAction(c *cli.Context) error {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	svr := nrelay.NewDefaultServer(
+	serverOpts := []nrelay.ServerOptFunc{
 		nrelay.ServerOptRelayConfig(relayConfig),
 		nrelay.ServerOptExecutor(executor),
 		nrelay.ServerOptLogger(logger),
-	)
+	}
+
+	if endpoint := c.String("otlp-endpoint"); 0 < len(endpoint) {
+		tp, err := newTracerProvider(ctx, endpoint)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer tp.Shutdown(context.Background())
+
+		serverOpts = append(serverOpts, nrelay.ServerOptTracerProvider(tp))
+	}
+
+	svr := nrelay.NewDefaultServer(serverOpts...)
+	if addr := c.String("admin-addr"); 0 < len(addr) {
+		runAdminServer(ctx, addr, svr, logger)
+	}
+	reloadOnSignal(ctx, path, svr, logger)
 	return svr.Run(ctx)
 }
 
@@ -75,6 +167,18 @@ func init() {
 				Value:  1000,
 				EnvVar: "NRELAY_POOL_MAX",
 			},
+			cli.StringFlag{
+				Name:   "otlp-endpoint",
+				Usage:  "OTLP/HTTP trace collector endpoint(host:port), tracing disabled if empty",
+				Value:  "",
+				EnvVar: "NRELAY_OTLP_ENDPOINT",
+			},
+			cli.StringFlag{
+				Name:   "admin-addr",
+				Usage:  "admin http server listen address(e.g. 127.0.0.1:8080), disabled if empty",
+				Value:  "",
+				EnvVar: "NRELAY_ADMIN_ADDR",
+			},
 		},
 	})
 }
@@ -8,6 +8,8 @@ import (
 	"gopkg.in/urfave/cli.v1"
 
 	"github.com/octu0/nats-relay"
+	"github.com/octu0/nats-relay/cli/dlq"
+	"github.com/octu0/nats-relay/cli/replay"
 	"github.com/octu0/nats-relay/cli/server"
 )
 
@@ -36,6 +38,8 @@ func main() {
 	app.Usage = ""
 	app.Commands = mergeCommand(
 		server.Command(),
+		dlq.Command(),
+		replay.Command(),
 	)
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
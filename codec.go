@@ -0,0 +1,268 @@
+package nrelay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	HeaderContentEncoding string = "Content-Encoding"
+)
+
+const (
+	CodecModeCompress   string = "compress"
+	CodecModeDecompress string = "decompress"
+)
+
+const (
+	// max_payload of nats is at most 64MB
+	defaultCodecMaxSize int64 = 64 * 1024 * 1024
+)
+
+const (
+	CodecGzip   string = "gzip"
+	CodecZstd   string = "zstd"
+	CodecSnappy string = "snappy"
+)
+
+var (
+	ErrUnknownCodec     = errors.New("unknown codec")
+	ErrUnknownCodecMode = errors.New("unknown codec mode")
+	ErrCodecMaxSize     = errors.New("decompressed payload exceeds max size")
+)
+
+type codec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+	Close()
+}
+
+// check interface
+var (
+	_ codec = (*gzipCodec)(nil)
+	_ codec = (*zstdCodec)(nil)
+	_ codec = (*snappyCodec)(nil)
+)
+
+type gzipCodec struct {
+	writers *sync.Pool
+	maxSize int64
+}
+
+func (c *gzipCodec) Encode(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	w := c.writers.Get().(*gzip.Writer)
+	defer c.writers.Put(w)
+
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCodec) Decode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, c.maxSize+1))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if c.maxSize < int64(len(out)) {
+		return nil, errors.Wrapf(ErrCodecMaxSize, "max: %d", c.maxSize)
+	}
+	return out, nil
+}
+
+func (c *gzipCodec) Close() {}
+
+func newGzipCodec(maxSize int64) *gzipCodec {
+	return &gzipCodec{
+		writers: &sync.Pool{
+			New: func() interface{} {
+				return gzip.NewWriter(nil)
+			},
+		},
+		maxSize: maxSize,
+	}
+}
+
+// zstdCodec: EncodeAll/DecodeAll are safe for concurrent use
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	maxSize int64
+}
+
+func (c *zstdCodec) Encode(data []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+}
+
+func (c *zstdCodec) Decode(data []byte) ([]byte, error) {
+	out, err := c.decoder.DecodeAll(data, nil)
+	if err != nil {
+		// window of frame larger than max memory is also rejected
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, errors.Wrapf(ErrCodecMaxSize, "max: %d", c.maxSize)
+		}
+		return nil, errors.WithStack(err)
+	}
+	return out, nil
+}
+
+func (c *zstdCodec) Close() {
+	c.encoder.Close()
+	c.decoder.Close()
+}
+
+func newZstdCodec(maxSize int64) (*zstdCodec, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &zstdCodec{encoder, decoder, maxSize}, nil
+}
+
+// snappyCodec is snappy block format
+type snappyCodec struct {
+	maxSize int64
+}
+
+func (c *snappyCodec) Encode(data []byte) ([]byte, error) {
+	return s2.EncodeSnappy(nil, data), nil
+}
+
+func (c *snappyCodec) Decode(data []byte) ([]byte, error) {
+	size, err := s2.DecodedLen(data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if c.maxSize < int64(size) {
+		return nil, errors.Wrapf(ErrCodecMaxSize, "max: %d", c.maxSize)
+	}
+	out, err := s2.Decode(nil, data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return out, nil
+}
+
+func (c *snappyCodec) Close() {}
+
+// newCodec returns codec of name, decoded data larger than maxSize is rejected
+func newCodec(name string, maxSize int64) (codec, error) {
+	switch name {
+	case CodecGzip:
+		return newGzipCodec(maxSize), nil
+	case CodecZstd:
+		return newZstdCodec(maxSize)
+	case CodecSnappy:
+		return &snappyCodec{maxSize}, nil
+	}
+	return nil, errors.Wrapf(ErrUnknownCodec, "codec: %s", name)
+}
+
+// payloadCodec compresses payload and set Content-Encoding header,
+// or decompresses payload by Content-Encoding header
+type payloadCodec struct {
+	mode   string
+	name   string
+	codecs map[string]codec
+}
+
+func (c *payloadCodec) Apply(msg *nats.Msg) error {
+	if c.mode == CodecModeCompress {
+		return c.compress(msg)
+	}
+	return c.decompress(msg)
+}
+
+func (c *payloadCodec) compress(msg *nats.Msg) error {
+	if msg.Header != nil && msg.Header.Get(HeaderContentEncoding) != "" {
+		return nil // already encoded
+	}
+
+	data, err := c.codecs[c.name].Encode(msg.Data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(HeaderContentEncoding, c.name)
+	msg.Data = data
+	return nil
+}
+
+func (c *payloadCodec) decompress(msg *nats.Msg) error {
+	if msg.Header == nil {
+		return nil
+	}
+	name := msg.Header.Get(HeaderContentEncoding)
+	if name == "" {
+		return nil // not encoded
+	}
+
+	cc, ok := c.codecs[name]
+	if ok != true {
+		return errors.Wrapf(ErrUnknownCodec, "codec: %s", name)
+	}
+	data, err := cc.Decode(msg.Data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	msg.Header.Del(HeaderContentEncoding)
+	msg.Data = data
+	return nil
+}
+
+func (c *payloadCodec) Close() {
+	for _, cc := range c.codecs {
+		cc.Close()
+	}
+}
+
+// newPayloadCodec returns nil if conf is not configured
+func newPayloadCodec(conf CodecConfig) (*payloadCodec, error) {
+	if conf.Configured() != true {
+		return nil, nil
+	}
+
+	switch conf.Mode {
+	case CodecModeCompress:
+		cc, err := newCodec(conf.Type, conf.maxSize())
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &payloadCodec{conf.Mode, conf.Type, map[string]codec{conf.Type: cc}}, nil
+	case CodecModeDecompress:
+		codecs := make(map[string]codec, 3)
+		for _, name := range []string{CodecGzip, CodecZstd, CodecSnappy} {
+			cc, err := newCodec(name, conf.maxSize())
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			codecs[name] = cc
+		}
+		return &payloadCodec{conf.Mode, "", codecs}, nil
+	}
+	return nil, errors.Wrapf(ErrUnknownCodecMode, "mode: %s", conf.Mode)
+}
@@ -0,0 +1,167 @@
+package nrelay
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+func TestPayloadCodec(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"id":1,"name":"nats-relay","tags":["a","b","c"]},`), 100)
+
+	for _, name := range []string{CodecGzip, CodecZstd, CodecSnappy} {
+		t.Run("roundtrip/"+name, func(tt *testing.T) {
+			enc, err := newPayloadCodec(CodecConfig{Mode: CodecModeCompress, Type: name})
+			if err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			defer enc.Close()
+			dec, err := newPayloadCodec(CodecConfig{Mode: CodecModeDecompress})
+			if err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			defer dec.Close()
+
+			msg := &nats.Msg{Subject: "test", Data: payload}
+			if err := enc.Apply(msg); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			if msg.Header.Get(HeaderContentEncoding) != name {
+				tt.Errorf("Content-Encoding expect:%s actual:%s", name, msg.Header.Get(HeaderContentEncoding))
+			}
+			if len(payload) <= len(msg.Data) {
+				tt.Errorf("must be compressed: %d -> %d", len(payload), len(msg.Data))
+			}
+
+			if err := dec.Apply(msg); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			if msg.Header.Get(HeaderContentEncoding) != "" {
+				tt.Errorf("Content-Encoding must be removed")
+			}
+			if bytes.Equal(msg.Data, payload) != true {
+				tt.Errorf("payload must be restored")
+			}
+		})
+	}
+
+	t.Run("compress/alreadyEncoded", func(tt *testing.T) {
+		enc, err := newPayloadCodec(CodecConfig{Mode: CodecModeCompress, Type: CodecGzip})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		msg := &nats.Msg{Subject: "test", Header: nats.Header{}, Data: []byte("raw")}
+		msg.Header.Set(HeaderContentEncoding, "br")
+		if err := enc.Apply(msg); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if string(msg.Data) != "raw" {
+			tt.Errorf("encoded payload must be kept")
+		}
+	})
+	t.Run("decompress/notEncoded", func(tt *testing.T) {
+		dec, err := newPayloadCodec(CodecConfig{Mode: CodecModeDecompress})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		msg := &nats.Msg{Subject: "test", Data: []byte("raw")}
+		if err := dec.Apply(msg); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if string(msg.Data) != "raw" {
+			tt.Errorf("plain payload must be kept")
+		}
+	})
+	t.Run("decompress/unknown", func(tt *testing.T) {
+		dec, err := newPayloadCodec(CodecConfig{Mode: CodecModeDecompress})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		msg := &nats.Msg{Subject: "test", Header: nats.Header{}, Data: []byte("raw")}
+		msg.Header.Set(HeaderContentEncoding, "br")
+		if err := dec.Apply(msg); errors.Is(err, ErrUnknownCodec) != true {
+			tt.Errorf("must ErrUnknownCodec: %+v", err)
+		}
+	})
+	for _, name := range []string{CodecGzip, CodecZstd, CodecSnappy} {
+		t.Run("decompress/maxSize/"+name, func(tt *testing.T) {
+			enc, err := newPayloadCodec(CodecConfig{Mode: CodecModeCompress, Type: name})
+			if err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			defer enc.Close()
+			dec, err := newPayloadCodec(CodecConfig{Mode: CodecModeDecompress, MaxSize: int64(len(payload) - 1)})
+			if err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			defer dec.Close()
+
+			msg := &nats.Msg{Subject: "test", Data: payload}
+			if err := enc.Apply(msg); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			if err := dec.Apply(msg); errors.Is(err, ErrCodecMaxSize) != true {
+				tt.Errorf("must ErrCodecMaxSize: %+v", err)
+			}
+		})
+	}
+	t.Run("config/error", func(tt *testing.T) {
+		if _, err := newPayloadCodec(CodecConfig{Mode: CodecModeCompress, Type: "lz4"}); errors.Is(err, ErrUnknownCodec) != true {
+			tt.Errorf("must ErrUnknownCodec: %+v", err)
+		}
+		if _, err := newPayloadCodec(CodecConfig{Mode: "inflate"}); errors.Is(err, ErrUnknownCodecMode) != true {
+			tt.Errorf("must ErrUnknownCodecMode: %+v", err)
+		}
+		if c, err := newPayloadCodec(CodecConfig{}); c != nil || err != nil {
+			tt.Errorf("not configured")
+		}
+	})
+}
+
+func TestSingleDestinationCodec(t *testing.T) {
+	ns, ok := testNatsServerStart()
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer ns.Shutdown()
+
+	e := chanque.NewExecutor(10, 10)
+	t.Cleanup(func() { e.Release() })
+
+	url := fmt.Sprintf("nats://%s", ns.Addr().String())
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync("test.codec")
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	nc.Flush()
+
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	dst := NewSingleDestination(e, url, nil, lg, DestinationOptCodec(CodecConfig{Mode: CodecModeCompress, Type: CodecSnappy}))
+	if err := dst.Open(1); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	dst.Workers()[0].Enqueue(&nats.Msg{Subject: "test.codec", Data: []byte("hello hello hello")})
+	if err := dst.Close(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	if msg.Header.Get(HeaderContentEncoding) != CodecSnappy {
+		t.Errorf("must be compressed by snappy: %v", msg.Header)
+	}
+}
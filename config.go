@@ -1,27 +1,514 @@
 package nrelay
 
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidWorkerNum = errors.New("worker must be 1 or more")
+)
+
 //
 // relay.yaml
 // ----------
 // primary: "nats://master1.example.com:4222/"
 // secondary: "nats://master2.example.com:4222/"
 // nats: "nats://localhost:4222/"
+// ratelimit:
+//   bytes: 10485760
+// leader:
+//   bucket: "nrelay"
+//   ttl: 5s
+// state:
+//   bucket: "nrelay-state"
+//   interval: 5s
 // topic:
 //   "foo.>":
 //     worker: 2
+//     ratelimit:
+//       msgs: 1000
+//       mode: drop
 //   "bar.>":
 //     worker: 2
+//     queue: "nrelay-bar"
+//     tap:
+//       subject: "debug.bar"
+//       every: 100
+//       enable: true
+//     codec:
+//       mode: compress
+//       type: zstd
+//     encryption:
+//       mode: encrypt
+//       cipher: aes-gcm
+//       key-id: "key2"
+//       keys:
+//         "key1": "/path/to/key1"
+//         "key2": "/path/to/key2"
+//     wasm:
+//       path: "/path/to/transform.wasm"
+//       timeout: 10ms
+//     script:
+//       path: "/path/to/route.lua"
+//     schema:
+//       path: "/path/to/bar.schema.json"
+//       dead-letter: "bar.invalid"
+//     partition:
+//       strategy: header
+//       header: "X-Partition-Key"
+//     ordering:
+//       header: "Nrelay-Sequence"
+//       window: 100ms
+//       max-pending: 1024
+//     aggregate:
+//       window: 1s
+//       max-count: 1000
+//       format: json
+//     delay:
+//       duration: 30s
+//       header: "Nrelay-Deliver-At"
+//       path: "/path/to/bar-delay.journal"
+//     buffer:
+//       type: ring
+//       capacity: 4096
+//       batch: 128
+//       flush-timeout: 50ms
+//       flush-mode: adaptive
+//       flush-max-delay: 10ms
+//     retry:
+//       max-attempts: 5
+//       backoff: 100ms
+//       max-backoff: 5s
+//       jitter: 0.2
+//     dead-letter:
+//       subject: "bar.dlq"
+//       file: "/path/to/bar-dlq.ndjson"
+//     record:
+//       path: "/path/to/bar.capture"
+//       format: binary
+//   "audit.>":
+//     worker: 1
+//     sink:
+//       type: file
+//       path: "/path/to/audit.ndjson"
+//       max-size: 104857600
+//       max-backups: 7
+//   "ingest.http":
+//     worker: 2
+//     input:
+//       type: http
+//       listen: ":8080"
+//   "sensors.>":
+//     input:
+//       type: mqtt
+//       mqtt:
+//         broker: "tcp://mqtt.example.com:1883"
+//         topic: "sensors/#"
+//         qos: 1
+//   "dashboard.>":
+//     sink:
+//       type: websocket
+//       websocket:
+//         listen: ":8081"
+//         allow: ["dashboard.metrics.>"]
 //
 type RelayConfig struct {
 	PrimaryUrl   string                       `yaml:"primary"`
 	SecondaryUrl string                       `yaml:"secondary"`
 	NatsUrl      string                       `yaml:"nats"`
+	RateLimit    RateLimitConfig              `yaml:"ratelimit"`
+	Leader       LeaderConfig                 `yaml:"leader"`
+	State        StateConfig                  `yaml:"state"`
 	Topics       map[string]RelayClientConfig `yaml:"topic"`
 }
 
+// Validate returns error if config can not be relayed
+func (c RelayConfig) Validate() error {
+	for topic, conf := range c.Topics {
+		if conf.WorkerNum < 1 {
+			return errors.Wrapf(ErrInvalidWorkerNum, "topic:%s worker:%d", topic, conf.WorkerNum)
+		}
+	}
+	return nil
+}
+
+// LeaderConfig elects one active relay among replicas by Key(default "leader") of KV Bucket on nats(destination),
+// standby takes over after TTL(default 5s) when the leader disappears. Heartbeat defaults to TTL/3,
+// Id identifies the instance(default hostname-pid)
+type LeaderConfig struct {
+	Bucket    string        `yaml:"bucket"`
+	Key       string        `yaml:"key"`
+	TTL       time.Duration `yaml:"ttl"`
+	Heartbeat time.Duration `yaml:"heartbeat"`
+	Id        string        `yaml:"id"`
+}
+
+func (c LeaderConfig) Configured() bool {
+	return 0 < len(c.Bucket)
+}
+
+// StateConfig persists relay position and statistics of topics to KV Bucket on nats(destination)
+// every Interval(default 5s), persisted state is restored on startup.
+// Without leader election each instance saves to its own key by Id(default hostname)
+type StateConfig struct {
+	Bucket   string        `yaml:"bucket"`
+	Interval time.Duration `yaml:"interval"`
+	Id       string        `yaml:"id"`
+}
+
+func (c StateConfig) Configured() bool {
+	return 0 < len(c.Bucket)
+}
+
+// SinkConfig delivers topic to sink of Type instead of nats(destination).
+// "webhook" POSTs each batch as JSON array of records to Url with Headers, Timeout defaults to 10s.
+// "file" appends NDJSON records to Path, rotated when it exceeds MaxSize(default 100MB, negative disables)
+// or RotateInterval has elapsed, MaxBackups rotated files are kept(all if 0).
+// Options are passed through to sinks registered by ServerOptSink
+type SinkConfig struct {
+	Type           string            `yaml:"type"`
+	Url            string            `yaml:"url"`
+	Headers        map[string]string `yaml:"headers"`
+	Timeout        time.Duration     `yaml:"timeout"`
+	Path           string            `yaml:"path"`
+	MaxSize        int64             `yaml:"max-size"`
+	RotateInterval time.Duration     `yaml:"rotate-interval"`
+	MaxBackups     int               `yaml:"max-backups"`
+	Options        map[string]string `yaml:"options"`
+	Mqtt           MqttConfig        `yaml:"mqtt"`
+	Websocket      WebsocketConfig   `yaml:"websocket"`
+}
+
+func (c SinkConfig) Configured() bool {
+	return 0 < len(c.Type)
+}
+
+// InputConfig ingests messages from outside of NATS instead of primary/secondary,
+// messages are published to Subject(default topic without trailing ".>").
+// "http" accepts POST on Listen, request path is appended to Subject ("/a/b" -> "<subject>.a.b"),
+// body larger than MaxBodySize(default 1MB) is rejected.
+// "file" tails lines of Path ("-" for stdin) from the end, or FromStart, polled every PollInterval(default 250ms).
+// "udp" receives datagrams on Listen, Format "syslog" appends facility and severity to Subject
+type InputConfig struct {
+	Type         string        `yaml:"type"`
+	Subject      string        `yaml:"subject"`
+	Listen       string        `yaml:"listen"`
+	Path         string        `yaml:"path"`
+	Format       string        `yaml:"format"`
+	FromStart    bool          `yaml:"from-start"`
+	PollInterval time.Duration `yaml:"poll-interval"`
+	MaxBodySize  int64         `yaml:"max-body-size"`
+	Mqtt         MqttConfig    `yaml:"mqtt"`
+}
+
+func (c InputConfig) Configured() bool {
+	return 0 < len(c.Type)
+}
+
+// MqttConfig connects MQTT 3.1.1 Broker (e.g. "tcp://localhost:1883") for input and sink of type "mqtt".
+// Topic is MQTT topic filter of input or MQTT topic of sink, translated from topic/subject if empty
+// ("/" <-> ".", "+" <-> "*", "#" <-> ">"). Qos is subscribe QoS of input and max publish QoS of sink.
+// Retain publishes retained messages, IgnoreRetained skips retained messages on subscribe.
+// Persistent keeps session of ClientId(default unique id of the process) across reconnects.
+// Timeout of connect, subscribe and publish defaults to 10s
+type MqttConfig struct {
+	Broker         string        `yaml:"broker"`
+	ClientId       string        `yaml:"client-id"`
+	Username       string        `yaml:"username"`
+	Password       string        `yaml:"password"`
+	Topic          string        `yaml:"topic"`
+	Qos            byte          `yaml:"qos"`
+	Retain         bool          `yaml:"retain"`
+	IgnoreRetained bool          `yaml:"ignore-retained"`
+	Persistent     bool          `yaml:"persistent"`
+	Timeout        time.Duration `yaml:"timeout"`
+}
+
+// WebsocketConfig serves WebSocket endpoint on Listen and Path(default "/") for sink of type "websocket".
+// Clients subscribe subject patterns within Allow(default topic), Origins are allowed origins
+// ("*" for all, same origin if empty). Each client buffers BufferSize(default 256) messages
+// and is disconnected when the buffer is full, WriteTimeout defaults to 10s
+type WebsocketConfig struct {
+	Listen       string        `yaml:"listen"`
+	Path         string        `yaml:"path"`
+	Allow        []string      `yaml:"allow"`
+	Origins      []string      `yaml:"origins"`
+	BufferSize   int           `yaml:"buffer-size"`
+	WriteTimeout time.Duration `yaml:"write-timeout"`
+}
+
+func (c WebsocketConfig) bufferSize() int {
+	if c.BufferSize <= 0 {
+		return defaultWebsocketBufferSize
+	}
+	return c.BufferSize
+}
+
+func (c WebsocketConfig) writeTimeout() time.Duration {
+	if c.WriteTimeout <= 0 {
+		return defaultWebsocketWriteTimeout
+	}
+	return c.WriteTimeout
+}
+
+// RecordConfig captures all messages received by source to Path for `nats-relay replay`,
+// Format is "ndjson"(default) or "binary"(compact)
+type RecordConfig struct {
+	Path   string `yaml:"path"`
+	Format string `yaml:"format"`
+}
+
+func (c RecordConfig) Configured() bool {
+	return 0 < len(c.Path)
+}
+
 type RelayClientConfig struct {
-	WorkerNum  int `yaml:"worker"`
-	PrefixSize int `yaml:"prefix"`
+	WorkerNum  int              `yaml:"worker"`
+	PrefixSize int              `yaml:"prefix"`
+	Queue      string           `yaml:"queue"`
+	Tap        TapConfig        `yaml:"tap"`
+	RateLimit  RateLimitConfig  `yaml:"ratelimit"`
+	Codec      CodecConfig      `yaml:"codec"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Wasm       WasmConfig       `yaml:"wasm"`
+	Script     ScriptConfig     `yaml:"script"`
+	Schema     SchemaConfig     `yaml:"schema"`
+	Partition  PartitionConfig  `yaml:"partition"`
+	Ordering   OrderingConfig   `yaml:"ordering"`
+	Aggregate  AggregateConfig  `yaml:"aggregate"`
+	Delay      DelayConfig      `yaml:"delay"`
+	Buffer     BufferConfig     `yaml:"buffer"`
+	Retry      RetryConfig      `yaml:"retry"`
+	DeadLetter DeadLetterConfig `yaml:"dead-letter"`
+	Sink       SinkConfig       `yaml:"sink"`
+	Input      InputConfig      `yaml:"input"`
+	Record     RecordConfig     `yaml:"record"`
+}
+
+// UnmarshalYAML fills keys omitted in relay.yaml by defaultTopicOption, e.g. worker defaults to 1
+func (c *RelayClientConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RelayClientConfig
+	conf := plain(defaultTopicOption())
+	if err := unmarshal(&conf); err != nil {
+		return errors.WithStack(err)
+	}
+	*c = RelayClientConfig(conf)
+	return nil
+}
+
+// TapConfig mirrors sampled messages to Subject (published to nats) and/or File (NDJSON).
+// Every takes precedence over Percent, all messages are mirrored if both are 0
+type TapConfig struct {
+	Subject string  `yaml:"subject"`
+	File    string  `yaml:"file"`
+	Percent float64 `yaml:"percent"`
+	Every   int     `yaml:"every"`
+	Enable  bool    `yaml:"enable"`
+}
+
+func (c TapConfig) Configured() bool {
+	return 0 < len(c.Subject) || 0 < len(c.File)
+}
+
+// RateLimitConfig is token-bucket limit enforced before publishing to destination.
+// Msgs is messages/sec and Bytes is bytes/sec, bursts default to 1sec of the rate.
+// Mode "delay"(default) waits for tokens, "drop" discards excess messages, other modes are rejected.
+// Topic and destination limits are reserved together, tokens are returned if either drops the message
+type RateLimitConfig struct {
+	Msgs      float64 `yaml:"msgs"`
+	MsgBurst  int     `yaml:"msg-burst"`
+	Bytes     float64 `yaml:"bytes"`
+	ByteBurst int     `yaml:"byte-burst"`
+	Mode      string  `yaml:"mode"`
+}
+
+func (c RateLimitConfig) Configured() bool {
+	return 0 < c.Msgs || 0 < c.Bytes
+}
+
+// CodecConfig compresses payloads with Type(gzip, zstd, snappy) on Mode "compress",
+// decompresses payloads by Content-Encoding header on Mode "decompress".
+// Decompressed payloads larger than MaxSize(default 64MB, capped at max_payload of destination) are rejected
+type CodecConfig struct {
+	Mode    string `yaml:"mode"`
+	Type    string `yaml:"type"`
+	MaxSize int64  `yaml:"max-size"`
+}
+
+func (c CodecConfig) Configured() bool {
+	return 0 < len(c.Mode)
+}
+
+func (c CodecConfig) maxSize() int64 {
+	if c.MaxSize <= 0 {
+		return defaultCodecMaxSize
+	}
+	return c.MaxSize
+}
+
+// EncryptionConfig encrypts payloads by Cipher(aes-gcm, secretbox) with the key of KeyId on Mode "encrypt",
+// decrypts payloads with the key of Nrelay-Key-Id header on Mode "decrypt" (messages without encryption header are rejected).
+// Payloads are authenticated with subject and key id.
+// Keys maps key id to key file path, key is 32 bytes of raw, hex or base64
+type EncryptionConfig struct {
+	Mode   string            `yaml:"mode"`
+	Cipher string            `yaml:"cipher"`
+	KeyId  string            `yaml:"key-id"`
+	Keys   map[string]string `yaml:"keys"`
+}
+
+func (c EncryptionConfig) Configured() bool {
+	return 0 < len(c.Mode)
+}
+
+// WasmConfig transforms messages by WASM module of Path,
+// each execution is limited by Timeout, Instances of the module are pooled(default: num of cpu)
+type WasmConfig struct {
+	Path      string        `yaml:"path"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Instances int           `yaml:"instances"`
+}
+
+func (c WasmConfig) Configured() bool {
+	return 0 < len(c.Path)
+}
+
+// ScriptConfig evaluates Lua script of Path for each message,
+// script function route(msg) chooses subject, adds headers or drops the message.
+// Execution over Timeout(default 50ms) fails the message. Script is reloaded with relay.yaml
+type ScriptConfig struct {
+	Path    string        `yaml:"path"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c ScriptConfig) Configured() bool {
+	return 0 < len(c.Path)
+}
+
+// SchemaConfig validates payloads by JSON Schema of Path,
+// invalid messages are dead-lettered with reason "validation" to DeadLetter subject if set, otherwise to dead-letter of the topic.
+// Invalid messages are dropped if neither is configured
+type SchemaConfig struct {
+	Path       string `yaml:"path"`
+	DeadLetter string `yaml:"dead-letter"`
+}
+
+func (c SchemaConfig) Configured() bool {
+	return 0 < len(c.Path)
+}
+
+// PartitionConfig chooses worker of message by Strategy,
+// "consistent"(default) and "jump" hash the subject prefix, "header" hashes value of Header (falls back to subject prefix),
+// "round-robin" and "least-loaded" balance workers without ordering per key
+type PartitionConfig struct {
+	Strategy string `yaml:"strategy"`
+	Header   string `yaml:"header"`
+}
+
+// OrderingConfig reorders messages per partition key by sequence number of Header (e.g. "Nats-Sequence" of JetStream),
+// messages are held up to Window(default 100ms) or MaxPending(default 1024) waiting for missing sequences.
+// Late arrivals (sequence already released) are relayed unless DropLate
+type OrderingConfig struct {
+	Header     string        `yaml:"header"`
+	Window     time.Duration `yaml:"window"`
+	MaxPending int           `yaml:"max-pending"`
+	DropLate   bool          `yaml:"drop-late"`
+}
+
+func (c OrderingConfig) Configured() bool {
+	return 0 < len(c.Header)
+}
+
+// AggregateConfig combines messages per partition key into a message of Format "json"(default, array of records)
+// or "binary"(length prefixed records), published to Subject(default: subject of the first message) when
+// Window(default 1s) elapsed, MaxCount(default 1000) messages or MaxBytes(default 512KB) of combined payload collected.
+// Mode "split" relays each message of combined messages instead, after decrypt and decompress of the topic
+type AggregateConfig struct {
+	Mode     string        `yaml:"mode"`
+	Window   time.Duration `yaml:"window"`
+	MaxCount int           `yaml:"max-count"`
+	MaxBytes int           `yaml:"max-bytes"`
+	Format   string        `yaml:"format"`
+	Subject  string        `yaml:"subject"`
+}
+
+func (c AggregateConfig) Configured() bool {
+	return 0 < len(c.Mode) || 0 < c.Window || 0 < c.MaxCount || 0 < c.MaxBytes
+}
+
+// DelayConfig holds messages and relays each after Duration or at the time given by Header(default "Nrelay-Deliver-At",
+// RFC3339 or unix milliseconds). Held messages are kept in journal Path if configured (released after restart),
+// otherwise relayed immediately on shutdown. Journal is fsynced every SyncInterval(default 1s).
+// Messages over MaxPending(default 100000) are relayed without delay
+type DelayConfig struct {
+	Duration     time.Duration `yaml:"duration"`
+	Header       string        `yaml:"header"`
+	Path         string        `yaml:"path"`
+	SyncInterval time.Duration `yaml:"sync-interval"`
+	MaxPending   int           `yaml:"max-pending"`
+}
+
+func (c DelayConfig) Configured() bool {
+	return 0 < c.Duration || 0 < len(c.Header)
+}
+
+// BufferConfig configures destination worker queue, Type "chanque"(default) or "ring"(lock-free ring buffer),
+// Capacity(default 1024) of queue, Batch(default 32) of dequeue, FlushTimeout(default 50ms) of flush after dequeue.
+// FlushMode "fixed"(default) flushes after every batch, "adaptive" coalesces flushes up to FlushMaxDelay(default 10ms) on high rate
+type BufferConfig struct {
+	Type          string        `yaml:"type"`
+	Capacity      int           `yaml:"capacity"`
+	Batch         int           `yaml:"batch"`
+	FlushTimeout  time.Duration `yaml:"flush-timeout"`
+	FlushMode     string        `yaml:"flush-mode"`
+	FlushMaxDelay time.Duration `yaml:"flush-max-delay"`
+}
+
+func (c BufferConfig) capacity() int {
+	if 0 < c.Capacity {
+		return c.Capacity
+	}
+	return defaultWorkerCapacity
+}
+
+func (c BufferConfig) batchSize() int {
+	if 0 < c.Batch {
+		return c.Batch
+	}
+	return defaultWorkerMaxMsgSize
+}
+
+func (c BufferConfig) flushTimeout() time.Duration {
+	if 0 < c.FlushTimeout {
+		return c.FlushTimeout
+	}
+	return defaultFlushTimeout
+}
+
+// RetryConfig retries failed publishes up to MaxAttempts(including first attempt) for retryable errors,
+// wait is Backoff(default 100ms) doubled for each attempt up to MaxBackoff(default 5s), reduced randomly by Jitter ratio(0.0 - 1.0)
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max-attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	MaxBackoff  time.Duration `yaml:"max-backoff"`
+	Jitter      float64       `yaml:"jitter"`
+}
+
+func (c RetryConfig) Configured() bool {
+	return 1 < c.MaxAttempts
+}
+
+// DeadLetterConfig stores messages that failed to relay(publish error, queue full) to Subject (published to nats) and/or File (NDJSON),
+// failure reason, original subject, attempts and timestamp are set in Nrelay-Dlq-* headers
+type DeadLetterConfig struct {
+	Subject string `yaml:"subject"`
+	File    string `yaml:"file"`
+}
+
+func (c DeadLetterConfig) Configured() bool {
+	return 0 < len(c.Subject) || 0 < len(c.File)
 }
 
 func Topics(topics ...*topicNameOptionTuple) map[string]RelayClientConfig {
@@ -68,3 +555,93 @@ func PrefixSize(size int) topicOptionFunc {
 		opt.PrefixSize = size
 	}
 }
+
+func Queue(group string) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Queue = group
+	}
+}
+
+func RateLimit(conf RateLimitConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.RateLimit = conf
+	}
+}
+
+func Codec(conf CodecConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Codec = conf
+	}
+}
+
+func Encryption(conf EncryptionConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Encryption = conf
+	}
+}
+
+func Wasm(conf WasmConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Wasm = conf
+	}
+}
+
+func Script(conf ScriptConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Script = conf
+	}
+}
+
+func Schema(conf SchemaConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Schema = conf
+	}
+}
+
+func Partition(conf PartitionConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Partition = conf
+	}
+}
+
+func Ordering(conf OrderingConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Ordering = conf
+	}
+}
+
+func Aggregate(conf AggregateConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Aggregate = conf
+	}
+}
+
+func Delay(conf DelayConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Delay = conf
+	}
+}
+
+func Buffer(conf BufferConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Buffer = conf
+	}
+}
+
+func Retry(conf RetryConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Retry = conf
+	}
+}
+
+func DeadLetter(conf DeadLetterConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.DeadLetter = conf
+	}
+}
+
+func Tap(conf TapConfig) topicOptionFunc {
+	return func(opt *RelayClientConfig) {
+		opt.Tap = conf
+	}
+}
@@ -0,0 +1,193 @@
+package nrelay
+
+import (
+	"expvar"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	HeaderDeadLetterReason    string = "Nrelay-Dlq-Reason"
+	HeaderDeadLetterSubject   string = "Nrelay-Dlq-Subject"
+	HeaderDeadLetterAttempts  string = "Nrelay-Dlq-Attempts"
+	HeaderDeadLetterTimestamp string = "Nrelay-Dlq-Timestamp"
+	HeaderDeadLetterError     string = "Nrelay-Dlq-Error"
+)
+
+const (
+	DeadLetterReasonPublish    string = "publish"
+	DeadLetterReasonQueueFull  string = "queue_full"
+	DeadLetterReasonTransform  string = "transform"
+	DeadLetterReasonValidation string = "validation"
+)
+
+const (
+	metricDeadLettered     string = "dead_lettered"
+	metricDeadLetterFailed string = "dead_letter_failed"
+)
+
+// deadLetter republishes messages that failed to relay to DLQ subject or local file.
+// Messages not yet transformed by destination (queue full, validation) are transformed before stored,
+// so that dead letters are always stored as the destination would receive
+type deadLetter struct {
+	topic      string
+	conf       DeadLetterConfig
+	natsUrl    string
+	natsOpts   []nats.Option
+	transforms []payloadTransform
+	logger     *log.Logger
+	metrics    *expvar.Map
+	conn       *nats.Conn
+	file       *os.File
+	writer     *RecordWriter
+}
+
+func (d *deadLetter) Open() error {
+	if 0 < len(d.conf.Subject) {
+		conn, err := nats.Connect(d.natsUrl, d.natsOpts...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		d.logger.Printf("debug: dead-letter connect %s", d.natsUrl)
+		d.conn = conn
+	}
+	if 0 < len(d.conf.File) {
+		f, err := os.OpenFile(d.conf.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		d.file = f
+		d.writer = NewRecordWriter(f)
+	}
+	return nil
+}
+
+func (d *deadLetter) Close() error {
+	if d.conn != nil {
+		d.conn.Flush()
+		d.conn.Close()
+		d.conn = nil
+	}
+	for _, t := range d.transforms {
+		t.Close()
+	}
+	d.transforms = nil
+	if d.file != nil {
+		if err := d.file.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+		d.file = nil
+	}
+	return nil
+}
+
+// transform returns copy of msg converted by payload transforms of destination
+func (d *deadLetter) transform(msg *nats.Msg) (*nats.Msg, error) {
+	out := &nats.Msg{Subject: msg.Subject, Header: copyHeader(msg.Header), Data: msg.Data}
+	for _, t := range d.transforms {
+		if err := t.Apply(out); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return out, nil
+}
+
+// Send stores msg with failure reason, attempts is the number of publish attempts
+func (d *deadLetter) Send(reason string, attempts int, msg *nats.Msg, cause error) {
+	if (reason == DeadLetterReasonQueueFull || reason == DeadLetterReasonValidation) && 0 < len(d.transforms) {
+		transformed, err := d.transform(msg)
+		if err != nil {
+			reason, cause = DeadLetterReasonTransform, err
+		} else {
+			msg = transformed
+		}
+	}
+
+	now := time.Now()
+	header := deadLetterHeader(reason, attempts, now, msg, cause)
+
+	d.metrics.Add(metricDeadLettered, 1)
+	if d.conn != nil {
+		out := &nats.Msg{
+			Subject: d.conf.Subject,
+			Header:  header,
+			Data:    msg.Data,
+		}
+		if err := d.conn.PublishMsg(out); err != nil {
+			d.metrics.Add(metricDeadLetterFailed, 1)
+			d.logger.Printf("error: failed to dead-letter subj:%s reason:%s err:%+v", msg.Subject, reason, err)
+		}
+	}
+	if d.writer != nil {
+		r := Record{
+			Subject:    msg.Subject,
+			Header:     header,
+			Data:       msg.Data,
+			ReceivedAt: now,
+		}
+		if err := d.writer.Write(r); err != nil {
+			d.metrics.Add(metricDeadLetterFailed, 1)
+			d.logger.Printf("error: failed to dead-letter subj:%s reason:%s err:%+v", msg.Subject, reason, err)
+		}
+	}
+}
+
+func deadLetterHeader(reason string, attempts int, now time.Time, msg *nats.Msg, cause error) nats.Header {
+	header := copyHeader(msg.Header)
+	if header == nil {
+		header = nats.Header{}
+	}
+	header.Set(HeaderDeadLetterReason, reason)
+	header.Set(HeaderDeadLetterSubject, msg.Subject)
+	header.Set(HeaderDeadLetterAttempts, strconv.Itoa(attempts))
+	header.Set(HeaderDeadLetterTimestamp, now.Format(time.RFC3339Nano))
+	if cause != nil {
+		header.Set(HeaderDeadLetterError, strings.ReplaceAll(errors.Cause(cause).Error(), "\n", " "))
+	}
+	return header
+}
+
+// RestoreDeadLetter returns msg to re-inject, subject is restored from Nrelay-Dlq-Subject header
+// and dead-letter headers are removed
+func RestoreDeadLetter(msg *nats.Msg) *nats.Msg {
+	header := copyHeader(msg.Header)
+	subject := msg.Subject
+	if s := header.Get(HeaderDeadLetterSubject); 0 < len(s) {
+		subject = s
+	}
+	for _, key := range []string{
+		HeaderDeadLetterReason,
+		HeaderDeadLetterSubject,
+		HeaderDeadLetterAttempts,
+		HeaderDeadLetterTimestamp,
+		HeaderDeadLetterError,
+	} {
+		header.Del(key)
+	}
+	if len(header) == 0 {
+		header = nil
+	}
+	return &nats.Msg{
+		Subject: subject,
+		Header:  header,
+		Data:    msg.Data,
+	}
+}
+
+func newDeadLetter(topic string, conf DeadLetterConfig, natsUrl string, natsOpts []nats.Option, transforms []payloadTransform, logger *log.Logger, metrics *expvar.Map) *deadLetter {
+	return &deadLetter{
+		topic:      topic,
+		conf:       conf,
+		natsUrl:    natsUrl,
+		natsOpts:   natsOpts,
+		transforms: transforms,
+		logger:     logger,
+		metrics:    metrics,
+	}
+}
@@ -0,0 +1,180 @@
+package nrelay
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+func testReadRecords(t *testing.T, path string) []Record {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer f.Close()
+
+	records := make([]Record, 0)
+	r := NewRecordReader(f)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("must no error: %+v", err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestRestoreDeadLetter(t *testing.T) {
+	t.Run("subject", func(tt *testing.T) {
+		msg := &nats.Msg{Subject: "test.dlq", Header: nats.Header{}, Data: []byte("hello")}
+		msg.Header.Set("X-App", "1")
+		msg.Header.Set(HeaderDeadLetterReason, DeadLetterReasonPublish)
+		msg.Header.Set(HeaderDeadLetterSubject, "test.1")
+		msg.Header.Set(HeaderDeadLetterAttempts, "3")
+
+		out := RestoreDeadLetter(msg)
+		if out.Subject != "test.1" {
+			tt.Errorf("subject must be restored: %s", out.Subject)
+		}
+		if out.Header.Get("X-App") != "1" {
+			tt.Errorf("other headers must be kept: %v", out.Header)
+		}
+		if out.Header.Get(HeaderDeadLetterReason) != "" || out.Header.Get(HeaderDeadLetterAttempts) != "" {
+			tt.Errorf("dead-letter headers must be removed: %v", out.Header)
+		}
+		if msg.Header.Get(HeaderDeadLetterReason) == "" {
+			tt.Errorf("original header must not be modified")
+		}
+	})
+	t.Run("no/header", func(tt *testing.T) {
+		out := RestoreDeadLetter(&nats.Msg{Subject: "test.1", Data: []byte("hello")})
+		if out.Subject != "test.1" || out.Header != nil {
+			tt.Errorf("unexpected msg: %+v", out)
+		}
+	})
+}
+
+func TestDeadLetterFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.ndjson")
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	metrics := new(expvar.Map).Init()
+	dl := newDeadLetter("test.>", DeadLetterConfig{File: path}, "", nil, nil, lg, metrics)
+	if err := dl.Open(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	dl.Send(DeadLetterReasonQueueFull, 0, &nats.Msg{Subject: "test.1", Data: []byte("a")}, errors.New("full"))
+	dl.Send(DeadLetterReasonPublish, 2, &nats.Msg{Subject: "test.2", Data: []byte("b")}, errors.Wrap(nats.ErrConnectionClosed, "wrapped"))
+	if err := dl.Close(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	records := testReadRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expect 2 records: %d", len(records))
+	}
+	if r := records[0]; r.Subject != "test.1" || r.Header.Get(HeaderDeadLetterReason) != DeadLetterReasonQueueFull || r.Header.Get(HeaderDeadLetterAttempts) != "0" {
+		t.Errorf("unexpected record: %+v", r)
+	}
+	if r := records[1]; r.Header.Get(HeaderDeadLetterError) != nats.ErrConnectionClosed.Error() || r.Header.Get(HeaderDeadLetterAttempts) != "2" {
+		t.Errorf("unexpected record: %+v", r)
+	}
+	if records[1].Header.Get(HeaderDeadLetterTimestamp) == "" {
+		t.Errorf("timestamp must be set")
+	}
+	if v := metrics.Get(metricDeadLettered).String(); v != "2" {
+		t.Errorf("expect:2 actual:%s", v)
+	}
+}
+
+func TestDeadLetterTransform(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.ndjson")
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	transforms, err := newPayloadTransforms(CodecConfig{Mode: CodecModeCompress, Type: CodecGzip}, EncryptionConfig{})
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	dl := newDeadLetter("test.>", DeadLetterConfig{File: path}, "", nil, transforms, lg, new(expvar.Map).Init())
+	if err := dl.Open(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	msg := &nats.Msg{Subject: "test.1", Data: []byte("plain")}
+	dl.Send(DeadLetterReasonQueueFull, 0, msg, errors.New("full"))
+	// already transformed by destination
+	dl.Send(DeadLetterReasonPublish, 1, &nats.Msg{Subject: "test.2", Data: []byte("sent")}, errors.New("timeout"))
+	if err := dl.Close(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	if string(msg.Data) != "plain" || msg.Header != nil {
+		t.Errorf("original msg must be kept: %+v", msg)
+	}
+
+	records := testReadRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expect 2 records: %d", len(records))
+	}
+	if r := records[0]; r.Header.Get(HeaderContentEncoding) != CodecGzip || string(r.Data) == "plain" {
+		t.Errorf("queue full must be transformed: %+v", r)
+	}
+	if r := records[1]; r.Header.Get(HeaderContentEncoding) != "" || string(r.Data) != "sent" {
+		t.Errorf("publish failure is stored as is: %+v", r)
+	}
+}
+
+func TestDestinationDeadLetter(t *testing.T) {
+	ns, ok := testNatsServerStart()
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer ns.Shutdown()
+
+	e := chanque.NewExecutor(10, 10)
+	t.Cleanup(func() { e.Release() })
+
+	url := fmt.Sprintf("nats://%s", ns.Addr().String())
+	path := filepath.Join(t.TempDir(), "dlq.ndjson")
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	dl := newDeadLetter("test.>", DeadLetterConfig{File: path}, url, nil, nil, lg, new(expvar.Map).Init())
+	if err := dl.Open(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	dst := NewSingleDestination(e, url, nil, lg, destinationOptDeadLetter(dl))
+	if err := dst.Open(1); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	// larger than MaxPayload of test server
+	tooLarge := bytes.Repeat([]byte("a"), 2048)
+	dst.Workers()[0].Enqueue(&nats.Msg{Subject: "test.large", Data: tooLarge})
+	dst.Workers()[0].Enqueue(&nats.Msg{Subject: "test.small", Data: []byte("ok")})
+	dst.Close()
+	dl.Close()
+
+	records := testReadRecords(t, path)
+	if len(records) != 1 {
+		t.Fatalf("only failed msg must be dead-lettered: %d", len(records))
+	}
+	r := records[0]
+	if r.Subject != "test.large" || r.Header.Get(HeaderDeadLetterReason) != DeadLetterReasonPublish {
+		t.Errorf("unexpected record: subj:%s header:%v", r.Subject, r.Header)
+	}
+	if bytes.Equal(r.Data, tooLarge) != true {
+		t.Errorf("payload must be kept")
+	}
+	if out := RestoreDeadLetter(r.Msg()); out.Subject != "test.large" || out.Header != nil {
+		t.Errorf("unexpected restored msg: %+v", out.Header)
+	}
+}
@@ -0,0 +1,584 @@
+package nrelay
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"expvar"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	HeaderDeliverAt string = "Nrelay-Deliver-At"
+)
+
+const (
+	defaultDelayMaxPending   int           = 100000
+	defaultDelaySyncInterval time.Duration = time.Second
+	delayCompactThreshold    int           = 10000
+	delayIdleWait            time.Duration = time.Hour
+	delayRetryWait           time.Duration = time.Second
+)
+
+const (
+	delayJournalOpAdd  string = "add"
+	delayJournalOpDone string = "done"
+)
+
+const (
+	metricDelayHeld     string = "delay_held"
+	metricDelayReleased string = "delay_released"
+	metricDelayOverflow string = "delay_overflow"
+	metricDelayInvalid  string = "delay_invalid"
+	metricDelayRetried  string = "delay_retried"
+)
+
+type delayItem struct {
+	id        uint64
+	deliverAt time.Time
+	msg       *nats.Msg
+	next      RelayHandler
+}
+
+func (i *delayItem) entry() delayJournalEntry {
+	rec := Record{Subject: i.msg.Subject, Header: i.msg.Header, Data: i.msg.Data}
+	return delayJournalEntry{delayJournalOpAdd, i.id, i.deliverAt, &rec}
+}
+
+// delayHeap is min-heap of deliverAt, messages of the same time are released in arrival order
+type delayHeap []*delayItem
+
+func (h delayHeap) Len() int { return len(h) }
+func (h delayHeap) Less(i, j int) bool {
+	if h[i].deliverAt.Equal(h[j].deliverAt) {
+		return h[i].id < h[j].id
+	}
+	return h[i].deliverAt.Before(h[j].deliverAt)
+}
+func (h delayHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *delayHeap) Push(x interface{}) {
+	*h = append(*h, x.(*delayItem))
+}
+
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[0 : n-1]
+	return item
+}
+
+// delayJournalEntry is a line of journal, held messages are "add" and released ones are "done"
+type delayJournalEntry struct {
+	Op        string    `json:"op"`
+	Id        uint64    `json:"id"`
+	DeliverAt time.Time `json:"deliver_at,omitempty"`
+	Record    *Record   `json:"record,omitempty"`
+}
+
+// delayJournal is append only NDJSON of held messages, writes are buffered and synced by Sync.
+// While compacting, entries are written to both the current journal and backlog
+// so that the compacted journal does not miss entries written during compaction
+type delayJournal struct {
+	path       string
+	mutex      *sync.Mutex
+	file       *os.File
+	w          *bufio.Writer
+	enc        *json.Encoder
+	released   int
+	compacting bool
+	backlog    []delayJournalEntry
+}
+
+func (j *delayJournal) Append(e delayJournalEntry) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.compacting {
+		j.backlog = append(j.backlog, e)
+	}
+	if e.Op == delayJournalOpDone {
+		j.released += 1
+	}
+	if err := j.enc.Encode(e); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Sync flushes buffered entries and fsyncs journal
+func (j *delayJournal) Sync() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if err := j.w.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (j *delayJournal) needsCompaction() bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return delayCompactThreshold <= j.released
+}
+
+// startCompaction begins collecting backlog, snapshot of held messages must be taken after this
+func (j *delayJournal) startCompaction() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.compacting = true
+	j.backlog = make([]delayJournalEntry, 0)
+}
+
+// finishCompaction writes snapshot then backlog to new journal and replaces the current one
+func (j *delayJournal) finishCompaction(snapshot []delayJournalEntry) error {
+	tmp, err := createDelayJournal(j.path+".tmp", snapshot)
+	if err != nil {
+		j.mutex.Lock()
+		j.compacting = false
+		j.backlog = nil
+		j.mutex.Unlock()
+		return errors.WithStack(err)
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.compacting = false
+	backlog := j.backlog
+	j.backlog = nil
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range backlog {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			return errors.WithStack(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(j.path+".tmp", j.path); err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+
+	// entries written to old journal are included in snapshot or backlog
+	j.w.Flush()
+	j.file.Close()
+	j.file = tmp
+	j.w = w
+	j.enc = enc
+	j.released = 0
+	return nil
+}
+
+func (j *delayJournal) Close() error {
+	if err := j.Sync(); err != nil {
+		j.file.Close()
+		return errors.WithStack(err)
+	}
+	if err := j.file.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// readDelayJournal returns held messages of journal in path
+func readDelayJournal(path string) ([]delayJournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	added := make(map[uint64]delayJournalEntry)
+	order := make([]uint64, 0)
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		e := delayJournalEntry{}
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break // last line may be partially written
+			}
+			return nil, errors.Wrapf(err, "journal: %s", path)
+		}
+		switch e.Op {
+		case delayJournalOpAdd:
+			if e.Record == nil {
+				continue
+			}
+			if _, ok := added[e.Id]; ok != true {
+				order = append(order, e.Id)
+			}
+			added[e.Id] = e
+		case delayJournalOpDone:
+			delete(added, e.Id)
+		}
+	}
+
+	entries := make([]delayJournalEntry, 0, len(added))
+	for _, id := range order {
+		if e, ok := added[id]; ok {
+			entries = append(entries, e)
+			delete(added, id)
+		}
+	}
+	return entries, nil
+}
+
+// createDelayJournal writes entries to path and returns it opened for append
+func createDelayJournal(path string, entries []delayJournalEntry) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+	return f, nil
+}
+
+// openDelayJournal reads held messages of path and rewrites journal with them
+func openDelayJournal(path string) (*delayJournal, []delayJournalEntry, error) {
+	loaded, err := readDelayJournal(path)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	f, err := createDelayJournal(path+".tmp", loaded)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, nil, errors.WithStack(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		f.Close()
+		return nil, nil, errors.WithStack(err)
+	}
+	w := bufio.NewWriter(f)
+	return &delayJournal{path, new(sync.Mutex), f, w, json.NewEncoder(w), 0, false, nil}, loaded, nil
+}
+
+// delay holds messages in time ordered queue and releases each at its delivery time,
+// the time is given by header (RFC3339 or unix milliseconds) or arrival time + duration.
+// With journal, held messages survive restart and are released after restart
+type delay struct {
+	topic        string
+	conf         DelayConfig
+	header       string
+	maxPending   int
+	syncInterval time.Duration
+	logger       *log.Logger
+	metrics      *expvar.Map
+	mutex        *sync.Mutex
+	pending      delayHeap
+	inflight     map[uint64]*delayItem
+	seq          uint64
+	loaded       []delayJournalEntry
+	journal      *delayJournal
+	once         *sync.Once
+	wakeup       chan struct{}
+	done         chan struct{}
+	wg           *sync.WaitGroup
+}
+
+// deliverAt returns delivery time of msg, invalid header falls back to duration
+func (d *delay) deliverAt(msg *nats.Msg, now time.Time) time.Time {
+	if msg.Header != nil {
+		if v := msg.Header.Get(d.header); 0 < len(v) {
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t
+			}
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.UnixMilli(ms)
+			}
+			d.metrics.Add(metricDelayInvalid, 1)
+		}
+	}
+	return now.Add(d.conf.Duration)
+}
+
+func (d *delay) Middleware(topic string, next RelayHandler) RelayHandler {
+	// messages restored from journal are released by handler of the first connection
+	d.once.Do(func() {
+		d.restore(next)
+	})
+
+	return func(msg *nats.Msg) error {
+		now := time.Now()
+		at := d.deliverAt(msg, now)
+		if at.After(now) != true {
+			return next(msg)
+		}
+
+		d.mutex.Lock()
+		if d.maxPending <= len(d.pending) {
+			d.mutex.Unlock()
+			d.metrics.Add(metricDelayOverflow, 1)
+			return next(msg)
+		}
+		d.seq += 1
+		item := &delayItem{d.seq, at, msg, next}
+		if d.journal != nil {
+			if err := d.journal.Append(item.entry()); err != nil {
+				d.logger.Printf("warn: failed to journal delayed msg topic:%s err:%+v", d.topic, err)
+			}
+		}
+		heap.Push(&d.pending, item)
+		head := d.pending[0] == item
+		d.mutex.Unlock()
+
+		d.metrics.Add(metricDelayHeld, 1)
+		if head {
+			d.notify()
+		}
+		return nil
+	}
+}
+
+func (d *delay) notify() {
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (d *delay) restore(next RelayHandler) {
+	d.mutex.Lock()
+	for _, e := range d.loaded {
+		heap.Push(&d.pending, &delayItem{e.Id, e.DeliverAt, e.Record.Msg(), next})
+	}
+	if 0 < len(d.loaded) {
+		d.logger.Printf("info: %d delayed messages restored topic:%s", len(d.loaded), d.topic)
+	}
+	d.loaded = nil
+	d.mutex.Unlock()
+
+	d.notify()
+}
+
+// releaseDue releases messages whose time has come, returns wait until the next one
+func (d *delay) releaseDue(now time.Time) time.Duration {
+	for {
+		d.mutex.Lock()
+		if len(d.pending) < 1 {
+			d.mutex.Unlock()
+			return delayIdleWait
+		}
+		if head := d.pending[0]; head.deliverAt.After(now) {
+			d.mutex.Unlock()
+			return head.deliverAt.Sub(now)
+		}
+		item := heap.Pop(&d.pending).(*delayItem)
+		d.inflight[item.id] = item
+		d.mutex.Unlock()
+
+		d.release(item)
+	}
+}
+
+// release relays item, "done" is journaled after relayed otherwise item is retried later
+func (d *delay) release(item *delayItem) {
+	err := item.next(item.msg)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.inflight, item.id)
+	if err != nil {
+		d.logger.Printf("warn: delay release error topic:%s subj:%s err:%+v", d.topic, item.msg.Subject, err)
+		d.metrics.Add(metricDelayRetried, 1)
+		item.deliverAt = time.Now().Add(delayRetryWait)
+		heap.Push(&d.pending, item)
+		return
+	}
+
+	d.metrics.Add(metricDelayReleased, 1)
+	if d.journal != nil {
+		if err := d.journal.Append(delayJournalEntry{Op: delayJournalOpDone, Id: item.id}); err != nil {
+			d.logger.Printf("warn: failed to journal released msg topic:%s err:%+v", d.topic, err)
+		}
+	}
+}
+
+// snapshot returns held messages including being released, d.mutex must be locked
+func (d *delay) snapshot() []delayJournalEntry {
+	entries := make([]delayJournalEntry, 0, len(d.loaded)+len(d.pending)+len(d.inflight))
+	entries = append(entries, d.loaded...)
+	for _, item := range d.pending {
+		entries = append(entries, item.entry())
+	}
+	for _, item := range d.inflight {
+		entries = append(entries, item.entry())
+	}
+	return entries
+}
+
+// compact rewrites journal with held messages, file is written without holding d.mutex
+func (d *delay) compact() error {
+	d.mutex.Lock()
+	d.journal.startCompaction()
+	entries := d.snapshot()
+	d.mutex.Unlock()
+
+	return d.journal.finishCompaction(entries)
+}
+
+func (d *delay) run() {
+	defer d.wg.Done()
+
+	for {
+		t := time.NewTimer(d.releaseDue(time.Now()))
+		select {
+		case <-d.done:
+			t.Stop()
+			return
+		case <-d.wakeup:
+			t.Stop()
+		case <-t.C:
+		}
+	}
+}
+
+// runJournal syncs journal every syncInterval and compacts it off the subscription path
+func (d *delay) runJournal() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			if err := d.journal.Sync(); err != nil {
+				d.logger.Printf("warn: failed to sync delay journal topic:%s err:%+v", d.topic, err)
+			}
+			if d.journal.needsCompaction() {
+				if err := d.compact(); err != nil {
+					d.logger.Printf("warn: failed to compact delay journal topic:%s err:%+v", d.topic, err)
+				}
+			}
+		}
+	}
+}
+
+// Close stops timer, held messages are kept in journal if configured otherwise released immediately
+func (d *delay) Close() error {
+	close(d.done)
+	d.wg.Wait()
+
+	if d.journal != nil {
+		if err := d.compact(); err != nil {
+			d.journal.Close()
+			return errors.WithStack(err)
+		}
+		if err := d.journal.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	d.mutex.Lock()
+	items := make([]*delayItem, 0, len(d.pending))
+	for 0 < len(d.pending) {
+		items = append(items, heap.Pop(&d.pending).(*delayItem))
+	}
+	d.mutex.Unlock()
+
+	for _, item := range items {
+		d.metrics.Add(metricDelayReleased, 1)
+		if err := item.next(item.msg); err != nil {
+			d.logger.Printf("warn: delay release error topic:%s subj:%s err:%+v", d.topic, item.msg.Subject, err)
+		}
+	}
+	return nil
+}
+
+func newDelay(topic string, conf DelayConfig, logger *log.Logger, metrics *expvar.Map) (*delay, error) {
+	header := conf.Header
+	if len(header) < 1 {
+		header = HeaderDeliverAt
+	}
+	maxPending := conf.MaxPending
+	if maxPending < 1 {
+		maxPending = defaultDelayMaxPending
+	}
+	syncInterval := conf.SyncInterval
+	if syncInterval <= 0 {
+		syncInterval = defaultDelaySyncInterval
+	}
+
+	d := &delay{
+		topic:        topic,
+		conf:         conf,
+		header:       header,
+		maxPending:   maxPending,
+		syncInterval: syncInterval,
+		logger:       logger,
+		metrics:      metrics,
+		mutex:        new(sync.Mutex),
+		pending:      make(delayHeap, 0),
+		inflight:     make(map[uint64]*delayItem),
+		once:         new(sync.Once),
+		wakeup:       make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		wg:           new(sync.WaitGroup),
+	}
+	if 0 < len(conf.Path) {
+		journal, loaded, err := openDelayJournal(conf.Path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, e := range loaded {
+			if d.seq < e.Id {
+				d.seq = e.Id
+			}
+		}
+		d.journal = journal
+		d.loaded = loaded
+
+		d.wg.Add(1)
+		go d.runJournal()
+	}
+	d.wg.Add(1)
+	go d.run()
+	return d, nil
+}
@@ -0,0 +1,213 @@
+package nrelay
+
+import (
+	"expvar"
+	"log"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+type testDelayCollector struct {
+	mutex    *sync.Mutex
+	subjects []string
+}
+
+func (c *testDelayCollector) next(msg *nats.Msg) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.subjects = append(c.subjects, msg.Subject)
+	return nil
+}
+
+func (c *testDelayCollector) get() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]string(nil), c.subjects...)
+}
+
+func testNewDelay(t *testing.T, conf DelayConfig) (*delay, RelayHandler, *testDelayCollector, *expvar.Map) {
+	lg := log.New(&testTapLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	metrics := new(expvar.Map).Init()
+	d, err := newDelay("test.>", conf, lg, metrics)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	c := &testDelayCollector{mutex: new(sync.Mutex)}
+	return d, d.Middleware("test.>", c.next), c, metrics
+}
+
+func testDelayMsg(subject string, deliverAt string) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	if 0 < len(deliverAt) {
+		msg.Header.Set(HeaderDeliverAt, deliverAt)
+	}
+	return msg
+}
+
+func TestDelay(t *testing.T) {
+	t.Run("duration", func(tt *testing.T) {
+		d, h, c, metrics := testNewDelay(tt, DelayConfig{Duration: 50 * time.Millisecond})
+		defer d.Close()
+
+		h(testDelayMsg("test.a", ""))
+		h(testDelayMsg("test.b", ""))
+		testEqualSeqs(tt, []string{}, c.get())
+
+		time.Sleep(150 * time.Millisecond)
+		testEqualSeqs(tt, []string{"test.a", "test.b"}, c.get())
+		if v := metrics.Get(metricDelayReleased).String(); v != "2" {
+			tt.Errorf("expect:2 actual:%s", v)
+		}
+	})
+	t.Run("header", func(tt *testing.T) {
+		d, h, c, _ := testNewDelay(tt, DelayConfig{Header: HeaderDeliverAt})
+		defer d.Close()
+
+		now := time.Now()
+		h(testDelayMsg("test.late", now.Add(100*time.Millisecond).Format(time.RFC3339Nano)))
+		h(testDelayMsg("test.early", strconv.FormatInt(now.Add(50*time.Millisecond).UnixMilli(), 10)))
+		h(testDelayMsg("test.now", ""))
+		testEqualSeqs(tt, []string{"test.now"}, c.get())
+
+		time.Sleep(200 * time.Millisecond)
+		testEqualSeqs(tt, []string{"test.now", "test.early", "test.late"}, c.get())
+	})
+	t.Run("header/past", func(tt *testing.T) {
+		d, h, c, _ := testNewDelay(tt, DelayConfig{Duration: time.Minute})
+		defer d.Close()
+
+		h(testDelayMsg("test.a", time.Now().Add(-1*time.Second).Format(time.RFC3339Nano)))
+		testEqualSeqs(tt, []string{"test.a"}, c.get())
+	})
+	t.Run("header/invalid", func(tt *testing.T) {
+		d, h, c, metrics := testNewDelay(tt, DelayConfig{Duration: time.Minute})
+		defer d.Close()
+
+		h(testDelayMsg("test.a", "tomorrow"))
+		testEqualSeqs(tt, []string{}, c.get())
+		if v := metrics.Get(metricDelayInvalid).String(); v != "1" {
+			tt.Errorf("expect:1 actual:%s", v)
+		}
+	})
+	t.Run("max-pending", func(tt *testing.T) {
+		d, h, c, metrics := testNewDelay(tt, DelayConfig{Duration: time.Minute, MaxPending: 1})
+		defer d.Close()
+
+		h(testDelayMsg("test.a", ""))
+		h(testDelayMsg("test.b", ""))
+		testEqualSeqs(tt, []string{"test.b"}, c.get())
+		if v := metrics.Get(metricDelayOverflow).String(); v != "1" {
+			tt.Errorf("expect:1 actual:%s", v)
+		}
+	})
+	t.Run("close/flush", func(tt *testing.T) {
+		d, h, c, _ := testNewDelay(tt, DelayConfig{Duration: time.Minute})
+
+		h(testDelayMsg("test.a", ""))
+		h(testDelayMsg("test.b", ""))
+		if err := d.Close(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		testEqualSeqs(tt, []string{"test.a", "test.b"}, c.get())
+	})
+	t.Run("retry", func(tt *testing.T) {
+		lg := log.New(&testTapLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+		metrics := new(expvar.Map).Init()
+		d, err := newDelay("test.>", DelayConfig{Duration: 10 * time.Millisecond}, lg, metrics)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer d.Close()
+
+		c := &testDelayCollector{mutex: new(sync.Mutex)}
+		failed := int32(0)
+		h := d.Middleware("test.>", func(msg *nats.Msg) error {
+			if atomic.AddInt32(&failed, 1) == 1 {
+				return errors.New("enqueue failed")
+			}
+			return c.next(msg)
+		})
+		h(testDelayMsg("test.a", ""))
+
+		time.Sleep(delayRetryWait + 200*time.Millisecond)
+		testEqualSeqs(tt, []string{"test.a"}, c.get())
+		if v := metrics.Get(metricDelayRetried).String(); v != "1" {
+			tt.Errorf("expect:1 actual:%s", v)
+		}
+	})
+	t.Run("journal/compact", func(tt *testing.T) {
+		path := filepath.Join(tt.TempDir(), "delay.journal")
+
+		d, h, _, _ := testNewDelay(tt, DelayConfig{Duration: time.Minute, Path: path})
+		h(testDelayMsg("test.a", ""))
+		h(testDelayMsg("test.b", time.Now().Add(10*time.Millisecond).Format(time.RFC3339Nano)))
+		time.Sleep(50 * time.Millisecond)
+
+		d.journal.startCompaction()
+		h(testDelayMsg("test.c", ""))
+		d.mutex.Lock()
+		snapshot := d.snapshot()
+		d.mutex.Unlock()
+		if err := d.journal.finishCompaction(snapshot); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if err := d.journal.Sync(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		entries, err := readDelayJournal(path)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		subjects := make([]string, 0, len(entries))
+		for _, e := range entries {
+			subjects = append(subjects, e.Record.Subject)
+		}
+		// test.c is in both snapshot and backlog
+		testEqualSeqs(tt, []string{"test.a", "test.c"}, subjects)
+		d.Close()
+	})
+	t.Run("journal", func(tt *testing.T) {
+		path := filepath.Join(tt.TempDir(), "delay.journal")
+
+		d1, h1, c1, _ := testNewDelay(tt, DelayConfig{Duration: time.Minute, Path: path})
+		h1(testDelayMsg("test.a", time.Now().Add(100*time.Millisecond).Format(time.RFC3339Nano)))
+		h1(testDelayMsg("test.b", time.Now().Add(150*time.Millisecond).Format(time.RFC3339Nano)))
+		h1(testDelayMsg("test.c", time.Now().Add(10*time.Millisecond).Format(time.RFC3339Nano)))
+		time.Sleep(50 * time.Millisecond)
+		if err := d1.Close(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		testEqualSeqs(tt, []string{"test.c"}, c1.get())
+
+		entries, err := readDelayJournal(path)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if len(entries) != 2 {
+			tt.Errorf("2 messages held: %d", len(entries))
+		}
+
+		d2, _, c2, _ := testNewDelay(tt, DelayConfig{Duration: time.Minute, Path: path})
+		testEqualSeqs(tt, []string{}, c2.get())
+		time.Sleep(200 * time.Millisecond)
+		testEqualSeqs(tt, []string{"test.a", "test.b"}, c2.get())
+		if err := d2.Close(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		left, _ := readDelayJournal(path)
+		if len(left) != 0 {
+			tt.Errorf("all messages released: %d", len(left))
+		}
+	})
+}
@@ -2,11 +2,15 @@ package nrelay
 
 import (
 	"log"
+	"sync"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/octu0/chanque"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -15,12 +19,256 @@ const (
 	defaultFlushTimeout     time.Duration = 50 * time.Millisecond
 )
 
+var (
+	publishMsgPool = &sync.Pool{
+		New: func() interface{} {
+			return new(nats.Msg)
+		},
+	}
+)
+
 type Destination interface {
 	Open(num int) error
 	Close() error
 	Workers() []chanque.Worker
 }
 
+type DestinationOptFunc func(*destinationOpt)
+
+type destinationOpt struct {
+	tracerProvider trace.TracerProvider
+	rateLimiters   []*RateLimiter
+	retryPolicy    *RetryPolicy
+	buffer         BufferConfig
+	codec          CodecConfig
+	encryption     EncryptionConfig
+	deadLetter     *deadLetter
+	stats          *topicStats
+}
+
+func DestinationOptTracerProvider(tp trace.TracerProvider) DestinationOptFunc {
+	return func(opt *destinationOpt) {
+		opt.tracerProvider = tp
+	}
+}
+
+// DestinationOptRateLimiter limits messages before publishing, nil limiters are ignored
+func DestinationOptRateLimiter(limiters ...*RateLimiter) DestinationOptFunc {
+	return func(opt *destinationOpt) {
+		for _, l := range limiters {
+			if l != nil {
+				opt.rateLimiters = append(opt.rateLimiters, l)
+			}
+		}
+	}
+}
+
+// DestinationOptRetryPolicy retries failed publishes inside the worker,
+// other workers(partitions) keep publishing while a worker waits backoff
+func DestinationOptRetryPolicy(p *RetryPolicy) DestinationOptFunc {
+	return func(opt *destinationOpt) {
+		opt.retryPolicy = p
+	}
+}
+
+// DestinationOptBuffer configures queue capacity, dequeue batch size and flush of workers
+func DestinationOptBuffer(conf BufferConfig) DestinationOptFunc {
+	return func(opt *destinationOpt) {
+		opt.buffer = conf
+	}
+}
+
+// DestinationOptCodec compresses or decompresses payloads before publishing
+func DestinationOptCodec(conf CodecConfig) DestinationOptFunc {
+	return func(opt *destinationOpt) {
+		opt.codec = conf
+	}
+}
+
+// DestinationOptEncryption encrypts or decrypts payloads before publishing
+func DestinationOptEncryption(conf EncryptionConfig) DestinationOptFunc {
+	return func(opt *destinationOpt) {
+		opt.encryption = conf
+	}
+}
+
+func destinationOptDeadLetter(d *deadLetter) DestinationOptFunc {
+	return func(opt *destinationOpt) {
+		opt.deadLetter = d
+	}
+}
+
+func destinationOptStats(t *topicStats) DestinationOptFunc {
+	return func(opt *destinationOpt) {
+		opt.stats = t
+	}
+}
+
+// payloadTransform converts payload of msg
+type payloadTransform interface {
+	Apply(*nats.Msg) error
+	Close()
+}
+
+// newPayloadTransforms orders transforms: decrypt -> (de)compress -> encrypt
+func newPayloadTransforms(codec CodecConfig, encryption EncryptionConfig) ([]payloadTransform, error) {
+	transforms := make([]payloadTransform, 0, 2)
+
+	enc, err := newPayloadEncryption(encryption)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if enc != nil && enc.mode == EncryptionModeDecrypt {
+		transforms = append(transforms, enc)
+	}
+
+	pc, err := newPayloadCodec(codec)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if pc != nil {
+		transforms = append(transforms, pc)
+	}
+
+	if enc != nil && enc.mode == EncryptionModeEncrypt {
+		transforms = append(transforms, enc)
+	}
+	return transforms, nil
+}
+
+// check interface
+var (
+	_ payloadTransform = (*payloadCodec)(nil)
+	_ payloadTransform = (*payloadEncryption)(nil)
+)
+
+// destinationPipeline is the worker pipeline shared by destinations:
+// transform -> throttle -> deliver with retry and trace -> stats / dead letter
+type destinationPipeline struct {
+	logger     *log.Logger
+	opt        *destinationOpt
+	tracing    *tracing
+	transforms []payloadTransform
+	done       chan struct{}
+	stopOnce   *sync.Once
+}
+
+// open creates transforms, decompressed payload is limited to maxPayload of destination if maxPayload is positive
+func (p *destinationPipeline) open(maxPayload int64) error {
+	codec := p.opt.codec
+	if 0 < maxPayload && maxPayload < codec.maxSize() {
+		codec.MaxSize = maxPayload
+	}
+	transforms, err := newPayloadTransforms(codec, p.opt.encryption)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	p.transforms = transforms
+	return nil
+}
+
+// stop interrupts retry backoff, msgs still queued are retried without waiting
+func (p *destinationPipeline) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+func (p *destinationPipeline) close() {
+	for _, t := range p.transforms {
+		t.Close()
+	}
+}
+
+// prepare transforms and throttles msg, returns false if msg is dropped or dead-lettered
+func (p *destinationPipeline) prepare(msg *nats.Msg) bool {
+	if err := p.transform(msg); err != nil {
+		p.logger.Printf("warn: failed to transform subj:%s err:%+v", msg.Subject, err)
+		p.failed(DeadLetterReasonTransform, 0, msg, err)
+		return false
+	}
+	if p.throttle(msg) != true {
+		return false
+	}
+	return true
+}
+
+// transform converts payload before publishing
+func (p *destinationPipeline) transform(msg *nats.Msg) error {
+	for _, t := range p.transforms {
+		if err := t.Apply(msg); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// throttle returns false if msg is dropped by rate limit, topic and destination limits are taken at once
+func (p *destinationPipeline) throttle(msg *nats.Msg) bool {
+	if len(p.opt.rateLimiters) < 1 {
+		return true
+	}
+	if takeRateLimiters(p.opt.rateLimiters, len(msg.Data)) != true {
+		p.logger.Printf("debug: rate limit exceeded, dropped subj:%s", msg.Subject)
+		return false
+	}
+	return true
+}
+
+// deliver calls write for msgs by retry policy, publish span of each msg covers retries
+// and its context is injected into outgoing headers before write.
+// failed msgs are sent to dead letter, returns error if write gave up
+func (p *destinationPipeline) deliver(msgs []*nats.Msg, write func() error) error {
+	var spans []trace.Span
+	if p.tracing != nil {
+		spans = make([]trace.Span, 0, len(msgs))
+		for _, msg := range msgs {
+			ctx, span := p.tracing.start(p.tracing.extract(msg), spanNamePublish, trace.SpanKindProducer, messagingAttributes(msg.Subject)...)
+			p.tracing.inject(ctx, msg)
+			spans = append(spans, span)
+		}
+	}
+
+	attempts, err := p.opt.retryPolicy.do(p.done, write, func(attempt int, err error) {
+		p.logger.Printf("debug: retry publish subj:%s msgs:%d attempt:%d err:%s", msgs[0].Subject, len(msgs), attempt, err.Error())
+	})
+	for _, span := range spans {
+		span.SetAttributes(attribute.Int("nrelay.attempts", attempts))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+
+	if err != nil {
+		p.logger.Printf("warn: failed to publish subj:%s msgs:%d attempts:%d err:%+v", msgs[0].Subject, len(msgs), attempts, err)
+		for _, msg := range msgs {
+			p.failed(DeadLetterReasonPublish, attempts, msg, err)
+		}
+		return errors.WithStack(err)
+	}
+	if p.opt.stats != nil {
+		for _, msg := range msgs {
+			p.opt.stats.Relayed(msg)
+		}
+	}
+	return nil
+}
+
+func (p *destinationPipeline) failed(reason string, attempts int, msg *nats.Msg, err error) {
+	if p.opt.stats != nil {
+		p.opt.stats.Failed(err)
+	}
+	if p.opt.deadLetter != nil {
+		p.opt.deadLetter.Send(reason, attempts, msg, err)
+	}
+}
+
+func newDestinationPipeline(logger *log.Logger, opt *destinationOpt) *destinationPipeline {
+	return &destinationPipeline{logger, opt, newTracing(opt.tracerProvider), nil, make(chan struct{}), new(sync.Once)}
+}
+
 // check interface
 var (
 	_ Destination = (*SingleDestination)(nil)
@@ -31,14 +279,14 @@ type SingleDestination struct {
 	url      string
 	natsOpts []nats.Option
 	logger   *log.Logger
+	opt      *destinationOpt
+	pipeline *destinationPipeline
 	conns    []*nats.Conn
 	workers  []chanque.Worker
 }
 
 func (d *SingleDestination) Open(num int) error {
 	conns := make([]*nats.Conn, 0, num)
-	workers := make([]chanque.Worker, 0, num)
-
 	for i := 0; i < num; i += 1 {
 		conn, err := nats.Connect(d.url, d.natsOpts...)
 		if err != nil {
@@ -47,14 +295,27 @@ func (d *SingleDestination) Open(num int) error {
 		d.logger.Printf("debug: nats destination connect %s", d.url)
 
 		conns = append(conns, conn)
-		workers = append(workers, d.createWorker(conn))
 	}
 	d.conns = conns
+
+	maxPayload := int64(0)
+	if 0 < len(conns) {
+		maxPayload = conns[0].MaxPayload()
+	}
+	if err := d.pipeline.open(maxPayload); err != nil {
+		return errors.WithStack(err)
+	}
+
+	workers := make([]chanque.Worker, 0, num)
+	for _, conn := range conns {
+		workers = append(workers, d.createWorker(conn))
+	}
 	d.workers = workers
 	return nil
 }
 
 func (d *SingleDestination) Close() error {
+	d.pipeline.stop()
 	for _, worker := range d.workers {
 		worker.CloseEnqueue()
 	}
@@ -65,6 +326,7 @@ func (d *SingleDestination) Close() error {
 		conn.Flush()
 		conn.Drain()
 	}
+	d.pipeline.close()
 	return nil
 }
 
@@ -72,34 +334,67 @@ func (d *SingleDestination) Workers() []chanque.Worker {
 	return d.workers
 }
 
+// createWorker returns worker that reports queue length for least-loaded partition
 func (d *SingleDestination) createWorker(conn *nats.Conn) chanque.Worker {
-	return chanque.NewDefaultWorker(
-		d.createWorkerHandler(conn),
+	counted := new(countedWorker)
+	flusher := newWorkerFlusher(conn, d.opt.buffer)
+	handler := counted.Handler(flusher.Handler(d.createWorkerHandler(conn)))
+	if d.opt.buffer.Type == BufferTypeRing {
+		counted.Worker = newRingWorker(
+			d.executor,
+			handler,
+			flusher.PostHook,
+			d.opt.buffer.capacity(),
+			d.opt.buffer.batchSize(),
+		)
+		return counted
+	}
+	counted.Worker = chanque.NewDefaultWorker(
+		handler,
 		chanque.WorkerExecutor(d.executor),
-		chanque.WorkerCapacity(defaultWorkerCapacity),
-		chanque.WorkerMaxDequeueSize(defaultWorkerMaxMsgSize),
-		chanque.WorkerPostHook(d.createWorkerPostHook(conn)),
+		chanque.WorkerCapacity(d.opt.buffer.capacity()),
+		chanque.WorkerMaxDequeueSize(d.opt.buffer.batchSize()),
+		chanque.WorkerPostHook(flusher.PostHook),
 		chanque.WorkerAbortQueueHandler(func(param interface{}) {
 			d.logger.Printf("error: destination queue aborted: %v", param)
 		}),
 	)
+	return counted
 }
 
 func (d *SingleDestination) createWorkerHandler(conn *nats.Conn) chanque.WorkerHandler {
+	// handler runs serially in worker, msgs is reused for each delivery
+	msgs := make([]*nats.Msg, 1)
 	return func(param interface{}) {
 		msg := param.(*nats.Msg)
-		if err := conn.Publish(msg.Subject, msg.Data); err != nil {
-			d.logger.Printf("warn: failed to publish subj:%s err:%+v", msg.Subject, err)
+		if d.pipeline.prepare(msg) != true {
+			return
 		}
+		msgs[0] = msg
+		d.pipeline.deliver(msgs, func() error {
+			return d.publish(conn, msg)
+		})
+		msgs[0] = nil
 	}
 }
 
-func (d *SingleDestination) createWorkerPostHook(conn *nats.Conn) chanque.WorkerHook {
-	return func() {
-		conn.FlushTimeout(defaultFlushTimeout)
-	}
+// publish sends msg by pooled nats.Msg, PublishMsg does not retain the msg
+func (d *SingleDestination) publish(conn *nats.Conn, msg *nats.Msg) error {
+	out := publishMsgPool.Get().(*nats.Msg)
+	out.Subject = msg.Subject
+	out.Header = msg.Header
+	out.Data = msg.Data
+	err := conn.PublishMsg(out)
+
+	*out = nats.Msg{}
+	publishMsgPool.Put(out)
+	return err
 }
 
-func NewSingleDestination(executor *chanque.Executor, url string, natsOpts []nats.Option, logger *log.Logger) *SingleDestination {
-	return &SingleDestination{executor, url, natsOpts, logger, nil, nil}
+func NewSingleDestination(executor *chanque.Executor, url string, natsOpts []nats.Option, logger *log.Logger, funcs ...DestinationOptFunc) *SingleDestination {
+	opt := new(destinationOpt)
+	for _, fn := range funcs {
+		fn(opt)
+	}
+	return &SingleDestination{executor, url, natsOpts, logger, opt, newDestinationPipeline(logger, opt), nil, nil}
 }
@@ -1,43 +1,33 @@
 package nrelay
 
 import (
-	"strconv"
-
-	"github.com/lafikl/consistent"
 	"github.com/nats-io/nats.go"
 	"github.com/octu0/chanque"
 )
 
 type distribute struct {
-	mapping    map[string]chanque.Worker
-	consistent *consistent.Consistent
-	fallback   chanque.Worker
+	workers     []chanque.Worker
+	partitioner Partitioner
+}
+
+// Index returns worker index of key by partitioner
+func (d *distribute) Index(key string, msg *nats.Msg) int {
+	return d.partitioner.Partition(key, msg)
+}
+
+func (d *distribute) Enqueue(idx int, msg *nats.Msg) bool {
+	return d.workers[idx].Enqueue(msg)
 }
 
 func (d *distribute) Publish(key string, msg *nats.Msg) bool {
-	id, err := d.consistent.Get(key)
-	if err != nil {
-		return d.fallback.Enqueue(msg)
-	}
+	return d.Enqueue(d.Index(key, msg), msg)
+}
 
-	worker, ok := d.mapping[id]
-	if ok != true {
-		return d.fallback.Enqueue(msg)
-	}
-	return worker.Enqueue(msg)
+func newDistributeWithPartitioner(workers []chanque.Worker, partitioner Partitioner) *distribute {
+	return &distribute{workers, partitioner}
 }
 
+// newDistribute returns distribute of consistent hash
 func newDistribute(workers []chanque.Worker) *distribute {
-	c := consistent.New()
-	m := make(map[string]chanque.Worker, len(workers))
-	for i, worker := range workers {
-		id := strconv.Itoa(i)
-		m[id] = worker
-		c.Add(id)
-	}
-	return &distribute{
-		mapping:    m,
-		consistent: c,
-		fallback:   workers[0],
-	}
+	return newDistributeWithPartitioner(workers, newConsistentPartitioner(len(workers)))
 }
@@ -0,0 +1,264 @@
+package nrelay
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	HeaderEncryption string = "Nrelay-Encryption"
+	HeaderKeyId      string = "Nrelay-Key-Id"
+)
+
+const (
+	EncryptionModeEncrypt string = "encrypt"
+	EncryptionModeDecrypt string = "decrypt"
+)
+
+const (
+	CipherAESGCM    string = "aes-gcm"
+	CipherSecretbox string = "secretbox"
+)
+
+const (
+	encryptionKeySize int = 32
+)
+
+var (
+	ErrUnknownCipher         = errors.New("unknown cipher")
+	ErrUnknownEncryptionMode = errors.New("unknown encryption mode")
+	ErrInvalidKey            = errors.New("invalid key, must be 32 bytes of raw, hex or base64")
+	ErrKeyNotFound           = errors.New("key not found")
+	ErrCipherMismatch        = errors.New("cipher mismatch")
+	ErrDecrypt               = errors.New("failed to decrypt")
+	ErrNotEncrypted          = errors.New("message is not encrypted")
+)
+
+// sealer encrypts and authenticates plain with associated data ad, ad is not included in sealed
+type sealer interface {
+	Seal(plain []byte, ad []byte) ([]byte, error)
+	Open(sealed []byte, ad []byte) ([]byte, error)
+}
+
+// check interface
+var (
+	_ sealer = (*aesGCMSealer)(nil)
+	_ sealer = (*secretboxSealer)(nil)
+)
+
+// aesGCMSealer output: nonce || ciphertext
+type aesGCMSealer struct {
+	aead cipher.AEAD
+}
+
+func (s *aesGCMSealer) Seal(plain []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plain)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s.aead.Seal(nonce, nonce, plain, ad), nil
+}
+
+func (s *aesGCMSealer) Open(sealed []byte, ad []byte) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.WithStack(ErrDecrypt)
+	}
+	nonce, data := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, data, ad)
+	if err != nil {
+		return nil, errors.Wrap(ErrDecrypt, err.Error())
+	}
+	return plain, nil
+}
+
+func newAESGCMSealer(key []byte) (*aesGCMSealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &aesGCMSealer{aead}, nil
+}
+
+// secretboxSealer output: nonce || box of (sha256(ad) || plain),
+// secretbox has no associated data so that digest of ad is authenticated with plain
+type secretboxSealer struct {
+	key *[32]byte
+}
+
+func (s *secretboxSealer) Seal(plain []byte, ad []byte) ([]byte, error) {
+	nonce := new([24]byte)
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	digest := sha256.Sum256(ad)
+	box := make([]byte, 0, sha256.Size+len(plain))
+	box = append(box, digest[:]...)
+	box = append(box, plain...)
+	return secretbox.Seal(nonce[:], box, nonce, s.key), nil
+}
+
+func (s *secretboxSealer) Open(sealed []byte, ad []byte) ([]byte, error) {
+	if len(sealed) < 24 {
+		return nil, errors.WithStack(ErrDecrypt)
+	}
+	nonce := new([24]byte)
+	copy(nonce[:], sealed[:24])
+	box, ok := secretbox.Open(nil, sealed[24:], nonce, s.key)
+	if ok != true || len(box) < sha256.Size {
+		return nil, errors.WithStack(ErrDecrypt)
+	}
+	digest := sha256.Sum256(ad)
+	if subtle.ConstantTimeCompare(box[:sha256.Size], digest[:]) != 1 {
+		return nil, errors.Wrap(ErrDecrypt, "associated data mismatch")
+	}
+	return box[sha256.Size:], nil
+}
+
+func newSecretboxSealer(key []byte) *secretboxSealer {
+	k := new([32]byte)
+	copy(k[:], key)
+	return &secretboxSealer{k}
+}
+
+func newSealer(cipherName string, key []byte) (sealer, error) {
+	switch cipherName {
+	case CipherAESGCM:
+		return newAESGCMSealer(key)
+	case CipherSecretbox:
+		return newSecretboxSealer(key), nil
+	}
+	return nil, errors.Wrapf(ErrUnknownCipher, "cipher: %s", cipherName)
+}
+
+// readEncryptionKey reads 32 bytes key from file of raw, hex or base64
+func readEncryptionKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(data) == encryptionKeySize {
+		return data, nil
+	}
+
+	text := string(bytes.TrimSpace(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	return nil, errors.Wrapf(ErrInvalidKey, "path: %s", path)
+}
+
+// encryptionAssociatedData binds sealed payload to subject and key id,
+// payload moved to another subject or relabeled with another key id fails to decrypt
+func encryptionAssociatedData(subject string, keyId string) []byte {
+	ad := make([]byte, 0, len(subject)+1+len(keyId))
+	ad = append(ad, subject...)
+	ad = append(ad, 0)
+	ad = append(ad, keyId...)
+	return ad
+}
+
+// payloadEncryption encrypts payload with active key and sets key id header,
+// or decrypts payload with the key of key id header. Messages without encryption header are rejected on decrypt
+type payloadEncryption struct {
+	mode    string
+	cipher  string
+	keyId   string
+	sealers map[string]sealer
+}
+
+func (e *payloadEncryption) Apply(msg *nats.Msg) error {
+	if e.mode == EncryptionModeEncrypt {
+		return e.encrypt(msg)
+	}
+	return e.decrypt(msg)
+}
+
+func (e *payloadEncryption) encrypt(msg *nats.Msg) error {
+	data, err := e.sealers[e.keyId].Seal(msg.Data, encryptionAssociatedData(msg.Subject, e.keyId))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(HeaderEncryption, e.cipher)
+	msg.Header.Set(HeaderKeyId, e.keyId)
+	msg.Data = data
+	return nil
+}
+
+func (e *payloadEncryption) decrypt(msg *nats.Msg) error {
+	if msg.Header == nil || msg.Header.Get(HeaderEncryption) == "" {
+		return errors.Wrapf(ErrNotEncrypted, "subj:%s", msg.Subject)
+	}
+	if c := msg.Header.Get(HeaderEncryption); c != e.cipher {
+		return errors.Wrapf(ErrCipherMismatch, "expect:%s actual:%s", e.cipher, c)
+	}
+
+	keyId := msg.Header.Get(HeaderKeyId)
+	s, ok := e.sealers[keyId]
+	if ok != true {
+		return errors.Wrapf(ErrKeyNotFound, "key id: %s", keyId)
+	}
+	data, err := s.Open(msg.Data, encryptionAssociatedData(msg.Subject, keyId))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	msg.Header.Del(HeaderEncryption)
+	msg.Header.Del(HeaderKeyId)
+	msg.Data = data
+	return nil
+}
+
+func (e *payloadEncryption) Close() {}
+
+// newPayloadEncryption returns nil if conf is not configured
+func newPayloadEncryption(conf EncryptionConfig) (*payloadEncryption, error) {
+	if conf.Configured() != true {
+		return nil, nil
+	}
+
+	switch conf.Mode {
+	case EncryptionModeEncrypt:
+		if _, ok := conf.Keys[conf.KeyId]; ok != true {
+			return nil, errors.Wrapf(ErrKeyNotFound, "key id: %s", conf.KeyId)
+		}
+	case EncryptionModeDecrypt:
+		// all keys are used by key id header
+	default:
+		return nil, errors.Wrapf(ErrUnknownEncryptionMode, "mode: %s", conf.Mode)
+	}
+
+	sealers := make(map[string]sealer, len(conf.Keys))
+	for keyId, path := range conf.Keys {
+		key, err := readEncryptionKey(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s, err := newSealer(conf.Cipher, key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		sealers[keyId] = s
+	}
+	return &payloadEncryption{conf.Mode, conf.Cipher, conf.KeyId, sealers}, nil
+}
@@ -0,0 +1,169 @@
+package nrelay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+func testWriteEncryptionKey(t *testing.T, dir, name string, encode func([]byte) []byte) string {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, encode(key), 0600); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	return path
+}
+
+func TestReadEncryptionKey(t *testing.T) {
+	dir := t.TempDir()
+	raw := testWriteEncryptionKey(t, dir, "raw", func(b []byte) []byte { return b })
+	hx := testWriteEncryptionKey(t, dir, "hex", func(b []byte) []byte { return []byte(hex.EncodeToString(b) + "\n") })
+	b64 := testWriteEncryptionKey(t, dir, "b64", func(b []byte) []byte { return []byte(base64.StdEncoding.EncodeToString(b) + "\n") })
+	short := testWriteEncryptionKey(t, dir, "short", func(b []byte) []byte { return b[:16] })
+
+	for _, path := range []string{raw, hx, b64} {
+		key, err := readEncryptionKey(path)
+		if err != nil {
+			t.Errorf("must no error: %+v", err)
+		}
+		if len(key) != encryptionKeySize {
+			t.Errorf("key size must be 32: %s", path)
+		}
+	}
+	if _, err := readEncryptionKey(short); errors.Is(err, ErrInvalidKey) != true {
+		t.Errorf("must ErrInvalidKey: %+v", err)
+	}
+}
+
+func TestPayloadEncryption(t *testing.T) {
+	dir := t.TempDir()
+	key1 := testWriteEncryptionKey(t, dir, "key1", func(b []byte) []byte { return b })
+	key2 := testWriteEncryptionKey(t, dir, "key2", func(b []byte) []byte { return b })
+	keys := map[string]string{"key1": key1, "key2": key2}
+	payload := []byte(`{"name":"secret"}`)
+
+	for _, c := range []string{CipherAESGCM, CipherSecretbox} {
+		t.Run("roundtrip/"+c, func(tt *testing.T) {
+			enc, err := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeEncrypt, Cipher: c, KeyId: "key2", Keys: keys})
+			if err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			dec, err := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeDecrypt, Cipher: c, Keys: keys})
+			if err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+
+			msg := &nats.Msg{Subject: "test", Data: payload}
+			if err := enc.Apply(msg); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			if bytes.Contains(msg.Data, []byte("secret")) {
+				tt.Errorf("payload must be opaque")
+			}
+			if msg.Header.Get(HeaderKeyId) != "key2" {
+				tt.Errorf("key id header: %s", msg.Header.Get(HeaderKeyId))
+			}
+			if msg.Header.Get(HeaderEncryption) != c {
+				tt.Errorf("cipher header: %s", msg.Header.Get(HeaderEncryption))
+			}
+
+			if err := dec.Apply(msg); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			if bytes.Equal(msg.Data, payload) != true {
+				tt.Errorf("payload must be restored")
+			}
+			if msg.Header.Get(HeaderKeyId) != "" || msg.Header.Get(HeaderEncryption) != "" {
+				tt.Errorf("headers must be removed: %v", msg.Header)
+			}
+		})
+	}
+
+	t.Run("rotation", func(tt *testing.T) {
+		old, err := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeEncrypt, Cipher: CipherAESGCM, KeyId: "key1", Keys: map[string]string{"key1": key1}})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		dec, err := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeDecrypt, Cipher: CipherAESGCM, Keys: keys})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		msg := &nats.Msg{Subject: "test", Data: payload}
+		old.Apply(msg)
+		if err := dec.Apply(msg); err != nil {
+			tt.Fatalf("old key must be decrypted: %+v", err)
+		}
+	})
+	t.Run("tampered", func(tt *testing.T) {
+		enc, _ := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeEncrypt, Cipher: CipherSecretbox, KeyId: "key1", Keys: keys})
+		dec, _ := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeDecrypt, Cipher: CipherSecretbox, Keys: keys})
+		msg := &nats.Msg{Subject: "test", Data: payload}
+		enc.Apply(msg)
+		msg.Data[len(msg.Data)-1] ^= 0xff
+		if err := dec.Apply(msg); errors.Is(err, ErrDecrypt) != true {
+			tt.Errorf("must ErrDecrypt: %+v", err)
+		}
+	})
+	t.Run("unknownKey", func(tt *testing.T) {
+		dec, _ := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeDecrypt, Cipher: CipherAESGCM, Keys: keys})
+		msg := &nats.Msg{Subject: "test", Header: nats.Header{}, Data: payload}
+		msg.Header.Set(HeaderEncryption, CipherAESGCM)
+		msg.Header.Set(HeaderKeyId, "key3")
+		if err := dec.Apply(msg); errors.Is(err, ErrKeyNotFound) != true {
+			tt.Errorf("must ErrKeyNotFound: %+v", err)
+		}
+	})
+	t.Run("plain/rejected", func(tt *testing.T) {
+		dec, _ := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeDecrypt, Cipher: CipherAESGCM, Keys: keys})
+		msg := &nats.Msg{Subject: "test", Data: payload}
+		if err := dec.Apply(msg); errors.Is(err, ErrNotEncrypted) != true {
+			tt.Errorf("must ErrNotEncrypted: %+v", err)
+		}
+	})
+	for _, c := range []string{CipherAESGCM, CipherSecretbox} {
+		t.Run("associated/subject/"+c, func(tt *testing.T) {
+			enc, _ := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeEncrypt, Cipher: c, KeyId: "key1", Keys: keys})
+			dec, _ := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeDecrypt, Cipher: c, Keys: keys})
+			msg := &nats.Msg{Subject: "test.a", Data: payload}
+			enc.Apply(msg)
+			msg.Subject = "test.b"
+			if err := dec.Apply(msg); errors.Is(err, ErrDecrypt) != true {
+				tt.Errorf("moved subject must ErrDecrypt: %+v", err)
+			}
+		})
+		t.Run("associated/keyid/"+c, func(tt *testing.T) {
+			// the same key under other id
+			aliases := map[string]string{"key1": key1, "alias": key1}
+			enc, _ := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeEncrypt, Cipher: c, KeyId: "key1", Keys: aliases})
+			dec, _ := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeDecrypt, Cipher: c, Keys: aliases})
+			msg := &nats.Msg{Subject: "test", Data: payload}
+			enc.Apply(msg)
+			msg.Header.Set(HeaderKeyId, "alias")
+			if err := dec.Apply(msg); errors.Is(err, ErrDecrypt) != true {
+				tt.Errorf("relabeled key id must ErrDecrypt: %+v", err)
+			}
+		})
+	}
+	t.Run("config/error", func(tt *testing.T) {
+		if _, err := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeEncrypt, Cipher: CipherAESGCM, KeyId: "none", Keys: keys}); errors.Is(err, ErrKeyNotFound) != true {
+			tt.Errorf("must ErrKeyNotFound: %+v", err)
+		}
+		if _, err := newPayloadEncryption(EncryptionConfig{Mode: EncryptionModeEncrypt, Cipher: "rot13", KeyId: "key1", Keys: keys}); errors.Is(err, ErrUnknownCipher) != true {
+			tt.Errorf("must ErrUnknownCipher: %+v", err)
+		}
+		if _, err := newPayloadEncryption(EncryptionConfig{Mode: "seal", Cipher: CipherAESGCM, Keys: keys}); errors.Is(err, ErrUnknownEncryptionMode) != true {
+			tt.Errorf("must ErrUnknownEncryptionMode: %+v", err)
+		}
+	})
+}
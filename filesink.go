@@ -0,0 +1,207 @@
+package nrelay
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultFileSinkMaxSize int64  = 100 * 1024 * 1024
+	fileSinkRotateLayout   string = "20060102T150405.000000000"
+)
+
+var (
+	ErrFileSinkPathRequired = errors.New("file sink path required")
+)
+
+// check interface
+var (
+	_ Sink = (*fileSink)(nil)
+)
+
+// fileSink appends NDJSON Records to path, the file is renamed to path.<timestamp>
+// when it exceeds maxSize or rotateInterval has elapsed, keeping maxBackups renamed files
+type fileSink struct {
+	path           string
+	maxSize        int64
+	rotateInterval time.Duration
+	maxBackups     int
+	mutex          *sync.Mutex
+	buf            *bytes.Buffer
+	writer         *RecordWriter
+	file           *os.File
+	size           int64
+	openedAt       time.Time
+}
+
+func (s *fileSink) Write(msgs []*nats.Msg) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.buf.Reset()
+	for _, msg := range msgs {
+		r := Record{
+			Subject:    msg.Subject,
+			Header:     msg.Header,
+			Data:       msg.Data,
+			ReceivedAt: now,
+		}
+		if err := s.writer.Write(r); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if s.shouldRotate(int64(s.buf.Len()), now) {
+		if err := s.rotate(now); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	n, err := s.file.Write(s.buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (s *fileSink) shouldRotate(n int64, now time.Time) bool {
+	if s.size < 1 {
+		return false
+	}
+	if 0 < s.maxSize && s.maxSize < s.size+n {
+		return true
+	}
+	if 0 < s.rotateInterval && s.rotateInterval <= now.Sub(s.openedAt) {
+		return true
+	}
+	return false
+}
+
+func (s *fileSink) open(now time.Time) error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	s.file = f
+	s.size = stat.Size()
+	s.openedAt = now
+	return nil
+}
+
+func (s *fileSink) rotate(now time.Time) error {
+	if err := s.file.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(s.path, s.path+"."+now.Format(fileSinkRotateLayout)); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := s.removeBackups(); err != nil {
+		return errors.WithStack(err)
+	}
+	return s.open(now)
+}
+
+// removeBackups removes oldest rotated files over maxBackups, all files are kept if maxBackups is 0.
+// only files named path.<fileSinkRotateLayout> are treated as backups
+func (s *fileSink) removeBackups() error {
+	if s.maxBackups < 1 {
+		return nil
+	}
+	backups, err := s.backups()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(backups) <= s.maxBackups {
+		return nil
+	}
+	sort.Strings(backups) // timestamp layout sorts by time
+	for _, b := range backups[:len(backups)-s.maxBackups] {
+		if err := os.Remove(b); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (s *fileSink) backups() ([]string, error) {
+	dir, base := filepath.Split(s.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	prefix := base + "."
+	backups := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if strings.HasPrefix(name, prefix) != true {
+			continue
+		}
+		suffix := name[len(prefix):]
+		if len(suffix) != len(fileSinkRotateLayout) {
+			continue
+		}
+		if _, err := time.Parse(fileSinkRotateLayout, suffix); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, name))
+	}
+	return backups, nil
+}
+
+func (s *fileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	if err := s.file.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	s.file = nil
+	return nil
+}
+
+func newFileSink(conf SinkConfig) (*fileSink, error) {
+	if len(conf.Path) < 1 {
+		return nil, errors.WithStack(ErrFileSinkPathRequired)
+	}
+	maxSize := conf.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultFileSinkMaxSize
+	}
+	buf := bytes.NewBuffer(nil)
+	s := &fileSink{
+		path:           conf.Path,
+		maxSize:        maxSize,
+		rotateInterval: conf.RotateInterval,
+		maxBackups:     conf.MaxBackups,
+		mutex:          new(sync.Mutex),
+		buf:            buf,
+		writer:         NewRecordWriter(buf),
+	}
+	if err := s.open(time.Now()); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s, nil
+}
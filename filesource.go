@@ -0,0 +1,258 @@
+package nrelay
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+const (
+	InputPathStdin string = "-"
+)
+
+const (
+	defaultFileSourcePollInterval time.Duration = 250 * time.Millisecond
+)
+
+// check interface
+var (
+	_ (Source) = (*FileSource)(nil)
+)
+
+// FileSource tails line-delimited file and publishes each line to subject.
+// It follows the file like `tail -F` (truncation and rotation), stdin is read until EOF or Unsubscribe
+type FileSource struct {
+	*ingest
+	conf   InputConfig
+	file   *os.File
+	offset int64
+	done   chan struct{}
+	wg     *sync.WaitGroup
+	once   *sync.Once
+}
+
+func (s *FileSource) stdin() bool {
+	return s.conf.Path == InputPathStdin
+}
+
+func (s *FileSource) Open() error {
+	if err := s.ingest.open(); err != nil {
+		return errors.WithStack(err)
+	}
+	if s.stdin() {
+		s.file = os.Stdin
+		return nil
+	}
+
+	f, err := os.Open(s.conf.Path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if s.conf.FromStart != true {
+		offset, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			f.Close()
+			return errors.WithStack(err)
+		}
+		s.offset = offset
+	}
+	s.file = f
+	return nil
+}
+
+func (s *FileSource) Subscribe(topic string, prefixSize int, workers []chanque.Worker) error {
+	if err := s.ingest.subscribe(topic, s.conf.Subject, prefixSize, workers); err != nil {
+		return errors.WithStack(err)
+	}
+	s.wg.Add(1)
+	if s.stdin() {
+		go s.tailStdin()
+	} else {
+		go s.tail()
+	}
+	return nil
+}
+
+// Unsubscribe stops tailing, blocked read of stdin is not waited
+func (s *FileSource) Unsubscribe() error {
+	s.once.Do(func() {
+		close(s.done)
+		if s.stdin() {
+			s.file.Close()
+		}
+	})
+	s.wg.Wait()
+	return nil
+}
+
+func (s *FileSource) Close() error {
+	if err := s.Unsubscribe(); err != nil {
+		return errors.WithStack(err)
+	}
+	if s.file != nil && s.stdin() != true {
+		s.file.Close()
+	}
+	s.file = nil
+	return s.ingest.close()
+}
+
+func (s *FileSource) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *FileSource) tail() {
+	defer s.wg.Done()
+
+	interval := s.conf.PollInterval
+	if interval <= 0 {
+		interval = defaultFileSourcePollInterval
+	}
+
+	reader := bufio.NewReader(s.file)
+	partial := make([]byte, 0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		s.offset += int64(len(line))
+		if err == nil {
+			if 0 < len(partial) {
+				line = append(partial, line...)
+				partial = partial[:0]
+			}
+			s.emit(line)
+			continue
+		}
+		if s.stopped() {
+			return
+		}
+		if err != io.EOF {
+			s.logger.Printf("error: failed to read %s: %+v", s.conf.Path, err)
+			return
+		}
+
+		// incomplete line is kept until newline is written
+		partial = append(partial, line...)
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(interval):
+		}
+		if s.follow() {
+			reader.Reset(s.file)
+			partial = partial[:0]
+		}
+	}
+}
+
+// tailStdin reads stdin in another goroutine that is not waited,
+// read on non-pollable fd can not be interrupted by closing it
+func (s *FileSource) tailStdin() {
+	defer s.wg.Done()
+
+	lines := make(chan []byte)
+	go func(r io.Reader) {
+		defer close(lines)
+
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if 0 < len(line) {
+				select {
+				case <-s.done:
+					return
+				case lines <- line:
+				}
+			}
+			if err != nil {
+				if err != io.EOF && s.stopped() != true {
+					s.logger.Printf("error: failed to read stdin: %+v", err)
+				}
+				return
+			}
+		}
+	}(s.file)
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case line, ok := <-lines:
+			if ok != true {
+				return
+			}
+			s.emit(line)
+		}
+	}
+}
+
+// follow reopens file when it was truncated or rotated, returns true if reading restarts from the beginning
+func (s *FileSource) follow() bool {
+	current, err := s.file.Stat()
+	if err != nil {
+		return false
+	}
+	if current.Size() < s.offset {
+		s.logger.Printf("info: %s truncated", s.conf.Path)
+		if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+			s.logger.Printf("warn: failed to seek %s: %+v", s.conf.Path, err)
+			return false
+		}
+		s.offset = 0
+		return true
+	}
+
+	stat, err := os.Stat(s.conf.Path)
+	if err != nil {
+		return false // rotated but new file not created yet
+	}
+	if os.SameFile(current, stat) {
+		return false
+	}
+	if s.offset < current.Size() {
+		return false // read rest of rotated file first
+	}
+	f, err := os.Open(s.conf.Path)
+	if err != nil {
+		return false
+	}
+	s.logger.Printf("info: %s rotated", s.conf.Path)
+	s.file.Close()
+	s.file = f
+	s.offset = 0
+	return true
+}
+
+func (s *FileSource) emit(line []byte) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) < 1 {
+		return
+	}
+	msg := nats.NewMsg(s.subjectOf())
+	msg.Data = append(make([]byte, 0, len(line)), line...)
+	if err := s.publish(msg); err != nil {
+		s.logger.Printf("warn: failed to ingest line of %s: %+v", s.conf.Path, err)
+	}
+}
+
+func NewFileSource(conf InputConfig, logger *log.Logger, funcs ...SourceOptFunc) *FileSource {
+	return &FileSource{
+		ingest: newIngest("file://"+conf.Path, logger, funcs...),
+		conf:   conf,
+		done:   make(chan struct{}),
+		wg:     new(sync.WaitGroup),
+		once:   new(sync.Once),
+	}
+}
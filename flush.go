@@ -0,0 +1,123 @@
+package nrelay
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+)
+
+const (
+	BufferTypeChanque string = "chanque"
+	BufferTypeRing    string = "ring"
+)
+
+const (
+	FlushModeFixed    string = "fixed"
+	FlushModeAdaptive string = "adaptive"
+)
+
+const (
+	defaultFlushMaxDelay time.Duration = 10 * time.Millisecond
+	flushRateAlpha       float64       = 0.2
+)
+
+// flushPolicy decides whether to flush after each dequeue batch of worker,
+// Observe is called from the worker goroutine only
+type flushPolicy interface {
+	Observe(n int, now time.Time) bool
+}
+
+// check interface
+var (
+	_ flushPolicy = (*fixedFlush)(nil)
+	_ flushPolicy = (*adaptiveFlush)(nil)
+)
+
+// fixedFlush flushes after every batch, lowest latency
+type fixedFlush struct{}
+
+func (f *fixedFlush) Observe(n int, now time.Time) bool {
+	return 0 < n
+}
+
+// adaptiveFlush estimates message rate by EWMA,
+// flushes every batch while a batch takes longer than maxDelay to fill (low rate, latency first),
+// coalesces flushes up to maxDelay on high rate (throughput first)
+type adaptiveFlush struct {
+	batch       int
+	maxDelay    time.Duration
+	rate        float64
+	pending     int
+	lastObserve time.Time
+	lastFlush   time.Time
+}
+
+func (f *adaptiveFlush) Observe(n int, now time.Time) bool {
+	if elapsed := now.Sub(f.lastObserve).Seconds(); 0 < elapsed {
+		f.rate = flushRateAlpha*(float64(n)/elapsed) + (1-flushRateAlpha)*f.rate
+	}
+	f.lastObserve = now
+	f.pending += n
+	if f.pending < 1 {
+		return false
+	}
+
+	lowRate := f.rate*f.maxDelay.Seconds() < float64(f.batch)
+	if lowRate || f.maxDelay <= now.Sub(f.lastFlush) {
+		f.pending = 0
+		f.lastFlush = now
+		return true
+	}
+	return false
+}
+
+func newFlushPolicy(conf BufferConfig) flushPolicy {
+	if conf.FlushMode != FlushModeAdaptive {
+		return new(fixedFlush)
+	}
+
+	maxDelay := conf.FlushMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultFlushMaxDelay
+	}
+	now := time.Now()
+	return &adaptiveFlush{
+		batch:       conf.batchSize(),
+		maxDelay:    maxDelay,
+		lastObserve: now,
+		lastFlush:   now,
+	}
+}
+
+// workerFlusher counts messages handled by worker and flushes conn by policy after each batch,
+// handler and post hook run on the same worker goroutine
+type workerFlusher struct {
+	conn      *nats.Conn
+	policy    flushPolicy
+	timeout   time.Duration
+	processed int
+}
+
+func (f *workerFlusher) Handler(handler chanque.WorkerHandler) chanque.WorkerHandler {
+	return func(param interface{}) {
+		f.processed += 1
+		handler(param)
+	}
+}
+
+func (f *workerFlusher) PostHook() {
+	n := f.processed
+	f.processed = 0
+	if f.policy.Observe(n, time.Now()) {
+		f.conn.FlushTimeout(f.timeout)
+	}
+}
+
+func newWorkerFlusher(conn *nats.Conn, conf BufferConfig) *workerFlusher {
+	return &workerFlusher{
+		conn:    conn,
+		policy:  newFlushPolicy(conf),
+		timeout: conf.flushTimeout(),
+	}
+}
@@ -0,0 +1,104 @@
+package nrelay
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+)
+
+func TestFlushPolicy(t *testing.T) {
+	t.Run("fixed", func(tt *testing.T) {
+		p := newFlushPolicy(BufferConfig{})
+		if p.Observe(0, time.Now()) {
+			tt.Errorf("empty batch has nothing to flush")
+		}
+		if p.Observe(1, time.Now()) != true {
+			tt.Errorf("fixed must flush every batch")
+		}
+	})
+	t.Run("adaptive/low-rate", func(tt *testing.T) {
+		p := newFlushPolicy(BufferConfig{Batch: 32, FlushMode: FlushModeAdaptive, FlushMaxDelay: 10 * time.Millisecond}).(*adaptiveFlush)
+		now := p.lastObserve
+		// 1 msg per 100ms
+		for i := 0; i < 10; i += 1 {
+			now = now.Add(100 * time.Millisecond)
+			if p.Observe(1, now) != true {
+				tt.Errorf("low rate must flush every batch: rate=%f", p.rate)
+			}
+		}
+	})
+	t.Run("adaptive/high-rate", func(tt *testing.T) {
+		p := newFlushPolicy(BufferConfig{Batch: 32, FlushMode: FlushModeAdaptive, FlushMaxDelay: 10 * time.Millisecond}).(*adaptiveFlush)
+		now := p.lastObserve
+		// 32 msgs per 100us = 320k msg/s
+		flushed := 0
+		for i := 0; i < 1000; i += 1 {
+			now = now.Add(100 * time.Microsecond)
+			if p.Observe(32, now) {
+				flushed += 1
+			}
+		}
+		// 100ms elapsed, flushes are coalesced to about every 10ms after rate is observed
+		if flushed < 5 || 30 < flushed {
+			tt.Errorf("high rate must coalesce flushes: flushed=%d", flushed)
+		}
+	})
+	t.Run("adaptive/rate-drop", func(tt *testing.T) {
+		p := newFlushPolicy(BufferConfig{Batch: 32, FlushMode: FlushModeAdaptive, FlushMaxDelay: 10 * time.Millisecond}).(*adaptiveFlush)
+		now := p.lastObserve
+		for i := 0; i < 100; i += 1 {
+			now = now.Add(100 * time.Microsecond)
+			p.Observe(32, now)
+		}
+		now = now.Add(time.Second)
+		if p.Observe(1, now) != true {
+			tt.Errorf("pending msgs must be flushed after max delay")
+		}
+	})
+}
+
+func benchmarkDestinationFlush(b *testing.B, conf BufferConfig) {
+	ns, ok := testNatsServerStart()
+	if ok != true {
+		b.Skip("unable to start a NATS Server")
+	}
+	defer ns.Shutdown()
+
+	e := chanque.NewExecutor(10, 10)
+	defer e.Release()
+
+	url := fmt.Sprintf("nats://%s", ns.Addr().String())
+	lg := log.New(io.Discard, "", log.LstdFlags)
+	dst := NewSingleDestination(e, url, nil, lg, DestinationOptBuffer(conf))
+	if err := dst.Open(1); err != nil {
+		b.Fatalf("must no error: %+v", err)
+	}
+	data := []byte("hello world")
+	w := dst.Workers()[0]
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		w.Enqueue(&nats.Msg{Subject: "bench.flush", Data: data})
+	}
+	dst.Close()
+}
+
+func BenchmarkDestinationFlush(b *testing.B) {
+	b.Run("fixed/batch32", func(tb *testing.B) {
+		benchmarkDestinationFlush(tb, BufferConfig{})
+	})
+	b.Run("fixed/batch128", func(tb *testing.B) {
+		benchmarkDestinationFlush(tb, BufferConfig{Capacity: 4096, Batch: 128})
+	})
+	b.Run("adaptive/batch32", func(tb *testing.B) {
+		benchmarkDestinationFlush(tb, BufferConfig{FlushMode: FlushModeAdaptive})
+	})
+	b.Run("adaptive/batch128", func(tb *testing.B) {
+		benchmarkDestinationFlush(tb, BufferConfig{Capacity: 4096, Batch: 128, FlushMode: FlushModeAdaptive})
+	})
+}
@@ -1,15 +1,27 @@
 module github.com/octu0/nats-relay
 
-go 1.16
+go 1.18
 
 require (
 	github.com/comail/colog v0.0.0-20160416085026-fba8e7b1f46c
+	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/gorilla/websocket v1.5.0
+	github.com/klauspost/compress v1.14.4
 	github.com/lafikl/consistent v0.0.0-20190331123054-b5c3ef09639f
 	github.com/minio/blake2b-simd v0.0.0-20160723061019-3f5f724cb5b1 // indirect
 	github.com/nats-io/nats-server/v2 v2.7.4
 	github.com/nats-io/nats.go v1.14.0
 	github.com/octu0/chanque v1.0.17
 	github.com/pkg/errors v0.9.1
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.0
+	github.com/tetratelabs/wazero v1.1.0
+	github.com/yuin/gopher-lua v1.1.0
+	go.opentelemetry.io/otel v1.6.3
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.6.3
+	go.opentelemetry.io/otel/sdk v1.6.3
+	go.opentelemetry.io/otel/trace v1.6.3
+	golang.org/x/crypto v0.0.0-20220112180741-5e0467b6c7ce
+	golang.org/x/time v0.0.0-20211116232009-f0f3c7e86c11
 	gopkg.in/urfave/cli.v1 v1.20.0
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,175 @@
+package nrelay
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHTTPSourceMaxBodySize     int64         = 1024 * 1024
+	defaultHTTPSourceShutdownTimeout time.Duration = 5 * time.Second
+)
+
+// httpSourceHeaderPrefixes are request headers copied to msg,
+// "Nrelay-" is reserved for relay (e.g. encryption, deliver-at) and not accepted from clients
+var httpSourceHeaderPrefixes = []string{"X-", "Nats-"}
+
+// check interface
+var (
+	_ (Source) = (*HTTPSource)(nil)
+)
+
+// HTTPSource accepts POST requests, request path is mapped to subject ("/a/b" -> "<subject>.a.b")
+// and body is the payload. It responds 202 when enqueued, 503 when queue is full
+type HTTPSource struct {
+	*ingest
+	conf     InputConfig
+	listener net.Listener
+	server   *http.Server
+}
+
+func (s *HTTPSource) Open() error {
+	if err := s.ingest.open(); err != nil {
+		return errors.WithStack(err)
+	}
+	ln, err := net.Listen("tcp", s.conf.Listen)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.logger.Printf("debug: http source listen %s", ln.Addr().String())
+	s.listener = ln
+	return nil
+}
+
+func (s *HTTPSource) Subscribe(topic string, prefixSize int, workers []chanque.Worker) error {
+	if err := s.ingest.subscribe(topic, s.conf.Subject, prefixSize, workers); err != nil {
+		return errors.WithStack(err)
+	}
+	server := &http.Server{Handler: s}
+	go func() {
+		if err := server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Printf("error: http source stopped: %+v", err)
+		}
+	}()
+	s.server = server
+	return nil
+}
+
+// Unsubscribe stops accepting requests, in-flight requests are completed
+func (s *HTTPSource) Unsubscribe() error {
+	if s.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHTTPSourceShutdownTimeout)
+	defer cancel()
+
+	err := s.server.Shutdown(ctx)
+	s.server = nil
+	s.listener = nil
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (s *HTTPSource) Close() error {
+	if err := s.Unsubscribe(); err != nil {
+		return errors.WithStack(err)
+	}
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	return s.ingest.close()
+}
+
+// Addr returns listening address
+func (s *HTTPSource) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *HTTPSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	subject, ok := s.pathSubject(r.URL.Path)
+	if ok != true {
+		s.metrics.Add(metricIngestErrors, 1)
+		http.Error(w, "invalid subject path", http.StatusBadRequest)
+		return
+	}
+
+	maxBodySize := s.conf.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultHTTPSourceMaxBodySize
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		s.metrics.Add(metricIngestErrors, 1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if maxBodySize < int64(len(body)) {
+		s.metrics.Add(metricIngestErrors, 1)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = body
+	for k, values := range r.Header {
+		if hasAnyPrefix(k, httpSourceHeaderPrefixes) {
+			for _, v := range values {
+				msg.Header.Add(k, v)
+			}
+		}
+	}
+	msg.Header.Set(HeaderRemoteAddr, r.RemoteAddr)
+
+	if err := s.publish(msg); err != nil {
+		if errors.Is(err, errEnqueueFailed) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *HTTPSource) pathSubject(path string) (string, bool) {
+	path = strings.Trim(path, "/")
+	if len(path) < 1 {
+		return s.subjectOf(), true
+	}
+	tokens := strings.Split(path, "/")
+	for _, token := range tokens {
+		if validSubjectToken(token) != true {
+			return "", false
+		}
+	}
+	return s.subjectOf(tokens...), true
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func NewHTTPSource(conf InputConfig, logger *log.Logger, funcs ...SourceOptFunc) *HTTPSource {
+	return &HTTPSource{newIngest("http://"+conf.Listen, logger, funcs...), conf, nil, nil}
+}
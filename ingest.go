@@ -0,0 +1,196 @@
+package nrelay
+
+import (
+	"expvar"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+const (
+	InputTypeHTTP string = "http"
+	InputTypeFile string = "file"
+	InputTypeUDP  string = "udp"
+	InputTypeMqtt string = "mqtt"
+)
+
+const (
+	HeaderRemoteAddr string = "Nrelay-Remote-Addr"
+)
+
+const (
+	metricIngested     string = "ingested"
+	metricIngestErrors string = "ingest_errors"
+)
+
+var (
+	ErrUnknownInput        = errors.New("unknown input type")
+	ErrInvalidInputSubject = errors.New("invalid input subject")
+)
+
+// ingest distributes messages read from outside of NATS to destination workers through middlewares,
+// shared by Source implementations of input
+type ingest struct {
+	name        string
+	logger      *log.Logger
+	tap         *tap
+	recorder    *recorder
+	deadLetter  *deadLetter
+	middlewares []Middleware
+	partition   PartitionConfig
+	prefixSize  int
+	subject     string
+	metrics     *expvar.Map
+	dist        *distribute
+	handler     RelayHandler
+}
+
+func (i *ingest) open() error {
+	if i.tap != nil {
+		if err := i.tap.Open(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (i *ingest) close() error {
+	if i.tap != nil {
+		if err := i.tap.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// subscribe prepares handler of topic, subject defaults to topic without trailing wildcard
+func (i *ingest) subscribe(topic string, subject string, prefixSize int, workers []chanque.Worker) error {
+	if len(subject) < 1 {
+		subject = strings.TrimSuffix(topic, ".>")
+	}
+	if validInputSubject(subject) != true {
+		return errors.Wrapf(ErrInvalidInputSubject, "topic:%s subject:%s", topic, subject)
+	}
+	if err := i.prepare(topic, prefixSize, workers); err != nil {
+		return errors.WithStack(err)
+	}
+	i.subject = subject
+	return nil
+}
+
+// prepare builds handler of topic for inputs whose subject is given by each message
+func (i *ingest) prepare(topic string, prefixSize int, workers []chanque.Worker) error {
+	partitioner, err := NewPartitioner(i.partition, workers)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	i.prefixSize = prefixSize
+	i.metrics = TopicMetrics(topic)
+	i.dist = newDistributeWithPartitioner(workers, partitioner)
+	i.handler = chainMiddleware(topic, i.enqueue, i.middlewares)
+	return nil
+}
+
+// enqueue is the last handler of middlewares, returns errEnqueueFailed if queue is full
+func (i *ingest) enqueue(msg *nats.Msg) error {
+	key := msg.Subject
+	if 0 < i.prefixSize && i.prefixSize <= len(msg.Subject) {
+		key = msg.Subject[0:i.prefixSize]
+	}
+	idx := i.dist.Index(key, msg)
+	receivedAt := time.Now()
+
+	if i.tap != nil {
+		i.tap.Mirror(i.name, idx, receivedAt, msg)
+	}
+	if i.recorder != nil {
+		i.recorder.Record(i.name, idx, receivedAt, msg)
+	}
+
+	if ok := i.dist.Enqueue(idx, msg); ok != true {
+		i.metrics.Add(metricEnqueueFailed, 1)
+		if i.deadLetter != nil {
+			i.deadLetter.Send(DeadLetterReasonQueueFull, 0, msg, errEnqueueFailed)
+		}
+		return errors.WithStack(errEnqueueFailed)
+	}
+	return nil
+}
+
+// publish passes msg to middlewares, returns error if msg was not enqueued
+func (i *ingest) publish(msg *nats.Msg) error {
+	if err := i.handler(msg); err != nil {
+		if errors.Is(err, errEnqueueFailed) != true {
+			i.metrics.Add(metricMiddlewareErrors, 1)
+			i.logger.Printf("warn: middleware error subj:%s err:%+v", msg.Subject, err)
+		}
+		return errors.WithStack(err)
+	}
+	i.metrics.Add(metricIngested, 1)
+	return nil
+}
+
+// subjectOf appends tokens to subject of input
+func (i *ingest) subjectOf(tokens ...string) string {
+	if len(tokens) < 1 {
+		return i.subject
+	}
+	return i.subject + "." + strings.Join(tokens, ".")
+}
+
+func validInputSubject(subject string) bool {
+	if len(subject) < 1 {
+		return false
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if validSubjectToken(token) != true {
+			return false
+		}
+	}
+	return true
+}
+
+func validSubjectToken(token string) bool {
+	if len(token) < 1 {
+		return false
+	}
+	if token == "*" || token == ">" {
+		return false
+	}
+	return strings.ContainsAny(token, " \t\r\n.") != true
+}
+
+func newIngest(name string, logger *log.Logger, funcs ...SourceOptFunc) *ingest {
+	opt := new(sourceOpt)
+	for _, fn := range funcs {
+		fn(opt)
+	}
+	return &ingest{
+		name:        name,
+		logger:      logger,
+		tap:         opt.tap,
+		recorder:    opt.recorder,
+		deadLetter:  opt.deadLetter,
+		middlewares: opt.middlewares,
+		partition:   opt.partition,
+	}
+}
+
+// newInputSource returns Source of input type
+func newInputSource(conf InputConfig, logger *log.Logger, funcs ...SourceOptFunc) (Source, error) {
+	switch conf.Type {
+	case InputTypeHTTP:
+		return NewHTTPSource(conf, logger, funcs...), nil
+	case InputTypeFile:
+		return NewFileSource(conf, logger, funcs...), nil
+	case InputTypeUDP:
+		return NewUDPSource(conf, logger, funcs...), nil
+	case InputTypeMqtt:
+		return NewMqttSource(conf, logger, funcs...), nil
+	}
+	return nil, errors.Wrapf(ErrUnknownInput, "type:%s", conf.Type)
+}
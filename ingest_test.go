@@ -0,0 +1,324 @@
+package nrelay
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+)
+
+type testIngestCollector struct {
+	mutex *sync.Mutex
+	msgs  []*nats.Msg
+}
+
+func (c *testIngestCollector) handle(param interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.msgs = append(c.msgs, param.(*nats.Msg))
+}
+
+func (c *testIngestCollector) wait(t *testing.T, n int) []*nats.Msg {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mutex.Lock()
+		if n <= len(c.msgs) {
+			msgs := append([]*nats.Msg{}, c.msgs...)
+			c.mutex.Unlock()
+			return msgs
+		}
+		c.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t.Fatalf("expect %d msgs: %d", n, len(c.msgs))
+	return nil
+}
+
+func testIngestWorkers(t *testing.T, num int) ([]chanque.Worker, *testIngestCollector) {
+	e := chanque.NewExecutor(num, num)
+	c := &testIngestCollector{mutex: new(sync.Mutex)}
+	workers := make([]chanque.Worker, num)
+	for i := 0; i < num; i += 1 {
+		workers[i] = chanque.NewDefaultWorker(c.handle, chanque.WorkerExecutor(e))
+	}
+	t.Cleanup(func() {
+		for _, w := range workers {
+			w.ShutdownAndWait()
+		}
+		e.Release()
+	})
+	return workers, c
+}
+
+func TestHTTPSource(t *testing.T) {
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	workers, c := testIngestWorkers(t, 2)
+
+	src := NewHTTPSource(InputConfig{Type: InputTypeHTTP, Listen: "127.0.0.1:0", MaxBodySize: 16}, lg)
+	if err := src.Open(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer src.Close()
+	if err := src.Subscribe("ingest.>", 0, workers); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	url := fmt.Sprintf("http://%s", src.Addr().String())
+	post := func(path string, body string, header http.Header) int {
+		req, err := http.NewRequest(http.MethodPost, url+path, bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("must no error: %+v", err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("must no error: %+v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post("/orders/created", "hello", http.Header{"X-Partition-Key": []string{"k1"}, "Cookie": []string{"secret"}, "Nrelay-Deliver-At": []string{"0"}, "Nrelay-Remote-Addr": []string{"forged"}}); code != http.StatusAccepted {
+		t.Errorf("accepted: %d", code)
+	}
+	if code := post("/", "root", nil); code != http.StatusAccepted {
+		t.Errorf("accepted: %d", code)
+	}
+	if code := post("/a/*/b", "wildcard", nil); code != http.StatusBadRequest {
+		t.Errorf("invalid subject: %d", code)
+	}
+	if code := post("/large", "01234567890123456789", nil); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large: %d", code)
+	}
+	resp, err := http.Get(url + "/foo")
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST only: %d", resp.StatusCode)
+	}
+
+	msgs := c.wait(t, 2)
+	subjects := map[string]*nats.Msg{}
+	for _, m := range msgs {
+		subjects[m.Subject] = m
+	}
+	m, ok := subjects["ingest.orders.created"]
+	if ok != true {
+		t.Fatalf("path mapped to subject: %v", subjects)
+	}
+	if string(m.Data) != "hello" {
+		t.Errorf("body is payload: %s", m.Data)
+	}
+	if m.Header.Get("X-Partition-Key") != "k1" {
+		t.Errorf("X- header copied: %v", m.Header)
+	}
+	if m.Header.Get("Cookie") != "" {
+		t.Errorf("other header not copied: %v", m.Header)
+	}
+	if m.Header.Get(HeaderDeliverAt) != "" {
+		t.Errorf("reserved header not copied: %v", m.Header)
+	}
+	if v := m.Header[HeaderRemoteAddr]; len(v) != 1 || v[0] == "forged" {
+		t.Errorf("remote addr: %v", m.Header)
+	}
+	if _, ok := subjects["ingest"]; ok != true {
+		t.Errorf("root path is subject: %v", subjects)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+
+	t.Run("tail", func(tt *testing.T) {
+		path := filepath.Join(tt.TempDir(), "input.log")
+		if err := os.WriteFile(path, []byte("old line\n"), 0644); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		workers, c := testIngestWorkers(tt, 1)
+
+		src := NewFileSource(InputConfig{Type: InputTypeFile, Path: path, Subject: "logs.app", PollInterval: 10 * time.Millisecond}, lg)
+		if err := src.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer src.Close()
+		if err := src.Subscribe("logs.>", 0, workers); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		f.Write([]byte("line1\nli"))
+		time.Sleep(50 * time.Millisecond)
+		f.Write([]byte("ne2\r\n\n"))
+		f.Close()
+
+		msgs := c.wait(tt, 2)
+		if string(msgs[0].Data) != "line1" || string(msgs[1].Data) != "line2" {
+			tt.Errorf("lines after open: %s %s", msgs[0].Data, msgs[1].Data)
+		}
+		if msgs[0].Subject != "logs.app" {
+			tt.Errorf("subject: %s", msgs[0].Subject)
+		}
+
+		// rotate
+		if err := os.Rename(path, path+".1"); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if err := os.WriteFile(path, []byte("line3\n"), 0644); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		msgs = c.wait(tt, 3)
+		if string(msgs[2].Data) != "line3" {
+			tt.Errorf("follow rotated file: %s", msgs[2].Data)
+		}
+	})
+	t.Run("from-start", func(tt *testing.T) {
+		path := filepath.Join(tt.TempDir(), "input.log")
+		if err := os.WriteFile(path, []byte("a\nb\nc\n"), 0644); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		workers, c := testIngestWorkers(tt, 1)
+
+		src := NewFileSource(InputConfig{Type: InputTypeFile, Path: path, FromStart: true}, lg)
+		if err := src.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer src.Close()
+		if err := src.Subscribe("logs.>", 0, workers); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		msgs := c.wait(tt, 3)
+		if msgs[0].Subject != "logs" {
+			tt.Errorf("subject defaults to topic: %s", msgs[0].Subject)
+		}
+	})
+	t.Run("stdin", func(tt *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer w.Close()
+		stdin := os.Stdin
+		os.Stdin = r
+		defer func() { os.Stdin = stdin }()
+
+		workers, c := testIngestWorkers(tt, 1)
+
+		src := NewFileSource(InputConfig{Type: InputTypeFile, Path: InputPathStdin}, lg)
+		if err := src.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if err := src.Subscribe("logs.>", 0, workers); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		w.Write([]byte("line1\n"))
+		if msgs := c.wait(tt, 1); string(msgs[0].Data) != "line1" {
+			tt.Errorf("line from stdin: %s", msgs[0].Data)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			src.Unsubscribe()
+			src.Close()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			tt.Errorf("unsubscribe must not wait blocked stdin read")
+		}
+	})
+}
+
+func TestUDPSource(t *testing.T) {
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	workers, c := testIngestWorkers(t, 1)
+
+	src := NewUDPSource(InputConfig{Type: InputTypeUDP, Listen: "127.0.0.1:0", Subject: "syslog", Format: InputFormatSyslog}, lg)
+	if err := src.Open(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer src.Close()
+	if err := src.Subscribe("syslog.>", 0, workers); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	conn, err := net.Dial("udp", src.Addr().String())
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer conn.Close()
+
+	// local0(16) * 8 + err(3) = 131
+	conn.Write([]byte("<131>Oct 19 12:00:00 host app: failed\n"))
+	conn.Write([]byte("no priority"))
+
+	msgs := c.wait(t, 2)
+	subjects := map[string]string{}
+	for _, m := range msgs {
+		subjects[m.Subject] = string(m.Data)
+	}
+	if subjects["syslog.local0.err"] != "<131>Oct 19 12:00:00 host app: failed" {
+		t.Errorf("facility and severity: %v", subjects)
+	}
+	if subjects["syslog"] != "no priority" {
+		t.Errorf("invalid priority published to subject: %v", subjects)
+	}
+}
+
+func TestParseSyslogPriority(t *testing.T) {
+	tests := []struct {
+		in       string
+		facility int
+		severity int
+		ok       bool
+	}{
+		{"<0>msg", 0, 0, true},
+		{"<34>1 2003-10-11T22:14:15.003Z host su - ID47 - msg", 4, 2, true},
+		{"<191>msg", 23, 7, true},
+		{"<192>msg", 0, 0, false},
+		{"<>msg", 0, 0, false},
+		{"<abc>msg", 0, 0, false},
+		{"msg", 0, 0, false},
+	}
+	for _, tc := range tests {
+		f, s, ok := parseSyslogPriority([]byte(tc.in))
+		if ok != tc.ok || f != tc.facility || s != tc.severity {
+			t.Errorf("%s: %d %d %v", tc.in, f, s, ok)
+		}
+	}
+}
+
+func TestInputSubject(t *testing.T) {
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	workers, _ := testIngestWorkers(t, 1)
+
+	i := newIngest("test", lg)
+	if err := i.subscribe("foo.*", "", 0, workers); err == nil {
+		t.Errorf("wildcard topic requires subject")
+	}
+	if err := i.subscribe("foo.*", "foo.bar", 0, workers); err != nil {
+		t.Errorf("must no error: %+v", err)
+	}
+	if _, err := newInputSource(InputConfig{Type: "unknown"}, lg); err == nil {
+		t.Errorf("unknown input")
+	}
+}
@@ -0,0 +1,174 @@
+package nrelay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultLeaderKey string        = "leader"
+	defaultLeaderTTL time.Duration = 5 * time.Second
+)
+
+// leaderElection elects one relay instance by KV key,
+// the leader creates the key and refreshes it by revision before TTL(MaxAge of bucket) expires.
+// Standby instances create the key after it expired or was deleted by the leader
+type leaderElection struct {
+	conf      LeaderConfig
+	id        string
+	ttl       time.Duration
+	heartbeat time.Duration
+	natsUrl   string
+	natsOpts  []nats.Option
+	logger    *log.Logger
+	conn      *nats.Conn
+	kv        nats.KeyValue
+	revision  uint64
+	leader    int32
+}
+
+func (e *leaderElection) Open() error {
+	conn, err := nats.Connect(e.natsUrl, e.natsOpts...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return errors.WithStack(err)
+	}
+
+	kv, err := js.KeyValue(e.conf.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  e.conf.Bucket,
+			History: 1,
+			TTL:     e.ttl,
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return errors.WithStack(err)
+	}
+	e.conn = conn
+	e.kv = kv
+	return nil
+}
+
+// Close resigns leadership so that standby takes over immediately
+func (e *leaderElection) Close() error {
+	if e.IsLeader() {
+		if err := e.kv.Delete(e.key()); err != nil {
+			e.logger.Printf("warn: failed to resign leader: %+v", err)
+		}
+		atomic.StoreInt32(&e.leader, 0)
+	}
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+	return nil
+}
+
+func (e *leaderElection) key() string {
+	if 0 < len(e.conf.Key) {
+		return e.conf.Key
+	}
+	return defaultLeaderKey
+}
+
+func (e *leaderElection) IsLeader() bool {
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+// campaign acquires or refreshes leadership, returns true if this instance is the leader
+func (e *leaderElection) campaign() bool {
+	if e.IsLeader() {
+		rev, err := e.kv.Update(e.key(), []byte(e.id), e.revision)
+		if err != nil {
+			e.logger.Printf("warn: leader %s lost leadership: %+v", e.id, err)
+			atomic.StoreInt32(&e.leader, 0)
+			return false
+		}
+		e.revision = rev
+		return true
+	}
+
+	rev, err := e.kv.Create(e.key(), []byte(e.id))
+	if err != nil {
+		// key exists, other instance is the leader
+		return false
+	}
+	e.revision = rev
+	atomic.StoreInt32(&e.leader, 1)
+	e.logger.Printf("info: %s elected as leader", e.id)
+	return true
+}
+
+// WaitLeadership blocks until this instance is elected or ctx is done
+func (e *leaderElection) WaitLeadership(ctx context.Context) error {
+	ticker := time.NewTicker(e.heartbeat)
+	defer ticker.Stop()
+
+	e.logger.Printf("info: %s standby", e.id)
+	for {
+		if e.campaign() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// KeepAlive refreshes leadership until ctx is done, lost is called when leadership is lost
+func (e *leaderElection) KeepAlive(ctx context.Context, lost func()) {
+	ticker := time.NewTicker(e.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if e.campaign() != true {
+				lost()
+				return
+			}
+		}
+	}
+}
+
+func newLeaderElection(conf LeaderConfig, natsUrl string, natsOpts []nats.Option, logger *log.Logger) *leaderElection {
+	id := conf.Id
+	if len(id) < 1 {
+		hostname, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	ttl := conf.TTL
+	if ttl <= 0 {
+		ttl = defaultLeaderTTL
+	}
+	heartbeat := conf.Heartbeat
+	if heartbeat <= 0 || ttl <= heartbeat {
+		heartbeat = ttl / 3
+	}
+	return &leaderElection{
+		conf:      conf,
+		id:        id,
+		ttl:       ttl,
+		heartbeat: heartbeat,
+		natsUrl:   natsUrl,
+		natsOpts:  natsOpts,
+		logger:    logger,
+	}
+}
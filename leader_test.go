@@ -0,0 +1,213 @@
+package nrelay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+)
+
+func testJetStreamServerStart(t *testing.T) (*server.Server, bool) {
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		HTTPPort:  -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	go ns.Start()
+	if ns.ReadyForConnections(10*time.Second) != true {
+		return nil, false
+	}
+	return ns, true
+}
+
+func TestLeaderElection(t *testing.T) {
+	ns, ok := testJetStreamServerStart(t)
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer ns.Shutdown()
+
+	url := fmt.Sprintf("nats://%s", ns.Addr().String())
+	lg := log.New(&testAdminLogWriter{t}, t.Name()+"@", log.LstdFlags)
+
+	t.Run("resign", func(tt *testing.T) {
+		conf := LeaderConfig{Bucket: "resign", TTL: 10 * time.Second}
+		e1 := newLeaderElection(LeaderConfig{Bucket: conf.Bucket, TTL: conf.TTL, Id: "e1"}, url, nil, lg)
+		e2 := newLeaderElection(LeaderConfig{Bucket: conf.Bucket, TTL: conf.TTL, Id: "e2"}, url, nil, lg)
+		if err := e1.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if err := e2.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer e2.Close()
+
+		if e1.campaign() != true {
+			tt.Errorf("e1 must be elected")
+		}
+		if e2.campaign() {
+			tt.Errorf("e2 must be standby")
+		}
+		if e1.campaign() != true {
+			tt.Errorf("e1 must keep leadership")
+		}
+
+		e1.Close()
+		if e2.campaign() != true {
+			tt.Errorf("e2 must take over after e1 resigned")
+		}
+	})
+	t.Run("ttl/takeover", func(tt *testing.T) {
+		conf := LeaderConfig{Bucket: "ttl", TTL: time.Second, Heartbeat: 100 * time.Millisecond}
+		e1 := newLeaderElection(LeaderConfig{Bucket: conf.Bucket, TTL: conf.TTL, Heartbeat: conf.Heartbeat, Id: "e1"}, url, nil, lg)
+		e2 := newLeaderElection(LeaderConfig{Bucket: conf.Bucket, TTL: conf.TTL, Heartbeat: conf.Heartbeat, Id: "e2"}, url, nil, lg)
+		if err := e1.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer e1.Close()
+		if err := e2.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer e2.Close()
+
+		if e1.campaign() != true {
+			tt.Errorf("e1 must be elected")
+		}
+
+		// e1 stops heartbeat
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		start := time.Now()
+		if err := e2.WaitLeadership(ctx); err != nil {
+			tt.Fatalf("e2 must take over: %+v", err)
+		}
+		if time.Since(start) < 500*time.Millisecond {
+			tt.Errorf("e2 must wait ttl of e1: %s", time.Since(start))
+		}
+		if e1.campaign() {
+			tt.Errorf("e1 must lose leadership")
+		}
+	})
+}
+
+func TestServerLeaderElection(t *testing.T) {
+	srcNs, ok := testNatsServerStart()
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer srcNs.Shutdown()
+	dstNs, ok := testJetStreamServerStart(t)
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer dstNs.Shutdown()
+
+	srcUrl := fmt.Sprintf("nats://%s", srcNs.Addr().String())
+	dstUrl := fmt.Sprintf("nats://%s", dstNs.Addr().String())
+
+	dstNc, err := nats.Connect(dstUrl)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer dstNc.Close()
+
+	received := int32(0)
+	sub, err := dstNc.Subscribe("test.leader.>", func(msg *nats.Msg) {
+		atomic.AddInt32(&received, 1)
+	})
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer sub.Unsubscribe()
+	dstNc.Flush()
+
+	e := chanque.NewExecutor(10, 100)
+	t.Cleanup(func() { e.Release() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svrs := make([]*DefaultServer, 2)
+	errCh := make(chan error, len(svrs))
+	for i := range svrs {
+		lg := log.New(&testAdminLogWriter{t}, fmt.Sprintf("%s[%d]@", t.Name(), i), log.LstdFlags)
+		svrs[i] = NewDefaultServer(
+			ServerOptRelayConfig(RelayConfig{
+				PrimaryUrl: srcUrl,
+				NatsUrl:    dstUrl,
+				Leader:     LeaderConfig{Bucket: "relay", TTL: time.Second, Id: fmt.Sprintf("svr%d", i)},
+				Topics:     Topics(Topic("test.leader.>")),
+			}),
+			ServerOptExecutor(e),
+			ServerOptLogger(lg),
+		)
+		go func(svr *DefaultServer) {
+			errCh <- svr.Run(ctx)
+		}(svrs[i])
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for (svrs[0].IsLeader() || svrs[1].IsLeader()) != true && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if svrs[0].IsLeader() == svrs[1].IsLeader() {
+		t.Fatalf("exactly one leader: %v %v", svrs[0].IsLeader(), svrs[1].IsLeader())
+	}
+	// wait subscribe of leader
+	time.Sleep(200 * time.Millisecond)
+
+	ts := httptest.NewServer(NewAdminHandler(svrs[0]))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/leader")
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	r := adminLeaderResponse{}
+	json.NewDecoder(resp.Body).Decode(&r)
+	resp.Body.Close()
+	if r.Leader != svrs[0].IsLeader() {
+		t.Errorf("admin must report leader status: %v", r.Leader)
+	}
+
+	srcNc, err := nats.Connect(srcUrl)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer srcNc.Close()
+	for i := 0; i < 100; i += 1 {
+		srcNc.Publish(fmt.Sprintf("test.leader.%d", i), []byte("hello"))
+	}
+	srcNc.Flush()
+
+	deadline = time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&received) < 100 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v := atomic.LoadInt32(&received); v != 100 {
+		t.Errorf("only leader relays: %d", v)
+	}
+
+	cancel()
+	for i := 0; i < len(svrs); i += 1 {
+		if err := <-errCh; err != nil {
+			t.Errorf("must no error: %+v", err)
+		}
+	}
+}
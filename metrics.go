@@ -0,0 +1,38 @@
+package nrelay
+
+import (
+	"expvar"
+	"sync"
+)
+
+const (
+	metricThrottledDelayed string = "throttled_delayed"
+	metricThrottledDropped string = "throttled_dropped"
+	metricThrottledDelayMs string = "throttled_delay_ms"
+	metricMiddlewareErrors string = "middleware_errors"
+	metricEnqueueFailed    string = "enqueue_failed"
+)
+
+var (
+	metricsMutex       = new(sync.Mutex)
+	metricsTopics      = expvar.NewMap(AppName + ".topics")
+	metricsDestination = expvar.NewMap(AppName + ".destination")
+)
+
+// TopicMetrics returns expvar counters of topic, exposed as nats-relay.topics.<topic>
+func TopicMetrics(topic string) *expvar.Map {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	if m, ok := metricsTopics.Get(topic).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	metricsTopics.Set(topic, m)
+	return m
+}
+
+// DestinationMetrics returns expvar counters shared by all topics, exposed as nats-relay.destination
+func DestinationMetrics() *expvar.Map {
+	return metricsDestination
+}
@@ -0,0 +1,23 @@
+package nrelay
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+// RelayHandler handles a message between Source and Destination workers
+type RelayHandler func(msg *nats.Msg) error
+
+// Middleware wraps next handler of topic.
+// It may modify msg, call next multiple times to fan out (with distinct *nats.Msg),
+// or not call next to drop msg.
+// Returned errors are counted as middleware_errors and logged.
+// Handler is called concurrently from each source connection.
+type Middleware func(topic string, next RelayHandler) RelayHandler
+
+// chainMiddleware composes middlewares, first one is outermost
+func chainMiddleware(topic string, handler RelayHandler, middlewares []Middleware) RelayHandler {
+	for i := len(middlewares) - 1; 0 <= i; i -= 1 {
+		handler = middlewares[i](topic, handler)
+	}
+	return handler
+}
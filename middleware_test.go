@@ -0,0 +1,120 @@
+package nrelay
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+func TestChainMiddleware(t *testing.T) {
+	order := make([]string, 0)
+	mw := func(name string) Middleware {
+		return func(topic string, next RelayHandler) RelayHandler {
+			return func(msg *nats.Msg) error {
+				order = append(order, name+":"+topic)
+				return next(msg)
+			}
+		}
+	}
+	h := chainMiddleware("test.>", func(msg *nats.Msg) error {
+		order = append(order, "last")
+		return nil
+	}, []Middleware{mw("a"), mw("b")})
+
+	if err := h(&nats.Msg{Subject: "test.1"}); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	if strings.Join(order, ",") != "a:test.>,b:test.>,last" {
+		t.Errorf("first middleware must be outermost: %v", order)
+	}
+}
+
+func TestMultipleSourceMiddleware(t *testing.T) {
+	ns, ok := testNatsServerStart()
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer ns.Shutdown()
+
+	url := fmt.Sprintf("nats://%s", ns.Addr().String())
+	topic := "test.middleware.>"
+
+	drop := func(topic string, next RelayHandler) RelayHandler {
+		return func(msg *nats.Msg) error {
+			if strings.HasSuffix(msg.Subject, ".drop") {
+				return nil
+			}
+			return next(msg)
+		}
+	}
+	fanout := func(topic string, next RelayHandler) RelayHandler {
+		return func(msg *nats.Msg) error {
+			if strings.HasSuffix(msg.Subject, ".fanout") {
+				copied := &nats.Msg{Subject: msg.Subject + ".copy", Data: msg.Data}
+				if err := next(copied); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			return next(msg)
+		}
+	}
+	failure := func(topic string, next RelayHandler) RelayHandler {
+		return func(msg *nats.Msg) error {
+			if strings.HasSuffix(msg.Subject, ".error") {
+				return errors.New("middleware error")
+			}
+			return next(msg)
+		}
+	}
+
+	worker := &testSourceWorker{new(sync.Mutex), make(map[string]struct{})}
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	src := NewMultipleSource([]string{url}, nil, lg, SourceOptMiddleware(drop, fanout, failure))
+	if err := src.Open(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	if err := src.Subscribe(topic, 0, []chanque.Worker{worker}); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer nc.Close()
+
+	for _, suffix := range []string{"pass", "drop", "fanout", "error"} {
+		nc.Publish("test.middleware."+suffix, []byte(""))
+	}
+	nc.Flush()
+
+	<-time.After(100 * time.Millisecond)
+	if err := src.Close(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	subjects := worker.get()
+	for _, subj := range []string{"test.middleware.pass", "test.middleware.fanout", "test.middleware.fanout.copy"} {
+		if _, ok := subjects[subj]; ok != true {
+			t.Errorf("%s must be enqueued", subj)
+		}
+	}
+	for _, subj := range []string{"test.middleware.drop", "test.middleware.error"} {
+		if _, ok := subjects[subj]; ok {
+			t.Errorf("%s must not be enqueued", subj)
+		}
+	}
+
+	v, ok := TopicMetrics(topic).Get(metricMiddlewareErrors).(*expvar.Int)
+	if ok != true || v.Value() != 1 {
+		t.Errorf("middleware error must be counted: %v", TopicMetrics(topic).Get(metricMiddlewareErrors))
+	}
+}
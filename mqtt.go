@@ -0,0 +1,305 @@
+package nrelay
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+const (
+	HeaderMqttTopic    string = "Nrelay-Mqtt-Topic"
+	HeaderMqttQos      string = "Nrelay-Mqtt-Qos"
+	HeaderMqttRetained string = "Nrelay-Mqtt-Retained"
+)
+
+const (
+	defaultMqttTimeout      time.Duration = 10 * time.Second
+	mqttDisconnectQuiesceMs uint          = 250
+)
+
+var (
+	ErrMqttBrokerRequired = errors.New("mqtt broker required")
+	ErrMqttInvalidQos     = errors.New("mqtt qos must be 0, 1 or 2")
+	ErrMqttTimeout        = errors.New("mqtt timeout")
+)
+
+var (
+	// characters not allowed in NATS token
+	mqttLevelReplacer = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_")
+	// characters not allowed in MQTT level
+	natsTokenReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+	mqttClientSeq uint64
+)
+
+// mqttToNatsSubject translates MQTT topic (filter) to NATS subject, "a/+/#" -> "a.*.>",
+// empty level and characters not allowed in NATS token are replaced with "_"
+func mqttToNatsSubject(topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		switch level {
+		case "+":
+			levels[i] = "*"
+		case "#":
+			levels[i] = ">"
+		case "":
+			levels[i] = "_"
+		default:
+			levels[i] = mqttLevelReplacer.Replace(level)
+		}
+	}
+	return strings.Join(levels, ".")
+}
+
+// natsToMqttTopic translates NATS subject to MQTT topic (filter), "a.*.>" -> "a/+/#"
+func natsToMqttTopic(subject string) string {
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		switch token {
+		case "*":
+			tokens[i] = "+"
+		case ">":
+			tokens[i] = "#"
+		default:
+			tokens[i] = natsTokenReplacer.Replace(token)
+		}
+	}
+	return strings.Join(tokens, "/")
+}
+
+func mqttTimeout(conf MqttConfig) time.Duration {
+	if conf.Timeout <= 0 {
+		return defaultMqttTimeout
+	}
+	return conf.Timeout
+}
+
+// mqttWait waits token completion, timeout and connection loss are retryable
+func mqttWait(token mqtt.Token, timeout time.Duration) error {
+	if token.WaitTimeout(timeout) != true {
+		return errors.WithStack(RetryableError(ErrMqttTimeout))
+	}
+	if err := token.Error(); err != nil {
+		if err == mqtt.ErrNotConnected {
+			return errors.WithStack(RetryableError(err))
+		}
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// newMqttClient connects to broker, client id defaults to unique id of the process
+func newMqttClient(conf MqttConfig, onConnect mqtt.OnConnectHandler) (mqtt.Client, error) {
+	if len(conf.Broker) < 1 {
+		return nil, errors.WithStack(ErrMqttBrokerRequired)
+	}
+	if 2 < conf.Qos {
+		return nil, errors.WithStack(ErrMqttInvalidQos)
+	}
+
+	clientId := conf.ClientId
+	if len(clientId) < 1 {
+		hostname, _ := os.Hostname()
+		clientId = fmt.Sprintf("nrelay-%s-%d-%d", hostname, os.Getpid(), atomic.AddUint64(&mqttClientSeq, 1))
+	}
+	timeout := mqttTimeout(conf)
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(conf.Broker)
+	opts.SetClientID(clientId)
+	opts.SetUsername(conf.Username)
+	opts.SetPassword(conf.Password)
+	opts.SetCleanSession(conf.Persistent != true)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectTimeout(timeout)
+	if onConnect != nil {
+		opts.SetOnConnectHandler(onConnect)
+	}
+
+	client := mqtt.NewClient(opts)
+	if err := mqttWait(client.Connect(), timeout); err != nil {
+		return nil, errors.Wrapf(err, "broker: %s", conf.Broker)
+	}
+	return client, nil
+}
+
+// check interface
+var (
+	_ (Source) = (*MqttSource)(nil)
+)
+
+// MqttSource subscribes MQTT topic filter (default translated topic) and relays messages,
+// MQTT topic of each message is translated to subject (prefixed by subject of input if configured)
+type MqttSource struct {
+	*ingest
+	conf   InputConfig
+	client mqtt.Client
+	mutex  *sync.Mutex
+	filter string
+}
+
+func (s *MqttSource) Open() error {
+	if err := s.ingest.open(); err != nil {
+		return errors.WithStack(err)
+	}
+	client, err := newMqttClient(s.conf.Mqtt, s.onConnect)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.logger.Printf("debug: mqtt source connect %s", s.conf.Mqtt.Broker)
+	s.client = client
+	return nil
+}
+
+// onConnect subscribes again after reconnect
+func (s *MqttSource) onConnect(client mqtt.Client) {
+	s.mutex.Lock()
+	filter := s.filter
+	s.mutex.Unlock()
+
+	if len(filter) < 1 {
+		return
+	}
+	s.logger.Printf("info: mqtt source reconnected, resubscribe %s", filter)
+	client.Subscribe(filter, s.conf.Mqtt.Qos, s.receive)
+}
+
+func (s *MqttSource) Subscribe(topic string, prefixSize int, workers []chanque.Worker) error {
+	if err := s.ingest.prepare(topic, prefixSize, workers); err != nil {
+		return errors.WithStack(err)
+	}
+	if 0 < len(s.conf.Subject) && validInputSubject(s.conf.Subject) != true {
+		return errors.Wrapf(ErrInvalidInputSubject, "topic:%s subject:%s", topic, s.conf.Subject)
+	}
+	s.subject = s.conf.Subject
+
+	filter := s.conf.Mqtt.Topic
+	if len(filter) < 1 {
+		filter = natsToMqttTopic(topic)
+	}
+	s.mutex.Lock()
+	s.filter = filter
+	s.mutex.Unlock()
+
+	if err := mqttWait(s.client.Subscribe(filter, s.conf.Mqtt.Qos, s.receive), mqttTimeout(s.conf.Mqtt)); err != nil {
+		return errors.Wrapf(err, "filter: %s", filter)
+	}
+	return nil
+}
+
+func (s *MqttSource) Unsubscribe() error {
+	s.mutex.Lock()
+	filter := s.filter
+	s.filter = ""
+	s.mutex.Unlock()
+
+	if len(filter) < 1 || s.client == nil {
+		return nil
+	}
+	if err := mqttWait(s.client.Unsubscribe(filter), mqttTimeout(s.conf.Mqtt)); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (s *MqttSource) Close() error {
+	if err := s.Unsubscribe(); err != nil {
+		return errors.WithStack(err)
+	}
+	if s.client != nil {
+		s.client.Disconnect(mqttDisconnectQuiesceMs)
+		s.client = nil
+	}
+	return s.ingest.close()
+}
+
+func (s *MqttSource) receive(client mqtt.Client, m mqtt.Message) {
+	if m.Retained() && s.conf.Mqtt.IgnoreRetained {
+		return
+	}
+
+	subject := mqttToNatsSubject(m.Topic())
+	if 0 < len(s.subject) {
+		subject = s.subject + "." + subject
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = append(make([]byte, 0, len(m.Payload())), m.Payload()...)
+	msg.Header.Set(HeaderMqttTopic, m.Topic())
+	msg.Header.Set(HeaderMqttQos, strconv.Itoa(int(m.Qos())))
+	if m.Retained() {
+		msg.Header.Set(HeaderMqttRetained, "true")
+	}
+	if err := s.publish(msg); err != nil {
+		s.logger.Printf("warn: failed to ingest mqtt topic:%s err:%+v", m.Topic(), err)
+	}
+}
+
+func NewMqttSource(conf InputConfig, logger *log.Logger, funcs ...SourceOptFunc) *MqttSource {
+	return &MqttSource{
+		ingest: newIngest("mqtt://"+conf.Mqtt.Broker, logger, funcs...),
+		conf:   conf,
+		mutex:  new(sync.Mutex),
+	}
+}
+
+// check interface
+var (
+	_ Sink = (*mqttSink)(nil)
+)
+
+// mqttSink publishes messages to MQTT topic (default translated subject),
+// QoS and retain of messages received by MqttSource are kept unless overridden by config
+type mqttSink struct {
+	conf    MqttConfig
+	client  mqtt.Client
+	timeout time.Duration
+}
+
+func (s *mqttSink) Write(msgs []*nats.Msg) error {
+	tokens := make([]mqtt.Token, len(msgs))
+	for i, msg := range msgs {
+		topic := s.conf.Topic
+		if len(topic) < 1 {
+			topic = natsToMqttTopic(msg.Subject)
+		}
+		qos, retain := s.conf.Qos, s.conf.Retain
+		if msg.Header != nil {
+			if q, err := strconv.Atoi(msg.Header.Get(HeaderMqttQos)); err == nil && 0 <= q && q < int(qos) {
+				qos = byte(q)
+			}
+			if msg.Header.Get(HeaderMqttRetained) == "true" {
+				retain = true
+			}
+		}
+		tokens[i] = s.client.Publish(topic, qos, retain, msg.Data)
+	}
+	for _, token := range tokens {
+		if err := mqttWait(token, s.timeout); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (s *mqttSink) Close() error {
+	s.client.Disconnect(mqttDisconnectQuiesceMs)
+	return nil
+}
+
+func newMqttSink(conf MqttConfig) (*mqttSink, error) {
+	client, err := newMqttClient(conf, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &mqttSink{conf, client, mqttTimeout(conf)}, nil
+}
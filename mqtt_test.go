@@ -0,0 +1,229 @@
+package nrelay
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func testMqttServerStart(t *testing.T) (*server.Server, string, bool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", false
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	ns, err := server.NewServer(&server.Options{
+		ServerName: "nrelay-mqtt-test",
+		Host:       "127.0.0.1",
+		Port:       -1,
+		HTTPPort:   -1,
+		NoLog:      true,
+		NoSigs:     true,
+		JetStream:  true,
+		StoreDir:   t.TempDir(),
+		MQTT:       server.MQTTOpts{Host: "127.0.0.1", Port: port},
+	})
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	go ns.Start()
+	if ns.ReadyForConnections(10*time.Second) != true {
+		return nil, "", false
+	}
+	return ns, fmt.Sprintf("tcp://127.0.0.1:%d", port), true
+}
+
+func testMqttClient(t *testing.T, broker string) mqtt.Client {
+	client, err := newMqttClient(MqttConfig{Broker: broker, ClientId: t.Name()}, nil)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(mqttDisconnectQuiesceMs) })
+	return client
+}
+
+func TestMqttTopicTranslation(t *testing.T) {
+	t.Run("mqtt->nats", func(tt *testing.T) {
+		tests := map[string]string{
+			"a/b/c":     "a.b.c",
+			"a/+/c":     "a.*.c",
+			"a/#":       "a.>",
+			"a/b.c/d":   "a.b_c.d",
+			"/a":        "_.a",
+			"a/b c/d":   "a.b_c.d",
+			"sensors/+": "sensors.*",
+		}
+		for in, expect := range tests {
+			if s := mqttToNatsSubject(in); s != expect {
+				tt.Errorf("%s: expect %s actual %s", in, expect, s)
+			}
+		}
+	})
+	t.Run("nats->mqtt", func(tt *testing.T) {
+		tests := map[string]string{
+			"a.b.c": "a/b/c",
+			"a.*.c": "a/+/c",
+			"a.>":   "a/#",
+			"a.b/c": "a/b_c",
+			"a.b+c": "a/b_c",
+		}
+		for in, expect := range tests {
+			if s := natsToMqttTopic(in); s != expect {
+				tt.Errorf("%s: expect %s actual %s", in, expect, s)
+			}
+		}
+	})
+}
+
+func TestMqttSource(t *testing.T) {
+	ns, broker, ok := testMqttServerStart(t)
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer ns.Shutdown()
+
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+
+	t.Run("subscribe", func(tt *testing.T) {
+		workers, c := testIngestWorkers(tt, 2)
+		src := NewMqttSource(InputConfig{Type: InputTypeMqtt, Mqtt: MqttConfig{Broker: broker, Qos: 1}}, lg)
+		if err := src.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer src.Close()
+		if err := src.Subscribe("sensors.>", 0, workers); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		pub := testMqttClient(tt, broker)
+		if err := mqttWait(pub.Publish("sensors/room1/temp", 1, false, []byte("21.5")), time.Second); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if err := mqttWait(pub.Publish("other/room1", 1, false, []byte("x")), time.Second); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		msgs := c.wait(tt, 1)
+		time.Sleep(100 * time.Millisecond)
+		if n := len(c.wait(tt, 1)); n != 1 {
+			tt.Errorf("only filtered topic: %d", n)
+		}
+		m := msgs[0]
+		if m.Subject != "sensors.room1.temp" {
+			tt.Errorf("translated subject: %s", m.Subject)
+		}
+		if string(m.Data) != "21.5" {
+			tt.Errorf("payload: %s", m.Data)
+		}
+		if m.Header.Get(HeaderMqttTopic) != "sensors/room1/temp" || m.Header.Get(HeaderMqttQos) != "1" {
+			tt.Errorf("mqtt headers: %v", m.Header)
+		}
+	})
+	t.Run("retained", func(tt *testing.T) {
+		pub := testMqttClient(tt, broker)
+		if err := mqttWait(pub.Publish("status/d1", 1, true, []byte("online")), time.Second); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		for _, ignore := range []bool{false, true} {
+			workers, c := testIngestWorkers(tt, 1)
+			conf := InputConfig{Type: InputTypeMqtt, Subject: "bridge", Mqtt: MqttConfig{Broker: broker, Qos: 1, IgnoreRetained: ignore}}
+			src := NewMqttSource(conf, lg)
+			if err := src.Open(); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			if err := src.Subscribe("status.>", 0, workers); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+
+			if ignore {
+				time.Sleep(200 * time.Millisecond)
+				c.mutex.Lock()
+				if n := len(c.msgs); n != 0 {
+					tt.Errorf("retained must be ignored: %d", n)
+				}
+				c.mutex.Unlock()
+			} else {
+				m := c.wait(tt, 1)[0]
+				if m.Subject != "bridge.status.d1" {
+					tt.Errorf("prefixed subject: %s", m.Subject)
+				}
+				if m.Header.Get(HeaderMqttRetained) != "true" {
+					tt.Errorf("retained header: %v", m.Header)
+				}
+			}
+			src.Close()
+		}
+	})
+}
+
+func TestMqttSink(t *testing.T) {
+	ns, broker, ok := testMqttServerStart(t)
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer ns.Shutdown()
+
+	type received struct {
+		topic    string
+		payload  string
+		qos      byte
+		retained bool
+	}
+	ch := make(chan received, 10)
+	sub := testMqttClient(t, broker)
+	handler := func(c mqtt.Client, m mqtt.Message) {
+		ch <- received{m.Topic(), string(m.Payload()), m.Qos(), m.Retained()}
+	}
+	if err := mqttWait(sub.Subscribe("devices/#", 1, handler), time.Second); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	sink, err := newMqttSink(MqttConfig{Broker: broker, Qos: 1})
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer sink.Close()
+
+	m1 := nats.NewMsg("devices.d1.cmd")
+	m1.Data = []byte("reboot")
+	m2 := nats.NewMsg("devices.d2.cmd")
+	m2.Data = []byte("noop")
+	m2.Header.Set(HeaderMqttQos, "0")
+	if err := sink.Write([]*nats.Msg{m1, m2}); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	got := map[string]received{}
+	for i := 0; i < 2; i += 1 {
+		select {
+		case r := <-ch:
+			got[r.topic] = r
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout: %v", got)
+		}
+	}
+	if r := got["devices/d1/cmd"]; r.payload != "reboot" || r.qos != 1 {
+		t.Errorf("translated topic with qos 1: %+v", r)
+	}
+	if r := got["devices/d2/cmd"]; r.payload != "noop" || r.qos != 0 {
+		t.Errorf("qos lowered by header: %+v", r)
+	}
+
+	t.Run("broker_required", func(tt *testing.T) {
+		if _, err := newMqttSink(MqttConfig{}); err == nil {
+			tt.Errorf("broker required")
+		}
+		if _, err := newMqttSink(MqttConfig{Broker: broker, Qos: 3}); err == nil {
+			tt.Errorf("invalid qos")
+		}
+	})
+}
@@ -0,0 +1,334 @@
+package nrelay
+
+import (
+	"container/heap"
+	"expvar"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultOrderingWindow     time.Duration = 100 * time.Millisecond
+	defaultOrderingMaxPending int           = 1024
+	defaultOrderingKeyTTL     time.Duration = 5 * time.Minute
+)
+
+const (
+	metricOrderReordered  string = "order_reordered"
+	metricOrderGaps       string = "order_gaps"
+	metricOrderLate       string = "order_late"
+	metricOrderUnsequence string = "order_unsequenced"
+)
+
+type orderingItem struct {
+	seq     uint64
+	msg     *nats.Msg
+	next    RelayHandler
+	arrived time.Time
+}
+
+// orderingHeap is min-heap of seq
+type orderingHeap []*orderingItem
+
+func (h orderingHeap) Len() int           { return len(h) }
+func (h orderingHeap) Less(i, j int) bool { return h[i].seq < h[j].seq }
+func (h orderingHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *orderingHeap) Push(x interface{}) {
+	*h = append(*h, x.(*orderingItem))
+}
+
+func (h *orderingHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[0 : n-1]
+	return item
+}
+
+// orderingKey is sequence state of a partition key
+type orderingKey struct {
+	mutex        *sync.Mutex
+	started      bool
+	next         uint64
+	pending      orderingHeap
+	waitingSince time.Time
+	lastSeen     time.Time
+}
+
+// ordering reorders messages by sequence header per partition key within window,
+// messages from primary and secondary are released in sequence order.
+// Missing sequences are skipped (gap) when the window elapsed or pending exceeds maxPending
+type ordering struct {
+	topic      string
+	conf       OrderingConfig
+	prefixSize int
+	keyHeader  string
+	window     time.Duration
+	maxPending int
+	logger     *log.Logger
+	metrics    *expvar.Map
+	mutex      *sync.RWMutex
+	keys       map[string]*orderingKey
+	done       chan struct{}
+	wg         *sync.WaitGroup
+}
+
+// key returns partition key of msg, the same key as distribute to keep ordering per worker
+func (o *ordering) key(msg *nats.Msg) string {
+	return partitionKey(msg, o.prefixSize, o.keyHeader)
+}
+
+func (o *ordering) state(key string) *orderingKey {
+	o.mutex.RLock()
+	st, ok := o.keys[key]
+	o.mutex.RUnlock()
+	if ok {
+		return st
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if st, ok := o.keys[key]; ok {
+		return st
+	}
+	st = &orderingKey{mutex: new(sync.Mutex)}
+	o.keys[key] = st
+	return st
+}
+
+func (o *ordering) Middleware(topic string, next RelayHandler) RelayHandler {
+	return func(msg *nats.Msg) error {
+		seq, err := strconv.ParseUint(msg.Header.Get(o.conf.Header), 10, 64)
+		if err != nil {
+			o.metrics.Add(metricOrderUnsequence, 1)
+			return next(msg)
+		}
+
+		key := o.key(msg)
+		st := o.state(key)
+		st.mutex.Lock()
+		defer st.mutex.Unlock()
+
+		return o.receive(key, st, &orderingItem{seq, msg, next, time.Now()})
+	}
+}
+
+func (o *ordering) receive(key string, st *orderingKey, item *orderingItem) error {
+	st.lastSeen = item.arrived
+	if st.started != true {
+		st.started = true
+		st.next = item.seq
+	}
+
+	if item.seq < st.next {
+		return o.late(key, item)
+	}
+	if item.seq == st.next {
+		st.next += 1
+		err := item.next(item.msg)
+		if e := o.release(st); e != nil && err == nil {
+			err = e
+		}
+		return err
+	}
+
+	if len(st.pending) == 0 {
+		st.waitingSince = item.arrived
+	}
+	heap.Push(&st.pending, item)
+	if o.maxPending <= len(st.pending) {
+		return o.skipGap(key, st)
+	}
+	return nil
+}
+
+func (o *ordering) late(key string, item *orderingItem) error {
+	o.metrics.Add(metricOrderLate, 1)
+	o.logger.Printf("debug: ordering late arrival topic:%s key:%s seq:%d", o.topic, key, item.seq)
+	if o.conf.DropLate {
+		return nil
+	}
+	return item.next(item.msg)
+}
+
+// release emits pending messages continued from next
+func (o *ordering) release(st *orderingKey) error {
+	var err error
+	for 0 < len(st.pending) {
+		top := st.pending[0]
+		if st.next < top.seq {
+			break
+		}
+		heap.Pop(&st.pending)
+
+		if top.seq < st.next {
+			// duplicated sequence
+			o.metrics.Add(metricOrderLate, 1)
+			if o.conf.DropLate {
+				continue
+			}
+		} else {
+			st.next = top.seq + 1
+			o.metrics.Add(metricOrderReordered, 1)
+		}
+		if e := top.next(top.msg); e != nil && err == nil {
+			err = e
+		}
+	}
+	if 0 < len(st.pending) {
+		st.waitingSince = time.Now()
+	}
+	return err
+}
+
+// skipGap gives up missing sequences before the smallest pending
+func (o *ordering) skipGap(key string, st *orderingKey) error {
+	top := st.pending[0]
+	o.metrics.Add(metricOrderGaps, int64(top.seq-st.next))
+	o.logger.Printf("warn: ordering gap topic:%s key:%s missing seq:%d-%d", o.topic, key, st.next, top.seq-1)
+	st.next = top.seq
+	return o.release(st)
+}
+
+// expire skips gaps waiting longer than window and removes idle keys
+func (o *ordering) expire(now time.Time) {
+	o.mutex.RLock()
+	keys := make(map[string]*orderingKey, len(o.keys))
+	for k, st := range o.keys {
+		keys[k] = st
+	}
+	o.mutex.RUnlock()
+
+	idle := make([]string, 0)
+	for k, st := range keys {
+		st.mutex.Lock()
+		if 0 < len(st.pending) && o.window <= now.Sub(st.waitingSince) {
+			if err := o.skipGap(k, st); err != nil {
+				o.logger.Printf("warn: ordering release error topic:%s key:%s err:%+v", o.topic, k, err)
+			}
+		}
+		if len(st.pending) == 0 && defaultOrderingKeyTTL <= now.Sub(st.lastSeen) {
+			idle = append(idle, k)
+		}
+		st.mutex.Unlock()
+	}
+	if len(idle) < 1 {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, k := range idle {
+		if st, ok := o.keys[k]; ok {
+			st.mutex.Lock()
+			if len(st.pending) == 0 && defaultOrderingKeyTTL <= now.Sub(st.lastSeen) {
+				delete(o.keys, k)
+			}
+			st.mutex.Unlock()
+		}
+	}
+}
+
+// flush releases all pending messages in sequence order, handlers are called after unlocking
+func (o *ordering) flush() {
+	items := make([]*orderingItem, 0)
+
+	o.mutex.Lock()
+	for k, st := range o.keys {
+		st.mutex.Lock()
+		for 0 < len(st.pending) {
+			item := heap.Pop(&st.pending).(*orderingItem)
+			if item.seq < st.next {
+				o.metrics.Add(metricOrderLate, 1)
+				if o.conf.DropLate {
+					continue
+				}
+			} else {
+				if st.next < item.seq {
+					o.metrics.Add(metricOrderGaps, int64(item.seq-st.next))
+					o.logger.Printf("warn: ordering gap topic:%s key:%s missing seq:%d-%d", o.topic, k, st.next, item.seq-1)
+				}
+				st.next = item.seq + 1
+			}
+			items = append(items, item)
+		}
+		st.mutex.Unlock()
+	}
+	o.mutex.Unlock()
+
+	for _, item := range items {
+		if err := item.next(item.msg); err != nil {
+			o.logger.Printf("warn: ordering release error topic:%s subj:%s err:%+v", o.topic, item.msg.Subject, err)
+		}
+	}
+}
+
+func (o *ordering) run() {
+	defer o.wg.Done()
+
+	ticker := time.NewTicker(o.window / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.done:
+			return
+		case now := <-ticker.C:
+			o.expire(now)
+		}
+	}
+}
+
+// Close stops window timer, pending messages are released
+func (o *ordering) Close() error {
+	close(o.done)
+	o.wg.Wait()
+	o.flush()
+	return nil
+}
+
+func newOrdering(topic string, conf RelayClientConfig, logger *log.Logger, metrics *expvar.Map) (*ordering, error) {
+	if conf.Partition.Strategy == PartitionRoundRobin || conf.Partition.Strategy == PartitionLeastLoaded {
+		return nil, errors.Errorf("ordering is not available on partition strategy: %s", conf.Partition.Strategy)
+	}
+
+	window := conf.Ordering.Window
+	if window <= 0 {
+		window = defaultOrderingWindow
+	}
+	maxPending := conf.Ordering.MaxPending
+	if maxPending < 1 {
+		maxPending = defaultOrderingMaxPending
+	}
+	keyHeader := ""
+	if conf.Partition.Strategy == PartitionHeader {
+		keyHeader = conf.Partition.Header
+	}
+
+	o := &ordering{
+		topic:      topic,
+		conf:       conf.Ordering,
+		prefixSize: conf.PrefixSize,
+		keyHeader:  keyHeader,
+		window:     window,
+		maxPending: maxPending,
+		logger:     logger,
+		metrics:    metrics,
+		mutex:      new(sync.RWMutex),
+		keys:       make(map[string]*orderingKey),
+		done:       make(chan struct{}),
+		wg:         new(sync.WaitGroup),
+	}
+	o.wg.Add(1)
+	go o.run()
+	return o, nil
+}
@@ -0,0 +1,164 @@
+package nrelay
+
+import (
+	"expvar"
+	"log"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type testOrderingCollector struct {
+	mutex *sync.Mutex
+	seqs  []string
+}
+
+func (c *testOrderingCollector) next(msg *nats.Msg) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.seqs = append(c.seqs, msg.Subject+":"+msg.Header.Get("Nrelay-Sequence"))
+	return nil
+}
+
+func (c *testOrderingCollector) get() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]string(nil), c.seqs...)
+}
+
+func testOrderingMsg(subject string, seq int) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set("Nrelay-Sequence", strconv.Itoa(seq))
+	return msg
+}
+
+func testNewOrdering(t *testing.T, conf OrderingConfig) (*ordering, RelayHandler, *testOrderingCollector, *expvar.Map) {
+	conf.Header = "Nrelay-Sequence"
+	lg := log.New(&testTapLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	metrics := new(expvar.Map).Init()
+	o, err := newOrdering("test.>", RelayClientConfig{Ordering: conf}, lg, metrics)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	c := &testOrderingCollector{mutex: new(sync.Mutex)}
+	return o, o.Middleware("test.>", c.next), c, metrics
+}
+
+func testEqualSeqs(t *testing.T, expect, actual []string) {
+	if len(expect) != len(actual) {
+		t.Errorf("expect:%v actual:%v", expect, actual)
+		return
+	}
+	for i := range expect {
+		if expect[i] != actual[i] {
+			t.Errorf("expect:%v actual:%v", expect, actual)
+			return
+		}
+	}
+}
+
+func TestOrdering(t *testing.T) {
+	t.Run("reorder", func(tt *testing.T) {
+		o, h, c, metrics := testNewOrdering(tt, OrderingConfig{Window: time.Minute})
+		defer o.Close()
+
+		for _, seq := range []int{1, 3, 4, 2, 5} {
+			h(testOrderingMsg("test.a", seq))
+		}
+		testEqualSeqs(tt, []string{"test.a:1", "test.a:2", "test.a:3", "test.a:4", "test.a:5"}, c.get())
+		if v := metrics.Get(metricOrderReordered).String(); v != "2" {
+			tt.Errorf("expect:2 actual:%s", v)
+		}
+	})
+	t.Run("per/key", func(tt *testing.T) {
+		o, h, c, _ := testNewOrdering(tt, OrderingConfig{Window: time.Minute})
+		defer o.Close()
+
+		h(testOrderingMsg("test.a", 10))
+		h(testOrderingMsg("test.b", 100))
+		h(testOrderingMsg("test.a", 12))
+		h(testOrderingMsg("test.b", 101))
+		h(testOrderingMsg("test.a", 11))
+		testEqualSeqs(tt, []string{"test.a:10", "test.b:100", "test.b:101", "test.a:11", "test.a:12"}, c.get())
+	})
+	t.Run("gap/window", func(tt *testing.T) {
+		o, h, c, metrics := testNewOrdering(tt, OrderingConfig{Window: 20 * time.Millisecond})
+		defer o.Close()
+
+		h(testOrderingMsg("test.a", 1))
+		h(testOrderingMsg("test.a", 4))
+		testEqualSeqs(tt, []string{"test.a:1"}, c.get())
+
+		time.Sleep(100 * time.Millisecond)
+		testEqualSeqs(tt, []string{"test.a:1", "test.a:4"}, c.get())
+		if v := metrics.Get(metricOrderGaps).String(); v != "2" {
+			tt.Errorf("2 sequences missing: %s", v)
+		}
+	})
+	t.Run("gap/max-pending", func(tt *testing.T) {
+		o, h, c, metrics := testNewOrdering(tt, OrderingConfig{Window: time.Minute, MaxPending: 2})
+		defer o.Close()
+
+		h(testOrderingMsg("test.a", 1))
+		h(testOrderingMsg("test.a", 3))
+		h(testOrderingMsg("test.a", 4))
+		testEqualSeqs(tt, []string{"test.a:1", "test.a:3", "test.a:4"}, c.get())
+		if v := metrics.Get(metricOrderGaps).String(); v != "1" {
+			tt.Errorf("expect:1 actual:%s", v)
+		}
+	})
+	t.Run("late", func(tt *testing.T) {
+		o, h, c, metrics := testNewOrdering(tt, OrderingConfig{Window: time.Minute})
+		defer o.Close()
+
+		h(testOrderingMsg("test.a", 1))
+		h(testOrderingMsg("test.a", 2))
+		h(testOrderingMsg("test.a", 1))
+		testEqualSeqs(tt, []string{"test.a:1", "test.a:2", "test.a:1"}, c.get())
+		if v := metrics.Get(metricOrderLate).String(); v != "1" {
+			tt.Errorf("expect:1 actual:%s", v)
+		}
+	})
+	t.Run("late/drop", func(tt *testing.T) {
+		o, h, c, _ := testNewOrdering(tt, OrderingConfig{Window: time.Minute, DropLate: true})
+		defer o.Close()
+
+		h(testOrderingMsg("test.a", 1))
+		h(testOrderingMsg("test.a", 2))
+		h(testOrderingMsg("test.a", 1))
+		testEqualSeqs(tt, []string{"test.a:1", "test.a:2"}, c.get())
+	})
+	t.Run("unsequenced", func(tt *testing.T) {
+		o, h, c, metrics := testNewOrdering(tt, OrderingConfig{})
+		defer o.Close()
+
+		h(&nats.Msg{Subject: "test.a"})
+		testEqualSeqs(tt, []string{"test.a:"}, c.get())
+		if v := metrics.Get(metricOrderUnsequence).String(); v != "1" {
+			tt.Errorf("expect:1 actual:%s", v)
+		}
+	})
+	t.Run("close/flush", func(tt *testing.T) {
+		o, h, c, _ := testNewOrdering(tt, OrderingConfig{Window: time.Minute})
+		h(testOrderingMsg("test.a", 1))
+		h(testOrderingMsg("test.a", 5))
+		h(testOrderingMsg("test.a", 3))
+		o.Close()
+		testEqualSeqs(tt, []string{"test.a:1", "test.a:3", "test.a:5"}, c.get())
+	})
+	t.Run("partition/unordered", func(tt *testing.T) {
+		lg := log.New(&testTapLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+		conf := RelayClientConfig{
+			Ordering:  OrderingConfig{Header: "Nrelay-Sequence"},
+			Partition: PartitionConfig{Strategy: PartitionRoundRobin},
+		}
+		if _, err := newOrdering("test.>", conf, lg, new(expvar.Map).Init()); err == nil {
+			tt.Errorf("round-robin can not keep ordering")
+		}
+	})
+}
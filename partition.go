@@ -0,0 +1,230 @@
+package nrelay
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/lafikl/consistent"
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+const (
+	PartitionConsistent  string = "consistent"
+	PartitionJump        string = "jump"
+	PartitionRoundRobin  string = "round-robin"
+	PartitionLeastLoaded string = "least-loaded"
+	PartitionHeader      string = "header"
+)
+
+const (
+	distributeSlotSize int = 4096 // power of 2
+)
+
+var (
+	ErrUnknownPartition = errors.New("unknown partition strategy")
+)
+
+// Partitioner chooses worker index of msg, key is subject(or prefix of subject).
+// Partition is called concurrently from source connections
+type Partitioner interface {
+	Partition(key string, msg *nats.Msg) int
+}
+
+// check interface
+var (
+	_ Partitioner = (*consistentPartitioner)(nil)
+	_ Partitioner = (*jumpPartitioner)(nil)
+	_ Partitioner = (*roundRobinPartitioner)(nil)
+	_ Partitioner = (*leastLoadedPartitioner)(nil)
+	_ Partitioner = (*headerPartitioner)(nil)
+)
+
+// fnv32a is FNV-1a hash of s without allocation
+func fnv32a(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i += 1 {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// fnv64a is FNV-1a hash of s without allocation
+func fnv64a(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i += 1 {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// partitionKey returns value of keyHeader if present, otherwise subject prefix of prefixSize (whole subject if 0)
+func partitionKey(msg *nats.Msg, prefixSize int, keyHeader string) string {
+	if 0 < len(keyHeader) && msg.Header != nil {
+		if v := msg.Header.Get(keyHeader); 0 < len(v) {
+			return v
+		}
+	}
+	if 0 < prefixSize && prefixSize <= len(msg.Subject) {
+		return msg.Subject[0:prefixSize]
+	}
+	return msg.Subject
+}
+
+// consistentPartitioner maps key to worker by precomputed slots,
+// slots are assigned to workers by consistent hash at construction
+// so that Partition does not allocate nor lock on hot path
+type consistentPartitioner struct {
+	slots []int
+	mask  uint32
+}
+
+func (p *consistentPartitioner) Partition(key string, msg *nats.Msg) int {
+	return p.slots[fnv32a(key)&p.mask]
+}
+
+func newConsistentPartitioner(size int) *consistentPartitioner {
+	slots := make([]int, distributeSlotSize)
+	if 1 < size {
+		c := consistent.New()
+		m := make(map[string]int, size)
+		for i := 0; i < size; i += 1 {
+			id := strconv.Itoa(i)
+			m[id] = i
+			c.Add(id)
+		}
+		for i := range slots {
+			id, err := c.Get(strconv.Itoa(i))
+			if err != nil {
+				continue // fallback to 0
+			}
+			slots[i] = m[id]
+		}
+	}
+	return &consistentPartitioner{slots, uint32(distributeSlotSize - 1)}
+}
+
+// jumpPartitioner is Jump Consistent Hash (Lamping and Veach),
+// even distribution and minimal movement when number of workers changes
+type jumpPartitioner struct {
+	size int64
+}
+
+func (p *jumpPartitioner) Partition(key string, msg *nats.Msg) int {
+	h := fnv64a(key)
+	b, j := int64(-1), int64(0)
+	for j < p.size {
+		b = j
+		h = h*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((h>>33)+1)))
+	}
+	return int(b)
+}
+
+// roundRobinPartitioner distributes evenly regardless of key, ordering per key is not preserved
+type roundRobinPartitioner struct {
+	size    uint64
+	counter uint64
+}
+
+func (p *roundRobinPartitioner) Partition(key string, msg *nats.Msg) int {
+	return int((atomic.AddUint64(&p.counter, 1) - 1) % p.size)
+}
+
+// workerLen is implemented by workers that report queue length
+type workerLen interface {
+	Len() int
+}
+
+// leastLoadedPartitioner chooses worker of the shortest queue, ordering per key is not preserved.
+// workers not implementing Len are treated as empty
+type leastLoadedPartitioner struct {
+	workers []chanque.Worker
+}
+
+func (p *leastLoadedPartitioner) Partition(key string, msg *nats.Msg) int {
+	idx, min := 0, -1
+	for i, w := range p.workers {
+		n := 0
+		if l, ok := w.(workerLen); ok {
+			n = l.Len()
+		}
+		if min < 0 || n < min {
+			idx, min = i, n
+		}
+		if min == 0 {
+			break
+		}
+	}
+	return idx
+}
+
+// headerPartitioner keeps messages of the same header value on the same worker,
+// key is used if msg has no header
+type headerPartitioner struct {
+	header string
+	hash   *consistentPartitioner
+}
+
+func (p *headerPartitioner) Partition(key string, msg *nats.Msg) int {
+	if msg.Header != nil {
+		if v := msg.Header.Get(p.header); 0 < len(v) {
+			return p.hash.Partition(v, msg)
+		}
+	}
+	return p.hash.Partition(key, msg)
+}
+
+// NewPartitioner returns Partitioner of conf.Strategy for workers, consistent hash is default
+func NewPartitioner(conf PartitionConfig, workers []chanque.Worker) (Partitioner, error) {
+	size := len(workers)
+	if size < 1 {
+		size = 1 // always partition to 0
+	}
+	switch conf.Strategy {
+	case "", PartitionConsistent:
+		return newConsistentPartitioner(size), nil
+	case PartitionJump:
+		return &jumpPartitioner{int64(size)}, nil
+	case PartitionRoundRobin:
+		return &roundRobinPartitioner{size: uint64(size)}, nil
+	case PartitionLeastLoaded:
+		return &leastLoadedPartitioner{workers}, nil
+	case PartitionHeader:
+		if len(conf.Header) < 1 {
+			return nil, errors.Wrapf(ErrUnknownPartition, "header is required: %s", conf.Strategy)
+		}
+		return &headerPartitioner{conf.Header, newConsistentPartitioner(size)}, nil
+	}
+	return nil, errors.Wrapf(ErrUnknownPartition, "strategy: %s", conf.Strategy)
+}
+
+// countedWorker reports number of messages enqueued but not handled yet
+type countedWorker struct {
+	chanque.Worker
+	pending int64
+}
+
+func (w *countedWorker) Enqueue(param interface{}) bool {
+	atomic.AddInt64(&w.pending, 1)
+	if w.Worker.Enqueue(param) != true {
+		atomic.AddInt64(&w.pending, -1)
+		return false
+	}
+	return true
+}
+
+func (w *countedWorker) Len() int {
+	return int(atomic.LoadInt64(&w.pending))
+}
+
+// Handler wraps handler to count handled messages
+func (w *countedWorker) Handler(handler chanque.WorkerHandler) chanque.WorkerHandler {
+	return func(param interface{}) {
+		handler(param)
+		atomic.AddInt64(&w.pending, -1)
+	}
+}
@@ -0,0 +1,166 @@
+package nrelay
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+type testLenWorker struct {
+	testDistributeWorker
+	length int
+}
+
+func (w *testLenWorker) Len() int {
+	return w.length
+}
+
+func testPartitionWorkers(n int) []chanque.Worker {
+	workers := make([]chanque.Worker, n)
+	for i := 0; i < n; i += 1 {
+		workers[i] = new(testDistributeWorker)
+	}
+	return workers
+}
+
+func TestNewPartitioner(t *testing.T) {
+	msg := &nats.Msg{}
+	t.Run("unknown", func(tt *testing.T) {
+		_, err := NewPartitioner(PartitionConfig{Strategy: "random"}, testPartitionWorkers(3))
+		if errors.Is(err, ErrUnknownPartition) != true {
+			tt.Errorf("must be ErrUnknownPartition: %+v", err)
+		}
+	})
+	t.Run("header/required", func(tt *testing.T) {
+		_, err := NewPartitioner(PartitionConfig{Strategy: PartitionHeader}, testPartitionWorkers(3))
+		if err == nil {
+			tt.Errorf("header strategy requires header name")
+		}
+	})
+	t.Run("default/consistent", func(tt *testing.T) {
+		p, err := NewPartitioner(PartitionConfig{}, testPartitionWorkers(3))
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if _, ok := p.(*consistentPartitioner); ok != true {
+			tt.Errorf("default must be consistent: %T", p)
+		}
+	})
+	t.Run("no/workers", func(tt *testing.T) {
+		strategies := []string{PartitionConsistent, PartitionJump, PartitionRoundRobin, PartitionLeastLoaded}
+		for _, strategy := range strategies {
+			p, err := NewPartitioner(PartitionConfig{Strategy: strategy}, nil)
+			if err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			if i := p.Partition("foo", msg); i != 0 {
+				tt.Errorf("%s must partition to 0: %d", strategy, i)
+			}
+		}
+	})
+}
+
+func TestPartitioner(t *testing.T) {
+	msg := &nats.Msg{}
+	testStickyEven := func(tt *testing.T, p Partitioner, size int) {
+		counts := make([]int, size)
+		for i := 0; i < 10000; i += 1 {
+			key := "foo." + strconv.Itoa(i)
+			idx := p.Partition(key, msg)
+			if idx < 0 || size <= idx {
+				tt.Fatalf("out of range: %d", idx)
+			}
+			if p.Partition(key, msg) != idx {
+				tt.Errorf("same key must be same worker: %s", key)
+			}
+			counts[idx] += 1
+		}
+		for i, c := range counts {
+			if c < 10000/size/4 {
+				tt.Errorf("worker[%d] must be assigned evenly: %v", i, counts)
+			}
+		}
+	}
+
+	t.Run("consistent", func(tt *testing.T) {
+		p, _ := NewPartitioner(PartitionConfig{Strategy: PartitionConsistent}, testPartitionWorkers(4))
+		testStickyEven(tt, p, 4)
+	})
+	t.Run("jump", func(tt *testing.T) {
+		p, _ := NewPartitioner(PartitionConfig{Strategy: PartitionJump}, testPartitionWorkers(4))
+		testStickyEven(tt, p, 4)
+	})
+	t.Run("jump/minimal-movement", func(tt *testing.T) {
+		p4 := &jumpPartitioner{4}
+		p5 := &jumpPartitioner{5}
+		for i := 0; i < 1000; i += 1 {
+			key := strconv.Itoa(i)
+			if idx := p5.Partition(key, msg); idx != 4 && idx != p4.Partition(key, msg) {
+				tt.Errorf("key must stay or move to new worker: %s", key)
+			}
+		}
+	})
+	t.Run("round-robin", func(tt *testing.T) {
+		p, _ := NewPartitioner(PartitionConfig{Strategy: PartitionRoundRobin}, testPartitionWorkers(3))
+		for i := 0; i < 9; i += 1 {
+			if idx := p.Partition("same", msg); idx != i%3 {
+				tt.Errorf("expect:%d actual:%d", i%3, idx)
+			}
+		}
+	})
+	t.Run("least-loaded", func(tt *testing.T) {
+		workers := []*testLenWorker{{length: 5}, {length: 2}, {length: 7}}
+		cw := make([]chanque.Worker, len(workers))
+		for i, w := range workers {
+			cw[i] = w
+		}
+		p, _ := NewPartitioner(PartitionConfig{Strategy: PartitionLeastLoaded}, cw)
+		if idx := p.Partition("a", msg); idx != 1 {
+			tt.Errorf("expect:1 actual:%d", idx)
+		}
+		workers[2].length = 0
+		if idx := p.Partition("a", msg); idx != 2 {
+			tt.Errorf("expect:2 actual:%d", idx)
+		}
+	})
+	t.Run("header", func(tt *testing.T) {
+		p, _ := NewPartitioner(PartitionConfig{Strategy: PartitionHeader, Header: "X-Key"}, testPartitionWorkers(8))
+		expect := -1
+		for i := 0; i < 100; i += 1 {
+			m := nats.NewMsg("foo." + strconv.Itoa(i))
+			m.Header.Set("X-Key", "user-1")
+			idx := p.Partition(m.Subject, m)
+			if expect < 0 {
+				expect = idx
+			}
+			if idx != expect {
+				tt.Errorf("same header value must be same worker: %d != %d", idx, expect)
+			}
+		}
+		noHeader := &nats.Msg{Subject: "foo.1"}
+		if p.Partition("foo.1", noHeader) != p.Partition("foo.1", noHeader) {
+			tt.Errorf("fallback to key")
+		}
+	})
+}
+
+func TestCountedWorker(t *testing.T) {
+	handled := make(chan interface{}, 10)
+	w := &countedWorker{Worker: new(testDistributeWorker)}
+	h := w.Handler(func(param interface{}) {
+		handled <- param
+	})
+
+	w.Enqueue(1)
+	w.Enqueue(2)
+	if w.Len() != 2 {
+		t.Errorf("expect:2 actual:%d", w.Len())
+	}
+	h(1)
+	if w.Len() != 1 {
+		t.Errorf("expect:1 actual:%d", w.Len())
+	}
+}
@@ -0,0 +1,163 @@
+package nrelay
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+const (
+	RateLimitModeDelay string = "delay"
+	RateLimitModeDrop  string = "drop"
+)
+
+var (
+	ErrUnknownRateLimitMode = errors.New("unknown ratelimit mode")
+)
+
+// RateLimiter is token-bucket limiter of messages/sec and bytes/sec
+type RateLimiter struct {
+	msgs      *rate.Limiter
+	bytes     *rate.Limiter
+	byteBurst int
+	drop      bool
+	metrics   *expvar.Map
+}
+
+// rateReservation is tokens reserved from a RateLimiter, cancelled if the message is dropped
+type rateReservation struct {
+	limiter *RateLimiter
+	msgs    *rate.Reservation
+	bytes   *rate.Reservation
+	delay   time.Duration
+}
+
+func (r rateReservation) cancel(now time.Time) {
+	if r.msgs != nil {
+		r.msgs.CancelAt(now)
+	}
+	if r.bytes != nil {
+		r.bytes.CancelAt(now)
+	}
+}
+
+func (l *RateLimiter) reserve(now time.Time, size int) rateReservation {
+	r := rateReservation{limiter: l}
+	if l.msgs != nil {
+		r.msgs = l.msgs.ReserveN(now, 1)
+		if d := r.msgs.DelayFrom(now); r.delay < d {
+			r.delay = d
+		}
+	}
+	if l.bytes != nil {
+		// message larger than burst can not be reserved, it consumes whole bucket
+		n := size
+		if l.byteBurst < n {
+			n = l.byteBurst
+		}
+		r.bytes = l.bytes.ReserveN(now, n)
+		if d := r.bytes.DelayFrom(now); r.delay < d {
+			r.delay = d
+		}
+	}
+	return r
+}
+
+// Take consumes tokens of a message of size bytes,
+// waits until tokens are available on delay mode, returns false on drop mode if tokens are not enough
+func (l *RateLimiter) Take(size int) bool {
+	return takeRateLimiters([]*RateLimiter{l}, size)
+}
+
+// takeRateLimiters reserves tokens of all limiters at once, then waits the longest delay.
+// If a limiter on drop mode has not enough tokens, the message is dropped and tokens reserved
+// from every limiter are returned
+func takeRateLimiters(limiters []*RateLimiter, size int) bool {
+	now := time.Now()
+	// topic and destination limiters at most
+	buf := [2]rateReservation{}
+	reservations := buf[:0]
+	delay := time.Duration(0)
+	drop := false
+	for _, l := range limiters {
+		r := l.reserve(now, size)
+		reservations = append(reservations, r)
+		if r.delay <= 0 {
+			continue
+		}
+		if l.drop {
+			drop = true
+		}
+		if delay < r.delay {
+			delay = r.delay
+		}
+	}
+
+	if delay <= 0 {
+		return true
+	}
+
+	if drop {
+		for _, r := range reservations {
+			r.cancel(now)
+			if r.limiter.drop && 0 < r.delay {
+				r.limiter.metrics.Add(metricThrottledDropped, 1)
+			}
+		}
+		return false
+	}
+
+	for _, r := range reservations {
+		if 0 < r.delay {
+			r.limiter.metrics.Add(metricThrottledDelayed, 1)
+			r.limiter.metrics.Add(metricThrottledDelayMs, r.delay.Milliseconds())
+		}
+	}
+	time.Sleep(delay)
+	return true
+}
+
+// NewRateLimiter returns nil if conf has no limit
+func NewRateLimiter(conf RateLimitConfig, metrics *expvar.Map) (*RateLimiter, error) {
+	if conf.Configured() != true {
+		return nil, nil
+	}
+	switch conf.Mode {
+	case "", RateLimitModeDelay, RateLimitModeDrop:
+		// ok
+	default:
+		return nil, errors.Wrapf(ErrUnknownRateLimitMode, "mode: %s", conf.Mode)
+	}
+	if metrics == nil {
+		metrics = new(expvar.Map).Init()
+	}
+
+	l := &RateLimiter{
+		drop:    conf.Mode == RateLimitModeDrop,
+		metrics: metrics,
+	}
+	if 0 < conf.Msgs {
+		burst := conf.MsgBurst
+		if burst < 1 {
+			burst = int(conf.Msgs)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		l.msgs = rate.NewLimiter(rate.Limit(conf.Msgs), burst)
+	}
+	if 0 < conf.Bytes {
+		burst := conf.ByteBurst
+		if burst < 1 {
+			burst = int(conf.Bytes)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		l.bytes = rate.NewLimiter(rate.Limit(conf.Bytes), burst)
+		l.byteBurst = burst
+	}
+	return l, nil
+}
@@ -0,0 +1,141 @@
+package nrelay
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func testNewRateLimiter(t *testing.T, conf RateLimitConfig, m *expvar.Map) *RateLimiter {
+	l, err := NewRateLimiter(conf, m)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	return l
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("notconfigured", func(tt *testing.T) {
+		if l, err := NewRateLimiter(RateLimitConfig{}, new(expvar.Map).Init()); l != nil || err != nil {
+			tt.Errorf("no limit must be nil")
+		}
+	})
+	t.Run("msgs/drop", func(tt *testing.T) {
+		m := new(expvar.Map).Init()
+		l := testNewRateLimiter(tt, RateLimitConfig{Msgs: 1, MsgBurst: 5, Mode: RateLimitModeDrop}, m)
+		allowed := 0
+		for i := 0; i < 20; i += 1 {
+			if l.Take(10) {
+				allowed += 1
+			}
+		}
+		if allowed != 5 {
+			tt.Errorf("burst only allowed: %d", allowed)
+		}
+		if v := m.Get(metricThrottledDropped).(*expvar.Int).Value(); v != 15 {
+			tt.Errorf("dropped count expect:15 actual:%d", v)
+		}
+	})
+	t.Run("bytes/drop", func(tt *testing.T) {
+		m := new(expvar.Map).Init()
+		l := testNewRateLimiter(tt, RateLimitConfig{Bytes: 1, ByteBurst: 100, Mode: RateLimitModeDrop}, m)
+		if l.Take(60) != true {
+			tt.Errorf("within burst")
+		}
+		if l.Take(60) {
+			tt.Errorf("exceeded burst must be dropped")
+		}
+		if l.Take(40) != true {
+			tt.Errorf("rest of burst")
+		}
+	})
+	t.Run("bytes/largerThanBurst", func(tt *testing.T) {
+		m := new(expvar.Map).Init()
+		l := testNewRateLimiter(tt, RateLimitConfig{Bytes: 1, ByteBurst: 100, Mode: RateLimitModeDrop}, m)
+		if l.Take(1000) != true {
+			tt.Errorf("larger than burst consumes whole bucket")
+		}
+		if l.Take(1) {
+			tt.Errorf("bucket must be empty")
+		}
+	})
+	t.Run("msgs/delay", func(tt *testing.T) {
+		m := new(expvar.Map).Init()
+		l := testNewRateLimiter(tt, RateLimitConfig{Msgs: 100, MsgBurst: 1}, m)
+		start := time.Now()
+		for i := 0; i < 6; i += 1 {
+			if l.Take(0) != true {
+				tt.Errorf("delay mode never drops")
+			}
+		}
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+			tt.Errorf("must be delayed 10ms per msg: %s", elapsed)
+		}
+		if v := m.Get(metricThrottledDelayed).(*expvar.Int).Value(); v != 5 {
+			tt.Errorf("delayed count expect:5 actual:%d", v)
+		}
+	})
+	t.Run("mode/unknown", func(tt *testing.T) {
+		if _, err := NewRateLimiter(RateLimitConfig{Msgs: 1, Mode: "block"}, nil); errors.Is(err, ErrUnknownRateLimitMode) != true {
+			tt.Errorf("must ErrUnknownRateLimitMode: %+v", err)
+		}
+	})
+	t.Run("multiple/drop", func(tt *testing.T) {
+		tm := new(expvar.Map).Init()
+		dm := new(expvar.Map).Init()
+		topic := testNewRateLimiter(tt, RateLimitConfig{Msgs: 1, MsgBurst: 5, Mode: RateLimitModeDrop}, tm)
+		dst := testNewRateLimiter(tt, RateLimitConfig{Msgs: 1, MsgBurst: 2, Mode: RateLimitModeDrop}, dm)
+		limiters := []*RateLimiter{topic, dst}
+		allowed := 0
+		for i := 0; i < 10; i += 1 {
+			if takeRateLimiters(limiters, 10) {
+				allowed += 1
+			}
+		}
+		if allowed != 2 {
+			tt.Errorf("smaller burst only allowed: %d", allowed)
+		}
+		// tokens of topic are returned when destination drops
+		allowed = 0
+		for i := 0; i < 10; i += 1 {
+			if topic.Take(10) {
+				allowed += 1
+			}
+		}
+		if allowed != 3 {
+			tt.Errorf("rest of topic burst: %d", allowed)
+		}
+		if v := dm.Get(metricThrottledDropped).(*expvar.Int).Value(); v != 8 {
+			tt.Errorf("dropped by destination expect:8 actual:%d", v)
+		}
+	})
+	t.Run("multiple/delay", func(tt *testing.T) {
+		topic := testNewRateLimiter(tt, RateLimitConfig{Msgs: 100, MsgBurst: 1}, new(expvar.Map).Init())
+		dst := testNewRateLimiter(tt, RateLimitConfig{Msgs: 100, MsgBurst: 1}, new(expvar.Map).Init())
+		limiters := []*RateLimiter{topic, dst}
+		start := time.Now()
+		for i := 0; i < 6; i += 1 {
+			if takeRateLimiters(limiters, 0) != true {
+				tt.Errorf("delay mode never drops")
+			}
+		}
+		// delays of limiters overlap
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond || 90*time.Millisecond < elapsed {
+			tt.Errorf("must be delayed 10ms per msg: %s", elapsed)
+		}
+	})
+}
+
+func TestTopicMetrics(t *testing.T) {
+	a := TopicMetrics("test.metrics.>")
+	b := TopicMetrics("test.metrics.>")
+	if a != b {
+		t.Errorf("same topic must be same map")
+	}
+	a.Add("counter", 1)
+	if metricsTopics.Get("test.metrics.>") == nil {
+		t.Errorf("must be published")
+	}
+}
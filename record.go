@@ -0,0 +1,287 @@
+package nrelay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// Record is a line of NDJSON that stores a relayed message with its metadata
+type Record struct {
+	Subject    string      `json:"subject"`
+	Header     nats.Header `json:"header,omitempty"`
+	Data       []byte      `json:"data"`
+	Source     string      `json:"source,omitempty"`
+	ReceivedAt time.Time   `json:"received_at"`
+	Worker     int         `json:"worker"`
+}
+
+func (r Record) Msg() *nats.Msg {
+	return &nats.Msg{
+		Subject: r.Subject,
+		Header:  r.Header,
+		Data:    r.Data,
+	}
+}
+
+// RecordEncoder writes Records of NDJSON or binary capture
+type RecordEncoder interface {
+	Write(Record) error
+}
+
+// RecordDecoder reads Records of NDJSON or binary capture, io.EOF is returned at the end of records
+type RecordDecoder interface {
+	Read() (Record, error)
+}
+
+// check interface
+var (
+	_ RecordEncoder = (*RecordWriter)(nil)
+	_ RecordEncoder = (*BinaryRecordWriter)(nil)
+	_ RecordDecoder = (*RecordReader)(nil)
+	_ RecordDecoder = (*BinaryRecordReader)(nil)
+)
+
+type RecordWriter struct {
+	mutex *sync.Mutex
+	enc   *json.Encoder
+}
+
+func (w *RecordWriter) Write(r Record) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.enc.Encode(r); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+type RecordReader struct {
+	dec *json.Decoder
+}
+
+// Read returns next Record, io.EOF is returned at the end of records
+func (r *RecordReader) Read() (Record, error) {
+	rec := Record{}
+	if err := r.dec.Decode(&rec); err != nil {
+		if err == io.EOF {
+			return Record{}, io.EOF
+		}
+		return Record{}, errors.WithStack(err)
+	}
+	return rec, nil
+}
+
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{json.NewDecoder(r)}
+}
+
+func NewRecordWriter(w io.Writer) *RecordWriter {
+	return &RecordWriter{new(sync.Mutex), json.NewEncoder(w)}
+}
+
+const (
+	// larger than max_payload of nats (max 64MB) with subject and headers
+	maxBinaryRecordSize  uint64 = 64*1024*1024 + 1024*1024
+	maxBinaryRecordField uint64 = 1024
+)
+
+var (
+	binaryRecordMagic = []byte("NRREC\x01")
+
+	ErrInvalidBinaryRecord = errors.New("invalid binary record")
+)
+
+// BinaryRecordWriter writes compact binary capture, each record is uvarint length prefixed:
+// varint received_at(unix nano), uvarint worker, source, subject, header, data
+// (strings and bytes are uvarint length prefixed, header is number of keys followed by key and values)
+type BinaryRecordWriter struct {
+	mutex *sync.Mutex
+	w     io.Writer
+	body  *bytes.Buffer
+	frame *bytes.Buffer
+	tmp   []byte
+}
+
+func (w *BinaryRecordWriter) Write(r Record) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.body.Reset()
+	w.putVarint(r.ReceivedAt.UnixNano())
+	w.putUvarint(uint64(r.Worker))
+	w.putBytes([]byte(r.Source))
+	w.putBytes([]byte(r.Subject))
+	w.putUvarint(uint64(len(r.Header)))
+	for key, values := range r.Header {
+		w.putBytes([]byte(key))
+		w.putUvarint(uint64(len(values)))
+		for _, v := range values {
+			w.putBytes([]byte(v))
+		}
+	}
+	w.putBytes(r.Data)
+
+	// a record is written at once
+	w.frame.Reset()
+	n := binary.PutUvarint(w.tmp, uint64(w.body.Len()))
+	w.frame.Write(w.tmp[:n])
+	w.frame.Write(w.body.Bytes())
+	if _, err := w.w.Write(w.frame.Bytes()); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (w *BinaryRecordWriter) putVarint(v int64) {
+	n := binary.PutVarint(w.tmp, v)
+	w.body.Write(w.tmp[:n])
+}
+
+func (w *BinaryRecordWriter) putUvarint(v uint64) {
+	n := binary.PutUvarint(w.tmp, v)
+	w.body.Write(w.tmp[:n])
+}
+
+func (w *BinaryRecordWriter) putBytes(b []byte) {
+	w.putUvarint(uint64(len(b)))
+	w.body.Write(b)
+}
+
+type BinaryRecordReader struct {
+	r       *bufio.Reader
+	buf     []byte
+	maxSize uint64
+}
+
+// Read returns next Record, io.EOF is returned at the end of records
+func (r *BinaryRecordReader) Read() (Record, error) {
+	size, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if err == io.EOF {
+			return Record{}, io.EOF
+		}
+		return Record{}, errors.WithStack(err)
+	}
+	if r.maxSize < size {
+		return Record{}, errors.Wrapf(ErrInvalidBinaryRecord, "record size too large: %d", size)
+	}
+	if cap(r.buf) < int(size) {
+		r.buf = make([]byte, size)
+	}
+	body := r.buf[:size]
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return Record{}, errors.Wrapf(ErrInvalidBinaryRecord, "truncated: %v", err)
+	}
+	return decodeBinaryRecord(body)
+}
+
+func decodeBinaryRecord(body []byte) (Record, error) {
+	d := &binaryRecordDecoder{body, nil}
+	rec := Record{}
+	rec.ReceivedAt = time.Unix(0, d.varint())
+	rec.Worker = int(d.uvarint())
+	rec.Source = string(d.bytes())
+	rec.Subject = string(d.bytes())
+	if keys := d.uvarint(); 0 < keys && d.err == nil {
+		if maxBinaryRecordField < keys {
+			return Record{}, errors.Wrapf(ErrInvalidBinaryRecord, "too many header keys: %d", keys)
+		}
+		rec.Header = make(nats.Header, keys)
+		for i := uint64(0); i < keys && d.err == nil; i += 1 {
+			key := string(d.bytes())
+			num := d.uvarint()
+			if maxBinaryRecordField < num {
+				return Record{}, errors.Wrapf(ErrInvalidBinaryRecord, "too many header values: %d", num)
+			}
+			for j := uint64(0); j < num && d.err == nil; j += 1 {
+				rec.Header[key] = append(rec.Header[key], string(d.bytes()))
+			}
+		}
+	}
+	rec.Data = append([]byte(nil), d.bytes()...)
+	if d.err != nil {
+		return Record{}, errors.WithStack(d.err)
+	}
+	return rec, nil
+}
+
+type binaryRecordDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *binaryRecordDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = ErrInvalidBinaryRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *binaryRecordDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrInvalidBinaryRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *binaryRecordDecoder) bytes() []byte {
+	size := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.b)) < size {
+		d.err = ErrInvalidBinaryRecord
+		return nil
+	}
+	b := d.b[:size]
+	d.b = d.b[size:]
+	return b
+}
+
+// NewBinaryRecordWriter writes magic of binary capture then returns writer
+func NewBinaryRecordWriter(w io.Writer) (*BinaryRecordWriter, error) {
+	if _, err := w.Write(binaryRecordMagic); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return newBinaryRecordWriter(w), nil
+}
+
+// newBinaryRecordWriter appends to capture that magic has already been written
+func newBinaryRecordWriter(w io.Writer) *BinaryRecordWriter {
+	return &BinaryRecordWriter{new(sync.Mutex), w, bytes.NewBuffer(nil), bytes.NewBuffer(nil), make([]byte, binary.MaxVarintLen64)}
+}
+
+// NewRecordDecoder detects format of capture, binary if it starts with magic otherwise NDJSON
+func NewRecordDecoder(r io.Reader) (RecordDecoder, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(binaryRecordMagic))
+	if err != nil && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+	if bytes.Equal(magic, binaryRecordMagic) {
+		br.Discard(len(binaryRecordMagic))
+		return &BinaryRecordReader{br, nil, maxBinaryRecordSize}, nil
+	}
+	return NewRecordReader(br), nil
+}
@@ -0,0 +1,155 @@
+package nrelay
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	RecordFormatNDJSON string = "ndjson"
+	RecordFormatBinary string = "binary"
+)
+
+const (
+	metricRecorded     string = "recorded"
+	metricRecordFailed string = "record_failed"
+)
+
+var (
+	ErrUnknownRecordFormat = errors.New("unknown record format")
+)
+
+// recorder captures all messages accepted by source with receive timestamp and source url,
+// capture is replayed by `nats-relay replay`
+type recorder struct {
+	topic   string
+	conf    RecordConfig
+	logger  *log.Logger
+	metrics *expvar.Map
+	file    *os.File
+	enc     RecordEncoder
+}
+
+func (r *recorder) Open() error {
+	f, err := os.OpenFile(r.conf.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	switch r.conf.Format {
+	case "", RecordFormatNDJSON:
+		r.enc = NewRecordWriter(f)
+	case RecordFormatBinary:
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return errors.WithStack(err)
+		}
+		if 0 < stat.Size() {
+			r.enc = newBinaryRecordWriter(f)
+		} else {
+			enc, err := NewBinaryRecordWriter(f)
+			if err != nil {
+				f.Close()
+				return errors.WithStack(err)
+			}
+			r.enc = enc
+		}
+	default:
+		f.Close()
+		return errors.Wrapf(ErrUnknownRecordFormat, "format:%s", r.conf.Format)
+	}
+	r.file = f
+	r.logger.Printf("info: record %s to %s", r.topic, r.conf.Path)
+	return nil
+}
+
+func (r *recorder) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	if err := r.file.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	r.file = nil
+	return nil
+}
+
+// Record writes msg received from source
+func (r *recorder) Record(source string, worker int, receivedAt time.Time, msg *nats.Msg) {
+	rec := Record{
+		Subject:    msg.Subject,
+		Header:     copyHeader(msg.Header),
+		Data:       msg.Data,
+		Source:     source,
+		ReceivedAt: receivedAt,
+		Worker:     worker,
+	}
+	if err := r.enc.Write(rec); err != nil {
+		r.metrics.Add(metricRecordFailed, 1)
+		r.logger.Printf("warn: failed to record subj:%s err:%+v", msg.Subject, err)
+		return
+	}
+	r.metrics.Add(metricRecorded, 1)
+}
+
+func newRecorder(topic string, conf RecordConfig, logger *log.Logger, metrics *expvar.Map) *recorder {
+	return &recorder{
+		topic:   topic,
+		conf:    conf,
+		logger:  logger,
+		metrics: metrics,
+	}
+}
+
+// ReplayPacer keeps intervals of recorded messages scaled by speed,
+// speed 2.0 replays twice as fast and speed <= 0 replays as fast as possible
+type ReplayPacer struct {
+	speed float64
+	first time.Time
+	start time.Time
+}
+
+// Delay returns duration to wait at now before publishing the record received at receivedAt
+func (p *ReplayPacer) Delay(receivedAt time.Time, now time.Time) time.Duration {
+	if p.speed <= 0 {
+		return 0
+	}
+	if p.first.IsZero() {
+		p.first = receivedAt
+		p.start = now
+		return 0
+	}
+	offset := time.Duration(float64(receivedAt.Sub(p.first)) / p.speed)
+	if d := p.start.Add(offset).Sub(now); 0 < d {
+		return d
+	}
+	return 0
+}
+
+// Wait sleeps Delay of receivedAt, returns ctx error if ctx is done while waiting
+func (p *ReplayPacer) Wait(ctx context.Context, receivedAt time.Time) error {
+	d := p.Delay(receivedAt, time.Now())
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case <-t.C:
+		return nil
+	}
+}
+
+func NewReplayPacer(speed float64) *ReplayPacer {
+	return &ReplayPacer{speed: speed}
+}
@@ -0,0 +1,225 @@
+package nrelay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"expvar"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+func testRecords() []Record {
+	now := time.Unix(1700000000, 123456789)
+	return []Record{
+		{
+			Subject:    "foo.bar",
+			Header:     nats.Header{"X-Key": []string{"a", "b"}, "Nrelay-Sequence": []string{"1"}},
+			Data:       []byte("hello"),
+			Source:     "nats://127.0.0.1:4222",
+			ReceivedAt: now,
+			Worker:     3,
+		},
+		{
+			Subject:    "foo.baz",
+			Data:       []byte{0x00, 0xff},
+			Source:     "nats://127.0.0.1:4223",
+			ReceivedAt: now.Add(10 * time.Millisecond),
+		},
+	}
+}
+
+func testDecodeAll(t *testing.T, r io.Reader) []Record {
+	dec, err := NewRecordDecoder(r)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	records := make([]Record, 0)
+	for {
+		rec, err := dec.Read()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("must no error: %+v", err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestRecordDecoder(t *testing.T) {
+	t.Run("binary", func(tt *testing.T) {
+		buf := bytes.NewBuffer(nil)
+		w, err := NewBinaryRecordWriter(buf)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		for _, r := range testRecords() {
+			if err := w.Write(r); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+		}
+
+		records := testDecodeAll(tt, buf)
+		expect := testRecords()
+		if len(records) != len(expect) {
+			tt.Fatalf("records: %d", len(records))
+		}
+		for i, r := range records {
+			if r.Subject != expect[i].Subject || r.Source != expect[i].Source || r.Worker != expect[i].Worker {
+				tt.Errorf("record[%d]: %+v", i, r)
+			}
+			if r.ReceivedAt.Equal(expect[i].ReceivedAt) != true {
+				tt.Errorf("received_at[%d]: %s", i, r.ReceivedAt)
+			}
+			if bytes.Equal(r.Data, expect[i].Data) != true {
+				tt.Errorf("data[%d]: %v", i, r.Data)
+			}
+			if len(expect[i].Header) != len(r.Header) || (0 < len(r.Header) && reflect.DeepEqual(r.Header, expect[i].Header) != true) {
+				tt.Errorf("header[%d]: %v", i, r.Header)
+			}
+		}
+	})
+	t.Run("ndjson", func(tt *testing.T) {
+		buf := bytes.NewBuffer(nil)
+		w := NewRecordWriter(buf)
+		for _, r := range testRecords() {
+			w.Write(r)
+		}
+		if records := testDecodeAll(tt, buf); len(records) != 2 || records[1].Subject != "foo.baz" {
+			tt.Errorf("ndjson detected: %+v", records)
+		}
+	})
+	t.Run("empty", func(tt *testing.T) {
+		if records := testDecodeAll(tt, bytes.NewReader(nil)); len(records) != 0 {
+			tt.Errorf("no records: %+v", records)
+		}
+	})
+	t.Run("corrupt/size", func(tt *testing.T) {
+		buf := bytes.NewBuffer(append([]byte(nil), binaryRecordMagic...))
+		tmp := make([]byte, binary.MaxVarintLen64)
+		buf.Write(tmp[:binary.PutUvarint(tmp, 1<<62)])
+
+		dec, err := NewRecordDecoder(buf)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if _, err := dec.Read(); errors.Is(err, ErrInvalidBinaryRecord) != true {
+			tt.Errorf("huge record must be ErrInvalidBinaryRecord: %+v", err)
+		}
+	})
+	t.Run("corrupt/header", func(tt *testing.T) {
+		body := bytes.NewBuffer(nil)
+		tmp := make([]byte, binary.MaxVarintLen64)
+		body.Write(tmp[:binary.PutVarint(tmp, 0)])      // received_at
+		body.Write(tmp[:binary.PutUvarint(tmp, 0)])     // worker
+		body.Write(tmp[:binary.PutUvarint(tmp, 0)])     // source
+		body.Write(tmp[:binary.PutUvarint(tmp, 0)])     // subject
+		body.Write(tmp[:binary.PutUvarint(tmp, 1<<40)]) // header keys
+		if _, err := decodeBinaryRecord(body.Bytes()); errors.Is(err, ErrInvalidBinaryRecord) != true {
+			tt.Errorf("too many header keys must be ErrInvalidBinaryRecord: %+v", err)
+		}
+	})
+	t.Run("truncated", func(tt *testing.T) {
+		buf := bytes.NewBuffer(nil)
+		w, _ := NewBinaryRecordWriter(buf)
+		w.Write(testRecords()[0])
+		b := buf.Bytes()
+
+		dec, err := NewRecordDecoder(bytes.NewReader(b[:len(b)-2]))
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if _, err := dec.Read(); err == nil || err == io.EOF {
+			tt.Errorf("truncated record must be error: %+v", err)
+		}
+	})
+}
+
+func TestRecorder(t *testing.T) {
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+
+	for _, format := range []string{RecordFormatNDJSON, RecordFormatBinary} {
+		t.Run(format, func(tt *testing.T) {
+			path := filepath.Join(tt.TempDir(), "capture")
+			metrics := new(expvar.Map).Init()
+
+			// appended by restart
+			for i := 0; i < 2; i += 1 {
+				r := newRecorder("foo.>", RecordConfig{Path: path, Format: format}, lg, metrics)
+				if err := r.Open(); err != nil {
+					tt.Fatalf("must no error: %+v", err)
+				}
+				msg := nats.NewMsg("foo.bar")
+				msg.Data = []byte("data")
+				r.Record("nats://primary", i, time.Now(), msg)
+				r.Close()
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			defer f.Close()
+
+			records := testDecodeAll(tt, f)
+			if len(records) != 2 {
+				tt.Fatalf("2 records: %+v", records)
+			}
+			if records[1].Worker != 1 || records[1].Source != "nats://primary" || string(records[1].Data) != "data" {
+				tt.Errorf("record: %+v", records[1])
+			}
+			if n := metrics.Get(metricRecorded).String(); n != "2" {
+				tt.Errorf("recorded: %s", n)
+			}
+		})
+	}
+	t.Run("unknown", func(tt *testing.T) {
+		r := newRecorder("foo.>", RecordConfig{Path: filepath.Join(tt.TempDir(), "capture"), Format: "xml"}, lg, new(expvar.Map).Init())
+		if err := r.Open(); err == nil {
+			tt.Errorf("unknown format")
+		}
+	})
+}
+
+func TestReplayPacer(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	now := time.Unix(1800000000, 0)
+
+	t.Run("original", func(tt *testing.T) {
+		p := NewReplayPacer(1.0)
+		if d := p.Delay(base, now); d != 0 {
+			tt.Errorf("first record immediately: %s", d)
+		}
+		if d := p.Delay(base.Add(time.Second), now); d != time.Second {
+			tt.Errorf("original interval: %s", d)
+		}
+		if d := p.Delay(base.Add(time.Second), now.Add(500*time.Millisecond)); d != 500*time.Millisecond {
+			tt.Errorf("elapsed time subtracted: %s", d)
+		}
+		if d := p.Delay(base.Add(time.Second), now.Add(2*time.Second)); d != 0 {
+			tt.Errorf("late record immediately: %s", d)
+		}
+	})
+	t.Run("scaled", func(tt *testing.T) {
+		p := NewReplayPacer(4.0)
+		p.Delay(base, now)
+		if d := p.Delay(base.Add(time.Second), now); d != 250*time.Millisecond {
+			tt.Errorf("4x speed: %s", d)
+		}
+	})
+	t.Run("fast", func(tt *testing.T) {
+		p := NewReplayPacer(0)
+		p.Delay(base, now)
+		if d := p.Delay(base.Add(time.Hour), now); d != 0 {
+			tt.Errorf("as fast as possible: %s", d)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package nrelay
 
 import (
 	"context"
+	"io"
 	"log"
 
 	"github.com/pkg/errors"
@@ -23,18 +24,22 @@ type MultipleSourceSingleDestinationRelay struct {
 	prefixSize int
 	workerNum  int
 	logger     *log.Logger
+	closers    []io.Closer
 }
 
 func (r *MultipleSourceSingleDestinationRelay) Run(ctx context.Context) error {
 	r.logger.Printf("info: relay/forward stream start:%s", r.topic)
 	if err := r.src.Open(); err != nil {
+		r.closeMiddlewares()
 		return errors.WithStack(err)
 	}
 	if err := r.dst.Open(r.workerNum); err != nil {
+		r.closeMiddlewares()
 		return errors.WithStack(err)
 	}
 
 	if err := r.src.Subscribe(r.topic, r.prefixSize, r.dst.Workers()); err != nil {
+		r.closeMiddlewares()
 		return errors.WithStack(err)
 	}
 
@@ -48,12 +53,24 @@ func (r *MultipleSourceSingleDestinationRelay) Run(ctx context.Context) error {
 	if err := r.src.Close(); err != nil {
 		return errors.WithStack(err)
 	}
+	// middlewares release held messages, destination must be still open
+	r.closeMiddlewares()
 	if err := r.dst.Close(); err != nil {
 		return errors.WithStack(err)
 	}
 	return nil
 }
 
-func NewMultipleSourceSingleDestinationRelay(topic string, src Source, dst Destination, prefix, num int, logger *log.Logger) *MultipleSourceSingleDestinationRelay {
-	return &MultipleSourceSingleDestinationRelay{topic, src, dst, prefix, num, logger}
+func (r *MultipleSourceSingleDestinationRelay) closeMiddlewares() {
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil {
+			r.logger.Printf("warn: failed to close middleware topic:%s err:%+v", r.topic, err)
+		}
+	}
+}
+
+// NewMultipleSourceSingleDestinationRelay creates relay of topic,
+// closers (e.g. middlewares holding messages) are closed after src is closed and before dst is closed
+func NewMultipleSourceSingleDestinationRelay(topic string, src Source, dst Destination, prefix, num int, logger *log.Logger, closers ...io.Closer) *MultipleSourceSingleDestinationRelay {
+	return &MultipleSourceSingleDestinationRelay{topic, src, dst, prefix, num, logger, closers}
 }
@@ -167,6 +167,63 @@ func TestMultipleRelayError(t *testing.T) {
 	})
 }
 
+type testRelayCloseOrder struct {
+	events []string
+}
+
+type testRelayCloseOrderSource struct {
+	testMultipleSourceSingleDestinationRelay_SourceWithError
+	order *testRelayCloseOrder
+}
+
+func (s *testRelayCloseOrderSource) Close() error {
+	s.order.events = append(s.order.events, "src")
+	return nil
+}
+
+type testRelayCloseOrderDestination struct {
+	testMultipleSourceSingleDestinationRelay_DestinationWithError
+	order *testRelayCloseOrder
+}
+
+func (d *testRelayCloseOrderDestination) Close() error {
+	d.order.events = append(d.order.events, "dst")
+	return nil
+}
+
+type testRelayCloseOrderCloser struct {
+	order *testRelayCloseOrder
+}
+
+func (c *testRelayCloseOrderCloser) Close() error {
+	c.order.events = append(c.order.events, "middleware")
+	return nil
+}
+
+func TestMultipleSourceSingleDestinationRelayClosers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	order := &testRelayCloseOrder{}
+	src := &testRelayCloseOrderSource{testMultipleSourceSingleDestinationRelay_SourceWithError{testSourceNoError}, order}
+	dst := &testRelayCloseOrderDestination{testMultipleSourceSingleDestinationRelay_DestinationWithError{testDestinationNoError}, order}
+	lg := log.New(&testRelayLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	r := NewMultipleSourceSingleDestinationRelay("test.topic."+t.Name(), src, dst, 0, 0, lg, &testRelayCloseOrderCloser{order})
+	if err := r.Run(ctx); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	// middlewares flush held messages into open destination
+	expect := []string{"src", "middleware", "dst"}
+	if len(order.events) != len(expect) {
+		t.Fatalf("expect:%v actual:%v", expect, order.events)
+	}
+	for i := range expect {
+		if expect[i] != order.events[i] {
+			t.Errorf("expect:%v actual:%v", expect, order.events)
+		}
+	}
+}
+
 func TestMultipleRelayRun(t *testing.T) {
 	t.Run("blocking", func(tt *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
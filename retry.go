@@ -0,0 +1,185 @@
+package nrelay
+
+import (
+	"expvar"
+	"math/rand"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRetryBackoff    time.Duration = 100 * time.Millisecond
+	defaultRetryMaxBackoff time.Duration = 5 * time.Second
+)
+
+const (
+	metricPublishRetries      string = "publish_retries"
+	metricPublishRetried      string = "publish_retried"
+	metricPublishFailed       string = "publish_failed"
+	metricPublishNotRetryable string = "publish_not_retryable"
+)
+
+// retryableErrors are transient errors, publish may succeed on the same connection later.
+// draining or closed connection never recovers and slow consumer is not an error of publish
+var retryableErrors = []error{
+	nats.ErrNoServers,
+	nats.ErrTimeout,
+	nats.ErrStaleConnection,
+	nats.ErrReconnectBufExceeded,
+}
+
+// retryableError marks transient errors of sinks
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// RetryableError marks err as transient, Sink returns it to retry the write by RetryPolicy
+func RetryableError(err error) error {
+	return &retryableError{err}
+}
+
+// IsRetryableError returns true if publish failed by err may succeed on retry,
+// errors caused by the message itself (e.g. ErrMaxPayload, ErrBadSubject) are not retryable
+func IsRetryableError(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(*retryableError); ok {
+		return true
+	}
+	for _, e := range retryableErrors {
+		if cause == e {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryPolicy is exponential backoff with jitter for failed publishes
+type RetryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	jitter      float64
+	metrics     *expvar.Map
+}
+
+// Retry returns true if publish should be retried after attempt-th failure by err
+func (p *RetryPolicy) Retry(attempt int, err error) bool {
+	if IsRetryableError(err) != true {
+		p.metrics.Add(metricPublishNotRetryable, 1)
+		return false
+	}
+	if p.maxAttempts <= attempt {
+		return false
+	}
+	p.metrics.Add(metricPublishRetries, 1)
+	return true
+}
+
+// Backoff returns wait duration after attempt-th failure,
+// backoff doubles for each attempt up to maxBackoff and is reduced randomly by jitter ratio
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.maxBackoff
+	if shift := attempt - 1; shift < 32 {
+		if b := p.backoff << uint(shift); 0 < b && b < p.maxBackoff {
+			d = b
+		}
+	}
+	if 0 < p.jitter {
+		d -= time.Duration(rand.Float64() * p.jitter * float64(d))
+	}
+	return d
+}
+
+// Wait sleeps Backoff of attempt, returns immediately if done is closed
+func (p *RetryPolicy) Wait(attempt int, done <-chan struct{}) {
+	t := time.NewTimer(p.Backoff(attempt))
+	defer t.Stop()
+
+	select {
+	case <-done:
+	case <-t.C:
+	}
+}
+
+// Done records result of publish finished in attempts
+func (p *RetryPolicy) Done(attempts int, err error) {
+	if err != nil {
+		p.metrics.Add(metricPublishFailed, 1)
+		return
+	}
+	if 1 < attempts {
+		p.metrics.Add(metricPublishRetried, 1)
+	}
+}
+
+// do calls fn until success or retry policy gives up, returns number of attempts.
+// fn is called once if p is nil, retried is called before each backoff.
+// backoff is skipped after done is closed so that remaining attempts do not stall shutdown
+func (p *RetryPolicy) do(done <-chan struct{}, fn func() error, retried func(attempt int, err error)) (int, error) {
+	attempt := 0
+	for {
+		attempt += 1
+		err := fn()
+		if err == nil {
+			if p != nil {
+				p.Done(attempt, nil)
+			}
+			return attempt, nil
+		}
+		if p == nil {
+			return attempt, errors.WithStack(err)
+		}
+		if p.Retry(attempt, err) != true {
+			p.Done(attempt, err)
+			return attempt, errors.WithStack(err)
+		}
+		retried(attempt, err)
+		p.Wait(attempt, done)
+	}
+}
+
+// NewRetryPolicy returns nil if conf has no retry
+func NewRetryPolicy(conf RetryConfig, metrics *expvar.Map) *RetryPolicy {
+	if conf.Configured() != true {
+		return nil
+	}
+	if metrics == nil {
+		metrics = new(expvar.Map).Init()
+	}
+
+	backoff := conf.Backoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	maxBackoff := conf.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	jitter := conf.Jitter
+	if jitter < 0 {
+		jitter = 0
+	}
+	if 1 < jitter {
+		jitter = 1
+	}
+	return &RetryPolicy{
+		maxAttempts: conf.MaxAttempts,
+		backoff:     backoff,
+		maxBackoff:  maxBackoff,
+		jitter:      jitter,
+		metrics:     metrics,
+	}
+}
@@ -0,0 +1,173 @@
+package nrelay
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+func TestIsRetryableError(t *testing.T) {
+	retryable := []error{
+		nats.ErrTimeout,
+		nats.ErrReconnectBufExceeded,
+		errors.WithStack(nats.ErrTimeout),
+	}
+	for _, err := range retryable {
+		if IsRetryableError(err) != true {
+			t.Errorf("%v must be retryable", err)
+		}
+	}
+	notRetryable := []error{
+		nats.ErrMaxPayload,
+		nats.ErrBadSubject,
+		nats.ErrConnectionClosed,
+		nats.ErrConnectionDraining,
+		nats.ErrConnectionReconnecting,
+		nats.ErrSlowConsumer,
+		errors.WithStack(nats.ErrMaxPayload),
+		errors.New("unknown"),
+	}
+	for _, err := range notRetryable {
+		if IsRetryableError(err) {
+			t.Errorf("%v must not be retryable", err)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	t.Run("not/configured", func(tt *testing.T) {
+		if NewRetryPolicy(RetryConfig{}, nil) != nil {
+			tt.Errorf("must be nil")
+		}
+		if NewRetryPolicy(RetryConfig{MaxAttempts: 1}, nil) != nil {
+			tt.Errorf("single attempt has no retry")
+		}
+	})
+	t.Run("backoff", func(tt *testing.T) {
+		p := NewRetryPolicy(RetryConfig{MaxAttempts: 10, Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}, nil)
+		expect := []time.Duration{
+			100 * time.Millisecond,
+			200 * time.Millisecond,
+			400 * time.Millisecond,
+			800 * time.Millisecond,
+			time.Second,
+			time.Second,
+		}
+		for i, e := range expect {
+			if d := p.Backoff(i + 1); d != e {
+				tt.Errorf("attempt %d expect:%s actual:%s", i+1, e, d)
+			}
+		}
+		if d := p.Backoff(100); d != time.Second {
+			tt.Errorf("overflow must be capped: %s", d)
+		}
+	})
+	t.Run("jitter", func(tt *testing.T) {
+		p := NewRetryPolicy(RetryConfig{MaxAttempts: 10, Backoff: 100 * time.Millisecond, Jitter: 0.5}, nil)
+		for i := 0; i < 100; i += 1 {
+			d := p.Backoff(2)
+			if d < 100*time.Millisecond || 200*time.Millisecond < d {
+				tt.Errorf("jitter out of range: %s", d)
+			}
+		}
+	})
+	t.Run("retry", func(tt *testing.T) {
+		metrics := new(expvar.Map).Init()
+		p := NewRetryPolicy(RetryConfig{MaxAttempts: 3}, metrics)
+		if p.Retry(1, nats.ErrMaxPayload) {
+			tt.Errorf("not retryable error must not be retried")
+		}
+		if p.Retry(1, nats.ErrTimeout) != true {
+			tt.Errorf("must be retried")
+		}
+		if p.Retry(2, nats.ErrTimeout) != true {
+			tt.Errorf("must be retried")
+		}
+		if p.Retry(3, nats.ErrTimeout) {
+			tt.Errorf("attempts exceeded")
+		}
+		if v := metrics.Get(metricPublishRetries).String(); v != "2" {
+			tt.Errorf("expect:2 actual:%s", v)
+		}
+		if v := metrics.Get(metricPublishNotRetryable).String(); v != "1" {
+			tt.Errorf("expect:1 actual:%s", v)
+		}
+	})
+	t.Run("wait/done", func(tt *testing.T) {
+		p := NewRetryPolicy(RetryConfig{MaxAttempts: 3, Backoff: time.Hour, MaxBackoff: time.Hour}, nil)
+		done := make(chan struct{})
+		close(done)
+
+		calls := 0
+		start := time.Now()
+		attempts, err := p.do(done, func() error {
+			calls += 1
+			return nats.ErrTimeout
+		}, func(int, error) {})
+		if errors.Is(err, nats.ErrTimeout) != true {
+			tt.Errorf("must return last error: %+v", err)
+		}
+		if attempts != 3 || calls != 3 {
+			tt.Errorf("must retry up to max attempts:%d calls:%d", attempts, calls)
+		}
+		if time.Second < time.Since(start) {
+			tt.Errorf("backoff must be interrupted: %s", time.Since(start))
+		}
+	})
+}
+
+func TestDestinationRetry(t *testing.T) {
+	ns, ok := testNatsServerStart()
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer ns.Shutdown()
+
+	e := chanque.NewExecutor(10, 10)
+	t.Cleanup(func() { e.Release() })
+
+	url := fmt.Sprintf("nats://%s", ns.Addr().String())
+	path := filepath.Join(t.TempDir(), "dlq.ndjson")
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	dl := newDeadLetter("test.>", DeadLetterConfig{File: path}, url, nil, nil, lg, new(expvar.Map).Init())
+	if err := dl.Open(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	metrics := new(expvar.Map).Init()
+	policy := NewRetryPolicy(RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond}, metrics)
+	dst := NewSingleDestination(e, url, nil, lg, DestinationOptRetryPolicy(policy), destinationOptDeadLetter(dl))
+	if err := dst.Open(1); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	// publish fails by ErrConnectionClosed, closed connection is not retried
+	dst.conns[0].Close()
+	dst.Workers()[0].Enqueue(&nats.Msg{Subject: "test.1", Data: []byte("hello")})
+	dst.Close()
+	dl.Close()
+
+	records := testReadRecords(t, path)
+	if len(records) != 1 {
+		t.Fatalf("failed msg must be dead-lettered: %d", len(records))
+	}
+	if v := records[0].Header.Get(HeaderDeadLetterAttempts); v != "1" {
+		t.Errorf("expect 1 attempt: %s", v)
+	}
+	if v := metrics.Get(metricPublishRetries); v != nil {
+		t.Errorf("must not be retried: %s", v)
+	}
+	if v := metrics.Get(metricPublishNotRetryable).String(); v != "1" {
+		t.Errorf("expect:1 actual:%s", v)
+	}
+	if v := metrics.Get(metricPublishFailed).String(); v != "1" {
+		t.Errorf("expect:1 actual:%s", v)
+	}
+}
@@ -0,0 +1,236 @@
+package nrelay
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+)
+
+type ringSlot struct {
+	seq uint64
+	msg *nats.Msg
+}
+
+// ringBuffer is bounded lock-free MPMC queue of *nats.Msg (Vyukov),
+// capacity is rounded up to power of 2
+type ringBuffer struct {
+	_     [8]uint64
+	head  uint64
+	_     [7]uint64
+	tail  uint64
+	_     [7]uint64
+	mask  uint64
+	slots []ringSlot
+}
+
+// Push returns false if buffer is full
+func (r *ringBuffer) Push(msg *nats.Msg) bool {
+	for {
+		pos := atomic.LoadUint64(&r.head)
+		slot := &r.slots[pos&r.mask]
+		seq := atomic.LoadUint64(&slot.seq)
+		diff := int64(seq) - int64(pos)
+		if diff == 0 {
+			if atomic.CompareAndSwapUint64(&r.head, pos, pos+1) {
+				slot.msg = msg
+				atomic.StoreUint64(&slot.seq, pos+1)
+				return true
+			}
+			continue
+		}
+		if diff < 0 {
+			return false // full
+		}
+		// other producer took pos, retry
+	}
+}
+
+// Pop returns false if buffer is empty
+func (r *ringBuffer) Pop() (*nats.Msg, bool) {
+	for {
+		pos := atomic.LoadUint64(&r.tail)
+		slot := &r.slots[pos&r.mask]
+		seq := atomic.LoadUint64(&slot.seq)
+		diff := int64(seq) - int64(pos+1)
+		if diff == 0 {
+			if atomic.CompareAndSwapUint64(&r.tail, pos, pos+1) {
+				msg := slot.msg
+				slot.msg = nil
+				atomic.StoreUint64(&slot.seq, pos+r.mask+1)
+				return msg, true
+			}
+			continue
+		}
+		if diff < 0 {
+			return nil, false // empty
+		}
+		// other consumer took pos, retry
+	}
+}
+
+// Empty returns true if no slot is reserved, reserved slot may not be written yet
+func (r *ringBuffer) Empty() bool {
+	return atomic.LoadUint64(&r.head) == atomic.LoadUint64(&r.tail)
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	size := 1
+	for size < capacity {
+		size <<= 1
+	}
+	slots := make([]ringSlot, size)
+	for i := range slots {
+		slots[i].seq = uint64(i)
+	}
+	return &ringBuffer{mask: uint64(size - 1), slots: slots}
+}
+
+// check interface
+var (
+	_ chanque.Worker = (*ringWorker)(nil)
+)
+
+// ringWorker is chanque.Worker backed by ringBuffer,
+// Enqueue never blocks and returns false if buffer is full.
+// The consumer parks on notify only when buffer is empty
+type ringWorker struct {
+	ring      *ringBuffer
+	handler   chanque.WorkerHandler
+	postHook  chanque.WorkerHook
+	batchSize int
+	notify    chan struct{}
+	done      chan struct{}
+	waiting   int32
+	inflight  int32
+	closed    int32
+	stopped   int32
+}
+
+func (w *ringWorker) wakeup() {
+	if atomic.CompareAndSwapInt32(&w.waiting, 1, 0) {
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *ringWorker) Enqueue(param interface{}) bool {
+	msg, ok := param.(*nats.Msg)
+	if ok != true {
+		return false
+	}
+
+	atomic.AddInt32(&w.inflight, 1)
+	if atomic.LoadInt32(&w.closed) == 1 {
+		atomic.AddInt32(&w.inflight, -1)
+		w.wakeup()
+		return false
+	}
+	ok = w.ring.Push(msg)
+	atomic.AddInt32(&w.inflight, -1)
+	w.wakeup()
+	return ok
+}
+
+func (w *ringWorker) CloseEnqueue() bool {
+	if atomic.CompareAndSwapInt32(&w.closed, 0, 1) {
+		w.wakeup()
+		return true
+	}
+	return false
+}
+
+// Shutdown stops worker after remaining messages are handled
+func (w *ringWorker) Shutdown() {
+	w.CloseEnqueue()
+}
+
+func (w *ringWorker) ShutdownAndWait() {
+	w.Shutdown()
+	<-w.done
+}
+
+// ForceStop stops worker, remaining messages are discarded
+func (w *ringWorker) ForceStop() {
+	atomic.StoreInt32(&w.stopped, 1)
+	w.CloseEnqueue()
+}
+
+// finished returns true if enqueue is closed and all messages are handled
+func (w *ringWorker) finished() bool {
+	if atomic.LoadInt32(&w.closed) != 1 {
+		return false
+	}
+	if atomic.LoadInt32(&w.inflight) != 0 {
+		return false
+	}
+	return w.ring.Empty()
+}
+
+func (w *ringWorker) runloop() {
+	defer close(w.done)
+
+	for {
+		n := 0
+		for n < w.batchSize {
+			if atomic.LoadInt32(&w.stopped) == 1 {
+				return
+			}
+			msg, ok := w.ring.Pop()
+			if ok != true {
+				break
+			}
+			w.handler(msg)
+			n += 1
+		}
+		if 0 < n {
+			if w.postHook != nil {
+				w.postHook()
+			}
+			continue
+		}
+
+		if w.finished() {
+			return
+		}
+		if w.ring.Empty() != true {
+			// slot reserved by producer is being written
+			runtime.Gosched()
+			continue
+		}
+
+		atomic.StoreInt32(&w.waiting, 1)
+		if w.ring.Empty() != true || atomic.LoadInt32(&w.closed) == 1 {
+			atomic.StoreInt32(&w.waiting, 0)
+			if w.finished() {
+				return
+			}
+			runtime.Gosched()
+			continue
+		}
+		<-w.notify
+	}
+}
+
+func newRingWorker(executor *chanque.Executor, handler chanque.WorkerHandler, postHook chanque.WorkerHook, capacity, batchSize int) *ringWorker {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	w := &ringWorker{
+		ring:      newRingBuffer(capacity),
+		handler:   handler,
+		postHook:  postHook,
+		batchSize: batchSize,
+		notify:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if executor != nil {
+		executor.Submit(w.runloop)
+	} else {
+		go w.runloop()
+	}
+	return w
+}
@@ -0,0 +1,266 @@
+package nrelay
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lafikl/consistent"
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+)
+
+func TestRingBuffer(t *testing.T) {
+	t.Run("capacity", func(tt *testing.T) {
+		r := newRingBuffer(5)
+		if len(r.slots) != 8 {
+			tt.Errorf("capacity must be power of 2: %d", len(r.slots))
+		}
+	})
+	t.Run("fifo/full", func(tt *testing.T) {
+		r := newRingBuffer(4)
+		for i := 0; i < 4; i += 1 {
+			if r.Push(&nats.Msg{Subject: strconv.Itoa(i)}) != true {
+				tt.Errorf("must push: %d", i)
+			}
+		}
+		if r.Push(&nats.Msg{Subject: "full"}) {
+			tt.Errorf("must be full")
+		}
+		for i := 0; i < 4; i += 1 {
+			msg, ok := r.Pop()
+			if ok != true {
+				tt.Fatalf("must pop: %d", i)
+			}
+			if msg.Subject != strconv.Itoa(i) {
+				tt.Errorf("expect:%d actual:%s", i, msg.Subject)
+			}
+		}
+		if _, ok := r.Pop(); ok {
+			tt.Errorf("must be empty")
+		}
+		if r.Empty() != true {
+			tt.Errorf("must be empty")
+		}
+	})
+	t.Run("concurrent", func(tt *testing.T) {
+		r := newRingBuffer(1024)
+		producers, perProducer := 8, 10000
+
+		wg := new(sync.WaitGroup)
+		for p := 0; p < producers; p += 1 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < perProducer; i += 1 {
+					for r.Push(&nats.Msg{}) != true {
+						time.Sleep(time.Microsecond)
+					}
+				}
+			}()
+		}
+
+		count := 0
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for {
+			if _, ok := r.Pop(); ok {
+				count += 1
+				continue
+			}
+			select {
+			case <-done:
+				for {
+					if _, ok := r.Pop(); ok != true {
+						break
+					}
+					count += 1
+				}
+				if count != producers*perProducer {
+					tt.Errorf("expect:%d actual:%d", producers*perProducer, count)
+				}
+				return
+			default:
+			}
+		}
+	})
+}
+
+func TestRingWorker(t *testing.T) {
+	t.Run("drain/on/shutdown", func(tt *testing.T) {
+		handled := int32(0)
+		hooks := int32(0)
+		w := newRingWorker(nil, func(param interface{}) {
+			atomic.AddInt32(&handled, 1)
+		}, func() {
+			atomic.AddInt32(&hooks, 1)
+		}, 16384, 32)
+
+		for i := 0; i < 10000; i += 1 {
+			if w.Enqueue(&nats.Msg{}) != true {
+				tt.Fatalf("must enqueue: %d", i)
+			}
+		}
+		w.ShutdownAndWait()
+
+		if v := atomic.LoadInt32(&handled); v != 10000 {
+			tt.Errorf("all msg must be handled: %d", v)
+		}
+		if atomic.LoadInt32(&hooks) < 10000/32 {
+			tt.Errorf("post hook must be called for each batch: %d", hooks)
+		}
+		if w.Enqueue(&nats.Msg{}) {
+			tt.Errorf("closed worker must reject")
+		}
+	})
+	t.Run("full", func(tt *testing.T) {
+		block := make(chan struct{})
+		w := newRingWorker(nil, func(param interface{}) {
+			<-block
+		}, nil, 2, 1)
+
+		enqueued := 0
+		for i := 0; i < 10; i += 1 {
+			if w.Enqueue(&nats.Msg{}) {
+				enqueued += 1
+			}
+		}
+		close(block)
+		w.ShutdownAndWait()
+		// capacity + 1 being handled at most
+		if 3 < enqueued {
+			tt.Errorf("must not enqueue more than capacity: %d", enqueued)
+		}
+	})
+	t.Run("wrong/type", func(tt *testing.T) {
+		w := newRingWorker(nil, func(interface{}) {}, nil, 2, 1)
+		defer w.ShutdownAndWait()
+		if w.Enqueue("not msg") {
+			tt.Errorf("must reject non *nats.Msg")
+		}
+	})
+}
+
+func TestSingleDestinationRing(t *testing.T) {
+	ns, ok := testNatsServerStart()
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer ns.Shutdown()
+
+	e := chanque.NewExecutor(10, 10)
+	t.Cleanup(func() { e.Release() })
+
+	url := fmt.Sprintf("nats://%s", ns.Addr().String())
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer nc.Close()
+
+	received := int32(0)
+	sub, err := nc.Subscribe("test.ring.>", func(msg *nats.Msg) {
+		atomic.AddInt32(&received, 1)
+	})
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	dst := NewSingleDestination(e, url, nil, lg, DestinationOptBuffer(BufferConfig{Type: BufferTypeRing, Capacity: 4096}))
+	if err := dst.Open(4); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	dist := newDistribute(dst.Workers())
+	for i := 0; i < 1000; i += 1 {
+		if dist.Publish(strconv.Itoa(i), &nats.Msg{Subject: fmt.Sprintf("test.ring.%d", i)}) != true {
+			t.Errorf("must enqueue: %d", i)
+		}
+	}
+	dst.Close()
+	nc.Flush()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&received) < 1000 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := atomic.LoadInt32(&received); v != 1000 {
+		t.Errorf("all msg must be published: %d", v)
+	}
+}
+
+func BenchmarkDistributeIndex(b *testing.B) {
+	workers := make([]chanque.Worker, 8)
+	for i := range workers {
+		workers[i] = new(testDistributeWorker)
+	}
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("foo.bar.%d", i)
+	}
+
+	b.Run("consistent", func(tb *testing.B) {
+		c := consistent.New()
+		m := make(map[string]int, len(workers))
+		for i := range workers {
+			id := strconv.Itoa(i)
+			m[id] = i
+			c.Add(id)
+		}
+		tb.ReportAllocs()
+		tb.ResetTimer()
+		for i := 0; i < tb.N; i += 1 {
+			id, _ := c.Get(keys[i&1023])
+			_ = m[id]
+		}
+	})
+	b.Run("slots", func(tb *testing.B) {
+		dist := newDistribute(workers)
+		msg := &nats.Msg{}
+		tb.ReportAllocs()
+		tb.ResetTimer()
+		for i := 0; i < tb.N; i += 1 {
+			_ = dist.Index(keys[i&1023], msg)
+		}
+	})
+}
+
+func BenchmarkWorker(b *testing.B) {
+	e := chanque.NewExecutor(10, 10)
+	defer e.Release()
+
+	msg := &nats.Msg{Subject: "bench"}
+	noop := func(interface{}) {}
+	run := func(tb *testing.B, w chanque.Worker) {
+		tb.ReportAllocs()
+		tb.ResetTimer()
+		tb.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				for w.Enqueue(msg) != true {
+					// ring is full, retry
+				}
+			}
+		})
+		w.ShutdownAndWait()
+	}
+
+	b.Run("chanque", func(tb *testing.B) {
+		run(tb, chanque.NewDefaultWorker(noop,
+			chanque.WorkerExecutor(e),
+			chanque.WorkerCapacity(defaultWorkerCapacity),
+			chanque.WorkerMaxDequeueSize(defaultWorkerMaxMsgSize),
+		))
+	})
+	b.Run("ring", func(tb *testing.B) {
+		run(tb, newRingWorker(e, noop, nil, defaultWorkerCapacity, defaultWorkerMaxMsgSize))
+	})
+}
@@ -0,0 +1,59 @@
+package nrelay
+
+import (
+	"encoding/json"
+	"expvar"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+const (
+	metricSchemaValid   string = "schema_valid"
+	metricSchemaInvalid string = "schema_invalid"
+)
+
+// schemaValidation validates payload by JSON Schema,
+// invalid messages are dead-lettered (not relayed) or dropped if dead-letter is not configured
+type schemaValidation struct {
+	topic      string
+	schema     *jsonschema.Schema
+	deadLetter *deadLetter
+	metrics    *expvar.Map
+}
+
+func (s *schemaValidation) validate(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return errors.Wrap(err, "invalid json")
+	}
+	if err := s.schema.Validate(v); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (s *schemaValidation) Middleware(topic string, next RelayHandler) RelayHandler {
+	return func(msg *nats.Msg) error {
+		err := s.validate(msg.Data)
+		if err == nil {
+			s.metrics.Add(metricSchemaValid, 1)
+			return next(msg)
+		}
+
+		s.metrics.Add(metricSchemaInvalid, 1)
+		if s.deadLetter != nil {
+			s.deadLetter.Send(DeadLetterReasonValidation, 0, msg, err)
+		}
+		return nil
+	}
+}
+
+func newSchemaValidation(topic string, conf SchemaConfig, dl *deadLetter, metrics *expvar.Map) (*schemaValidation, error) {
+	schema, err := jsonschema.Compile(conf.Path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &schemaValidation{topic, schema, dl, metrics}, nil
+}
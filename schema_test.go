@@ -0,0 +1,115 @@
+package nrelay
+
+import (
+	"expvar"
+	"log"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+const testSchemaOrder string = `{
+  "type": "object",
+  "required": ["id", "amount"],
+  "properties": {
+    "id":     {"type": "string"},
+    "amount": {"type": "number", "minimum": 0}
+  }
+}`
+
+func TestSchemaValidation(t *testing.T) {
+	path := testWriteScript(t, t.TempDir(), "order.schema.json", testSchemaOrder)
+
+	t.Run("compile/error", func(tt *testing.T) {
+		broken := testWriteScript(tt, tt.TempDir(), "broken.json", `{"type": `)
+		if _, err := newSchemaValidation("orders.>", SchemaConfig{Path: broken}, nil, new(expvar.Map).Init()); err == nil {
+			tt.Errorf("broken schema must error")
+		}
+	})
+	t.Run("dead-letter", func(tt *testing.T) {
+		dlqPath := filepath.Join(tt.TempDir(), "dlq.ndjson")
+		lg := log.New(&testDestinationLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+		dl := newDeadLetter("orders.>", DeadLetterConfig{File: dlqPath}, "", nil, nil, lg, new(expvar.Map).Init())
+		if err := dl.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		metrics := new(expvar.Map).Init()
+		sv, err := newSchemaValidation("orders.>", SchemaConfig{Path: path}, dl, metrics)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		relayed := make([]*nats.Msg, 0)
+		h := sv.Middleware("orders.>", func(msg *nats.Msg) error {
+			relayed = append(relayed, msg)
+			return nil
+		})
+
+		inputs := [][]byte{
+			[]byte(`{"id":"a","amount":10}`),
+			[]byte(`{"id":"b","amount":-1}`),
+			[]byte(`{"id":"c"}`),
+			[]byte(`not json`),
+		}
+		for _, data := range inputs {
+			if err := h(&nats.Msg{Subject: "orders.new", Data: data}); err != nil {
+				tt.Errorf("must no error: %+v", err)
+			}
+		}
+		if err := dl.Close(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		if len(relayed) != 1 {
+			tt.Fatalf("only valid message must be relayed: %d", len(relayed))
+		}
+		if relayed[0].Subject != "orders.new" {
+			tt.Errorf("valid message must keep subject: %s", relayed[0].Subject)
+		}
+
+		records := testReadRecords(tt, dlqPath)
+		if len(records) != 3 {
+			tt.Fatalf("invalid messages must be dead-lettered: %d", len(records))
+		}
+		for _, r := range records {
+			if r.Header.Get(HeaderDeadLetterReason) != DeadLetterReasonValidation {
+				tt.Errorf("reason must be validation: %v", r.Header)
+			}
+			if r.Header.Get(HeaderDeadLetterSubject) != "orders.new" {
+				tt.Errorf("original subject must be kept: %v", r.Header)
+			}
+			if r.Header.Get(HeaderDeadLetterError) == "" {
+				tt.Errorf("validation error must be set: %s", r.Data)
+			}
+		}
+		if v := metrics.Get(metricSchemaValid).String(); v != "1" {
+			tt.Errorf("valid expect:1 actual:%s", v)
+		}
+		if v := metrics.Get(metricSchemaInvalid).String(); v != "3" {
+			tt.Errorf("invalid expect:3 actual:%s", v)
+		}
+	})
+	t.Run("drop", func(tt *testing.T) {
+		metrics := new(expvar.Map).Init()
+		sv, err := newSchemaValidation("orders.>", SchemaConfig{Path: path}, nil, metrics)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		count := 0
+		h := sv.Middleware("orders.>", func(msg *nats.Msg) error {
+			count += 1
+			return nil
+		})
+		h(&nats.Msg{Subject: "orders.new", Data: []byte(`{"id":"a","amount":10}`)})
+		h(&nats.Msg{Subject: "orders.new", Data: []byte(`{"id":1}`)})
+		if count != 1 {
+			tt.Errorf("invalid message must be dropped without dead-letter: %d", count)
+		}
+		if v := metrics.Get(metricSchemaInvalid).String(); v != "1" {
+			tt.Errorf("invalid expect:1 actual:%s", v)
+		}
+	})
+}
@@ -0,0 +1,383 @@
+package nrelay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+//
+// script.lua
+// ----------
+// function route(msg)
+//   -- msg.subject: string
+//   -- msg.headers: table of header name -> value, table of values if the header has multiple values
+//   -- msg.payload: decoded JSON payload, nil if not JSON
+//   -- msg.data:    raw payload string
+//   if msg.payload ~= nil and msg.payload.amount ~= nil and msg.payload.amount > 1000 then
+//     msg.subject = "orders.priority"
+//   end
+//   msg.headers["X-Routed-By"] = "nrelay"
+//   return true -- return false to drop
+// end
+//
+
+const (
+	scriptEntrypoint string = "route"
+)
+
+const (
+	defaultScriptTimeout time.Duration = 50 * time.Millisecond
+)
+
+const (
+	metricScriptCalls    string = "script_calls"
+	metricScriptDropped  string = "script_dropped"
+	metricScriptRouted   string = "script_routed"
+	metricScriptErrors   string = "script_errors"
+	metricScriptTimeouts string = "script_timeouts"
+)
+
+// scripts can not touch os/io, only pure libraries are opened
+var scriptLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+var (
+	ErrScriptEntrypoint = errors.New("script must define function route(msg)")
+	ErrScriptTimeout    = errors.New("script execution timeout")
+)
+
+type scriptProgram struct {
+	path    string
+	proto   *lua.FunctionProto
+	timeout time.Duration
+	version uint64
+}
+
+type scriptState struct {
+	L       *lua.LState
+	version uint64
+}
+
+// scriptTransform evaluates Lua script per message, LState are pooled
+// since an LState is not safe for concurrent use.
+// Reload swaps compiled script, pooled LState are recreated lazily on next use
+type scriptTransform struct {
+	topic   string
+	mutex   *sync.RWMutex
+	program *scriptProgram
+	closed  bool
+	states  chan *scriptState
+	metrics *expvar.Map
+}
+
+func compileScript(path string) (*lua.FunctionProto, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	chunk, err := parse.Parse(bytes.NewReader(data), path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return proto, nil
+}
+
+func newScriptState(program *scriptProgram) (*scriptState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range scriptLibs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// base library loads files
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+
+	L.Push(L.NewFunctionFromProto(program.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, errors.WithStack(err)
+	}
+	if L.GetGlobal(scriptEntrypoint).Type() != lua.LTFunction {
+		L.Close()
+		return nil, errors.Wrapf(ErrScriptEntrypoint, "path: %s", program.path)
+	}
+	return &scriptState{L, program.version}, nil
+}
+
+func (s *scriptTransform) current() *scriptProgram {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.program
+}
+
+// acquire returns pooled state of program
+func (s *scriptTransform) acquire(ctx context.Context, program *scriptProgram) (*scriptState, error) {
+	var st *scriptState
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ErrScriptTimeout, "no state available: %s", program.timeout)
+	case st = <-s.states:
+	}
+	if st != nil && st.version == program.version {
+		return st, nil
+	}
+
+	if st != nil {
+		st.L.Close()
+	}
+	st, err := newScriptState(program)
+	if err != nil {
+		s.release(nil)
+		return nil, errors.WithStack(err)
+	}
+	return st, nil
+}
+
+// release returns st to the pool, st is closed if transform was closed while st was in use
+func (s *scriptTransform) release(st *scriptState) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.closed {
+		if st != nil {
+			st.L.Close()
+		}
+		return
+	}
+	s.states <- st
+}
+
+// discard closes broken state (e.g. cancelled by timeout), the slot is recreated on next acquire
+func (s *scriptTransform) discard(st *scriptState) {
+	st.L.Close()
+	s.release(nil)
+}
+
+// Reload compiles script of conf, running messages are finished with previous script
+func (s *scriptTransform) Reload(conf ScriptConfig) error {
+	proto, err := compileScript(conf.Path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	program := &scriptProgram{conf.Path, proto, scriptTimeout(conf), s.program.version + 1}
+	// validate entrypoint before swap
+	st, err := newScriptState(program)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	st.L.Close()
+
+	s.program = program
+	return nil
+}
+
+func (s *scriptTransform) call(msg *nats.Msg) (bool, error) {
+	program := s.current()
+	ctx, cancel := context.WithTimeout(context.Background(), program.timeout)
+	defer cancel()
+
+	st, err := s.acquire(ctx, program)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	L := st.L
+	L.SetContext(ctx)
+	tbl := newScriptMsgTable(L, msg)
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal(scriptEntrypoint), NRet: 1, Protect: true}, tbl); err != nil {
+		if ctx.Err() != nil {
+			s.metrics.Add(metricScriptTimeouts, 1)
+			s.discard(st)
+			return false, errors.Wrapf(ErrScriptTimeout, "timeout: %s", program.timeout)
+		}
+		s.discard(st)
+		return false, errors.WithStack(err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	L.RemoveContext()
+	// tbl is read before release, script may keep a reference of it
+	defer s.release(st)
+
+	if ret.Type() == lua.LTBool && lua.LVAsBool(ret) != true {
+		return false, nil
+	}
+
+	if subject, ok := tbl.RawGetString("subject").(lua.LString); ok && 0 < len(subject) {
+		if string(subject) != msg.Subject {
+			s.metrics.Add(metricScriptRouted, 1)
+		}
+		msg.Subject = string(subject)
+	}
+	if headers, ok := tbl.RawGetString("headers").(*lua.LTable); ok {
+		msg.Header = fromScriptHeaders(headers)
+	}
+	return true, nil
+}
+
+func (s *scriptTransform) Middleware(topic string, next RelayHandler) RelayHandler {
+	return func(msg *nats.Msg) error {
+		s.metrics.Add(metricScriptCalls, 1)
+		ok, err := s.call(msg)
+		if err != nil {
+			s.metrics.Add(metricScriptErrors, 1)
+			return errors.WithStack(err)
+		}
+		if ok != true {
+			s.metrics.Add(metricScriptDropped, 1)
+			return nil
+		}
+		return next(msg)
+	}
+}
+
+// Close closes pooled states, states in use are closed on release
+func (s *scriptTransform) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for {
+		select {
+		case st := <-s.states:
+			if st != nil {
+				st.L.Close()
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// newScriptHeaders converts header to table, a header of multiple values is table of values
+func newScriptHeaders(L *lua.LState, header nats.Header) *lua.LTable {
+	headers := L.NewTable()
+	for k, values := range header {
+		if len(values) == 1 {
+			headers.RawSetString(k, lua.LString(values[0]))
+			continue
+		}
+		tbl := L.NewTable()
+		for _, v := range values {
+			tbl.Append(lua.LString(v))
+		}
+		headers.RawSetString(k, tbl)
+	}
+	return headers
+}
+
+func fromScriptHeaders(headers *lua.LTable) nats.Header {
+	h := nats.Header{}
+	headers.ForEach(func(k, v lua.LValue) {
+		if values, ok := v.(*lua.LTable); ok {
+			values.ForEach(func(_, e lua.LValue) {
+				h.Add(k.String(), e.String())
+			})
+			return
+		}
+		h.Add(k.String(), v.String())
+	})
+	return h
+}
+
+func newScriptMsgTable(L *lua.LState, msg *nats.Msg) *lua.LTable {
+	headers := newScriptHeaders(L, msg.Header)
+
+	tbl := L.NewTable()
+	tbl.RawSetString("subject", lua.LString(msg.Subject))
+	tbl.RawSetString("headers", headers)
+	tbl.RawSetString("data", lua.LString(msg.Data))
+
+	var payload interface{}
+	if err := json.Unmarshal(msg.Data, &payload); err == nil {
+		tbl.RawSetString("payload", toLuaValue(L, payload))
+	}
+	return tbl
+}
+
+func toLuaValue(L *lua.LState, v interface{}) lua.LValue {
+	switch vv := v.(type) {
+	case bool:
+		return lua.LBool(vv)
+	case float64:
+		return lua.LNumber(vv)
+	case string:
+		return lua.LString(vv)
+	case []interface{}:
+		tbl := L.NewTable()
+		for _, e := range vv {
+			tbl.Append(toLuaValue(L, e))
+		}
+		return tbl
+	case map[string]interface{}:
+		tbl := L.NewTable()
+		for k, e := range vv {
+			tbl.RawSetString(k, toLuaValue(L, e))
+		}
+		return tbl
+	}
+	return lua.LNil
+}
+
+func scriptTimeout(conf ScriptConfig) time.Duration {
+	if conf.Timeout <= 0 {
+		return defaultScriptTimeout
+	}
+	return conf.Timeout
+}
+
+func newScriptTransform(topic string, conf ScriptConfig, metrics *expvar.Map) (*scriptTransform, error) {
+	proto, err := compileScript(conf.Path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	program := &scriptProgram{conf.Path, proto, scriptTimeout(conf), 1}
+
+	// validate entrypoint at startup
+	st, err := newScriptState(program)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	size := runtime.NumCPU()
+	states := make(chan *scriptState, size)
+	states <- st
+	for i := 1; i < size; i += 1 {
+		states <- nil
+	}
+	return &scriptTransform{
+		topic:   topic,
+		mutex:   new(sync.RWMutex),
+		program: program,
+		states:  states,
+		metrics: metrics,
+	}, nil
+}
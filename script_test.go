@@ -0,0 +1,278 @@
+package nrelay
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const testScriptRoute string = `
+function route(msg)
+  if msg.payload ~= nil and msg.payload.amount ~= nil and msg.payload.amount > 1000 then
+    msg.subject = "orders.priority"
+  end
+  if msg.headers["X-Drop"] == "1" then
+    return false
+  end
+  msg.headers["X-Routed-By"] = "nrelay"
+  return true
+end
+`
+
+const testScriptRouteV2 string = `
+function route(msg)
+  msg.subject = "orders.v2"
+  return true
+end
+`
+
+func testWriteScript(t *testing.T, dir, name, src string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	return path
+}
+
+func TestScriptTransform(t *testing.T) {
+	dir := t.TempDir()
+	path := testWriteScript(t, dir, "route.lua", testScriptRoute)
+
+	m := new(expvar.Map).Init()
+	st, err := newScriptTransform("orders.>", ScriptConfig{Path: path}, m)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer st.Close()
+
+	relayed := make([]*nats.Msg, 0)
+	h := st.Middleware("orders.>", func(msg *nats.Msg) error {
+		relayed = append(relayed, msg)
+		return nil
+	})
+
+	t.Run("route/payload", func(tt *testing.T) {
+		relayed = relayed[:0]
+		h(&nats.Msg{Subject: "orders.new", Data: []byte(`{"amount":2000}`)})
+		h(&nats.Msg{Subject: "orders.new", Data: []byte(`{"amount":10}`)})
+		h(&nats.Msg{Subject: "orders.new", Data: []byte(`not json`)})
+		if len(relayed) != 3 {
+			tt.Fatalf("all msg must be relayed: %d", len(relayed))
+		}
+		if relayed[0].Subject != "orders.priority" {
+			tt.Errorf("amount over 1000 must be routed: %s", relayed[0].Subject)
+		}
+		if relayed[1].Subject != "orders.new" {
+			tt.Errorf("subject must be kept: %s", relayed[1].Subject)
+		}
+		if relayed[2].Subject != "orders.new" {
+			tt.Errorf("subject must be kept: %s", relayed[2].Subject)
+		}
+		for _, msg := range relayed {
+			if msg.Header.Get("X-Routed-By") != "nrelay" {
+				tt.Errorf("header must be added: %v", msg.Header)
+			}
+		}
+	})
+	t.Run("drop", func(tt *testing.T) {
+		relayed = relayed[:0]
+		msg := &nats.Msg{Subject: "orders.new", Header: nats.Header{}, Data: []byte(`{}`)}
+		msg.Header.Set("X-Drop", "1")
+		if err := h(msg); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if len(relayed) != 0 {
+			tt.Errorf("must be dropped")
+		}
+	})
+	t.Run("reload", func(tt *testing.T) {
+		relayed = relayed[:0]
+		v2 := testWriteScript(tt, dir, "route_v2.lua", testScriptRouteV2)
+		if err := st.Reload(ScriptConfig{Path: v2}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		h(&nats.Msg{Subject: "orders.new", Data: []byte(`{}`)})
+		if len(relayed) != 1 || relayed[0].Subject != "orders.v2" {
+			tt.Errorf("reloaded script must be used: %v", relayed)
+		}
+	})
+	t.Run("reload/error", func(tt *testing.T) {
+		broken := testWriteScript(tt, dir, "broken.lua", "function route(msg")
+		if err := st.Reload(ScriptConfig{Path: broken}); err == nil {
+			tt.Errorf("must error")
+		}
+		noEntry := testWriteScript(tt, dir, "noentry.lua", "function other(msg) end")
+		if err := st.Reload(ScriptConfig{Path: noEntry}); errors.Is(err, ErrScriptEntrypoint) != true {
+			tt.Errorf("must ErrScriptEntrypoint: %+v", err)
+		}
+
+		relayed = relayed[:0]
+		h(&nats.Msg{Subject: "orders.new", Data: []byte(`{}`)})
+		if len(relayed) != 1 || relayed[0].Subject != "orders.v2" {
+			tt.Errorf("previous script must be kept: %v", relayed)
+		}
+	})
+	t.Run("runtime/error", func(tt *testing.T) {
+		rt := testWriteScript(tt, dir, "runtime.lua", "function route(msg) error('boom') end")
+		if err := st.Reload(ScriptConfig{Path: rt}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if err := h(&nats.Msg{Subject: "orders.new"}); err == nil {
+			tt.Errorf("must error")
+		}
+		if v := m.Get(metricScriptErrors).(*expvar.Int).Value(); v != 1 {
+			tt.Errorf("error count expect:1 actual:%d", v)
+		}
+	})
+	t.Run("sandbox", func(tt *testing.T) {
+		src := `
+function route(msg)
+  msg.subject = tostring(os == nil and io == nil and dofile == nil and string.upper ~= nil and math.max ~= nil)
+  return true
+end
+`
+		if err := st.Reload(ScriptConfig{Path: testWriteScript(tt, dir, "sandbox.lua", src)}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		relayed = relayed[:0]
+		if err := h(&nats.Msg{Subject: "orders.new"}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if len(relayed) != 1 || relayed[0].Subject != "true" {
+			tt.Errorf("os/io must not be opened: %v", relayed)
+		}
+	})
+	t.Run("headers/multi", func(tt *testing.T) {
+		src := `
+function route(msg)
+  msg.headers["X-Count"] = tostring(#msg.headers["X-Multi"])
+  table.insert(msg.headers["X-Multi"], "c")
+  msg.headers["X-Added"] = {"d", "e"}
+  return true
+end
+`
+		if err := st.Reload(ScriptConfig{Path: testWriteScript(tt, dir, "multi.lua", src)}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		relayed = relayed[:0]
+		msg := &nats.Msg{Subject: "orders.new", Header: nats.Header{}}
+		msg.Header.Add("X-Multi", "a")
+		msg.Header.Add("X-Multi", "b")
+		if err := h(msg); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if len(relayed) != 1 {
+			tt.Fatalf("must be relayed")
+		}
+		out := relayed[0].Header
+		if out.Get("X-Count") != "2" {
+			tt.Errorf("multiple values must be table: %v", out)
+		}
+		if v := out["X-Multi"]; len(v) != 3 || v[0] != "a" || v[1] != "b" || v[2] != "c" {
+			tt.Errorf("multiple values must be kept: %v", v)
+		}
+		if v := out["X-Added"]; len(v) != 2 || v[0] != "d" || v[1] != "e" {
+			tt.Errorf("table must be multiple values: %v", v)
+		}
+	})
+	t.Run("timeout", func(tt *testing.T) {
+		loop := testWriteScript(tt, dir, "loop.lua", "function route(msg) while true do end end")
+		if err := st.Reload(ScriptConfig{Path: loop, Timeout: 10 * time.Millisecond}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if err := h(&nats.Msg{Subject: "orders.new"}); errors.Is(err, ErrScriptTimeout) != true {
+			tt.Errorf("must ErrScriptTimeout: %+v", err)
+		}
+		if v := m.Get(metricScriptTimeouts).(*expvar.Int).Value(); v != 1 {
+			tt.Errorf("timeout count expect:1 actual:%d", v)
+		}
+
+		if err := st.Reload(ScriptConfig{Path: testWriteScript(tt, dir, "route_v2.lua", testScriptRouteV2)}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		relayed = relayed[:0]
+		if err := h(&nats.Msg{Subject: "orders.new"}); err != nil {
+			tt.Errorf("timed out state must be recreated: %+v", err)
+		}
+		if len(relayed) != 1 {
+			tt.Errorf("must be relayed after timeout")
+		}
+	})
+}
+
+func TestScriptTransformClose(t *testing.T) {
+	path := testWriteScript(t, t.TempDir(), "route.lua", testScriptRoute)
+	st, err := newScriptTransform("orders.>", ScriptConfig{Path: path}, new(expvar.Map).Init())
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	program := st.current()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	state, err := st.acquire(ctx, program)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		st.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("close must not wait state in use")
+	}
+	st.release(state)
+	if state.L.IsClosed() != true {
+		t.Errorf("state in use must be closed on release")
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	dir := t.TempDir()
+	path := testWriteScript(t, dir, "route.lua", testScriptRoute)
+	v2 := testWriteScript(t, dir, "route_v2.lua", testScriptRouteV2)
+
+	lg := log.New(&testServerLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	conf := RelayConfig{
+		Topics: Topics(
+			Topic("orders.>", Script(ScriptConfig{Path: path})),
+		),
+	}
+	svr := NewDefaultServer(ServerOptRelayConfig(conf), ServerOptLogger(lg))
+	_, closers, err := svr.createTopicMiddlewares("orders.>", conf.Topics["orders.>"], nil)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+
+	reloaded := RelayConfig{
+		Topics: Topics(
+			Topic("orders.>", Script(ScriptConfig{Path: v2})),
+			Topic("new.>", Script(ScriptConfig{Path: v2})),
+		),
+	}
+	if err := svr.Reload(reloaded); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	if svr.scripts["orders.>"].current().path != v2 {
+		t.Errorf("script must be reloaded")
+	}
+	if _, ok := svr.scripts["new.>"]; ok {
+		t.Errorf("new topic requires restart")
+	}
+}
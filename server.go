@@ -2,11 +2,14 @@ package nrelay
 
 import (
 	"context"
+	"io"
 	"log"
+	"sync"
 
 	"github.com/nats-io/nats.go"
 	"github.com/octu0/chanque"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Server interface {
@@ -16,10 +19,13 @@ type Server interface {
 type ServerOptFunc func(*serverOpt)
 
 type serverOpt struct {
-	relayConf RelayConfig
-	executor  *chanque.Executor
-	logger    *log.Logger
-	natsOpts  []nats.Option
+	relayConf      RelayConfig
+	executor       *chanque.Executor
+	logger         *log.Logger
+	natsOpts       []nats.Option
+	tracerProvider trace.TracerProvider
+	middlewares    []Middleware
+	sinks          map[string]SinkFactory
 }
 
 func ServerOptRelayConfig(conf RelayConfig) ServerOptFunc {
@@ -28,6 +34,17 @@ func ServerOptRelayConfig(conf RelayConfig) ServerOptFunc {
 	}
 }
 
+// ServerOptSink registers factory of sink selected by type of topic sink config,
+// built-in "webhook" and "file" can be replaced
+func ServerOptSink(name string, factory SinkFactory) ServerOptFunc {
+	return func(opt *serverOpt) {
+		if opt.sinks == nil {
+			opt.sinks = defaultSinkFactories()
+		}
+		opt.sinks[name] = factory
+	}
+}
+
 func ServerOptExecutor(executor *chanque.Executor) ServerOptFunc {
 	return func(opt *serverOpt) {
 		opt.executor = executor
@@ -46,39 +63,446 @@ func ServerOptNatsOptions(natsOpts ...nats.Option) ServerOptFunc {
 	}
 }
 
+// ServerOptTracerProvider enables OpenTelemetry tracing,
+// W3C trace context in message headers is continued through the relay
+func ServerOptTracerProvider(tp trace.TracerProvider) ServerOptFunc {
+	return func(opt *serverOpt) {
+		opt.tracerProvider = tp
+	}
+}
+
+// ServerOptMiddleware registers middlewares executed for each message
+// between Source and Destination workers of every topic
+func ServerOptMiddleware(middlewares ...Middleware) ServerOptFunc {
+	return func(opt *serverOpt) {
+		opt.middlewares = append(opt.middlewares, middlewares...)
+	}
+}
+
 // check interface
 var (
 	_ (Server) = (*DefaultServer)(nil)
 )
 
+var (
+	ErrTapNotFound        = errors.New("tap not found")
+	ErrStateNotConfigured = errors.New("state not configured")
+)
+
 type DefaultServer struct {
-	opt *serverOpt
+	opt      *serverOpt
+	taps     map[string]*tap
+	mutex    *sync.Mutex
+	scripts  map[string]*scriptTransform
+	election *leaderElection
+	state    *stateStore
 }
 
+// Run relays all topics, only the elected instance relays if leader election is configured
 func (s *DefaultServer) Run(ctx context.Context) error {
+	if err := s.opt.relayConf.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+	if s.opt.relayConf.State.Configured() {
+		// only the leader relays and saves with leader election, otherwise each instance saves its own state
+		instance := ""
+		if s.opt.relayConf.Leader.Configured() != true {
+			instance = stateInstance(s.opt.relayConf.State)
+		}
+		store := newStateStore(s.opt.relayConf.State, s.opt.relayConf.NatsUrl, s.opt.natsOpts, s.opt.logger, s.IsLeader, instance)
+		if err := store.Open(); err != nil {
+			return errors.WithStack(err)
+		}
+		defer store.Close()
+
+		s.mutex.Lock()
+		s.state = store
+		s.mutex.Unlock()
+
+		sctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go store.run(sctx)
+	}
+	if s.opt.relayConf.Leader.Configured() {
+		return s.runWithLeaderElection(ctx)
+	}
+	return s.run(ctx)
+}
+
+// runWithLeaderElection relays while this instance is the leader, returns to standby when leadership is lost
+func (s *DefaultServer) runWithLeaderElection(ctx context.Context) error {
+	election := newLeaderElection(s.opt.relayConf.Leader, s.opt.relayConf.NatsUrl, s.opt.natsOpts, s.opt.logger)
+	if err := election.Open(); err != nil {
+		return errors.WithStack(err)
+	}
+	defer election.Close()
+
+	s.mutex.Lock()
+	s.election = election
+	s.mutex.Unlock()
+
+	for {
+		if err := election.WaitLeadership(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+
+		lctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			election.KeepAlive(lctx, cancel)
+		}()
+
+		err := s.run(lctx)
+		cancel()
+		<-done
+
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.opt.logger.Printf("warn: leadership lost, relays stopped")
+	}
+}
+
+// IsLeader returns true if this instance relays, always true without leader election
+func (s *DefaultServer) IsLeader() bool {
+	s.mutex.Lock()
+	election := s.election
+	s.mutex.Unlock()
+
+	if election == nil {
+		return s.opt.relayConf.Leader.Configured() != true
+	}
+	return election.IsLeader()
+}
+
+func (s *DefaultServer) run(ctx context.Context) error {
 	sourceNatsUrls := make([]string, 0, 2)
 	sourceNatsUrls = append(sourceNatsUrls, s.opt.relayConf.PrimaryUrl)
 	if 0 < len(s.opt.relayConf.SecondaryUrl) {
 		sourceNatsUrls = append(sourceNatsUrls, s.opt.relayConf.SecondaryUrl)
 	}
 
+	// shared by all topics
+	destinationLimiter, err := NewRateLimiter(s.opt.relayConf.RateLimit, DestinationMetrics())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	closers := make([]io.Closer, 0)
+	defer func() {
+		for _, c := range closers {
+			if err := c.Close(); err != nil {
+				s.opt.logger.Printf("warn: failed to close: %+v", err)
+			}
+		}
+	}()
+
+	s.mutex.Lock()
+	state := s.state
+	s.mutex.Unlock()
+
+	if state != nil {
+		// restored on every run, the previous leader may have saved newer state
+		topics := make([]string, 0, len(s.opt.relayConf.Topics))
+		for topic := range s.opt.relayConf.Topics {
+			topics = append(topics, topic)
+		}
+		if err := state.Restore(topics); err != nil {
+			return errors.WithStack(err)
+		}
+		defer func() {
+			if err := state.Save(); err != nil {
+				s.opt.logger.Printf("warn: failed to save state: %+v", err)
+			}
+		}()
+	}
+
+	// middleware closers are owned by relays once relays run
+	pendingClosers := make([]io.Closer, 0)
+	defer func() {
+		for _, c := range pendingClosers {
+			if err := c.Close(); err != nil {
+				s.opt.logger.Printf("warn: failed to close: %+v", err)
+			}
+		}
+	}()
+
 	relays := make([]Relay, 0, len(s.opt.relayConf.Topics)*len(sourceNatsUrls))
 	for topic, conf := range s.opt.relayConf.Topics {
-		src := NewMultipleSource(sourceNatsUrls, s.opt.natsOpts, s.opt.logger)
-		dst := NewSingleDestination(s.opt.executor, s.opt.relayConf.NatsUrl, s.opt.natsOpts, s.opt.logger)
-		relay := NewMultipleSourceSingleDestinationRelay(topic, src, dst, conf.PrefixSize, conf.WorkerNum, s.opt.logger)
+		// inbound payload transforms are applied by split if split is configured
+		_, _, dstCodec, dstEncryption := splitPayloadConfig(conf)
+
+		var dl *deadLetter
+		if conf.DeadLetter.Configured() {
+			// shared by source(queue full, validation) and destination(publish failure)
+			d, err := s.createDeadLetter(topic, conf.DeadLetter, dstCodec, dstEncryption)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			closers = append(closers, d)
+			dl = d
+		}
+
+		topicMiddlewares, topicClosers, err := s.createTopicMiddlewares(topic, conf, dl)
+		pendingClosers = append(pendingClosers, topicClosers...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		topicLimiter, err := NewRateLimiter(conf.RateLimit, TopicMetrics(topic))
+		if err != nil {
+			return errors.Wrapf(err, "topic: %s", topic)
+		}
+
+		srcOpts := []SourceOptFunc{
+			SourceOptTracerProvider(s.opt.tracerProvider),
+			SourceOptMiddleware(s.opt.middlewares...),
+			SourceOptMiddleware(topicMiddlewares...),
+			SourceOptPartition(conf.Partition),
+			SourceOptQueue(conf.Queue),
+		}
+		dstOpts := []DestinationOptFunc{
+			DestinationOptTracerProvider(s.opt.tracerProvider),
+			DestinationOptRateLimiter(topicLimiter, destinationLimiter),
+			DestinationOptRetryPolicy(NewRetryPolicy(conf.Retry, TopicMetrics(topic))),
+			DestinationOptBuffer(conf.Buffer),
+			DestinationOptCodec(dstCodec),
+			DestinationOptEncryption(dstEncryption),
+		}
+		if state != nil {
+			dstOpts = append(dstOpts, destinationOptStats(state.Topic(topic)))
+		}
+		if t, ok := s.taps[topic]; ok {
+			srcOpts = append(srcOpts, sourceOptTap(t))
+		}
+		if conf.Record.Configured() {
+			rec := newRecorder(topic, conf.Record, s.opt.logger, TopicMetrics(topic))
+			if err := rec.Open(); err != nil {
+				return errors.WithStack(err)
+			}
+			closers = append(closers, rec)
+			srcOpts = append(srcOpts, sourceOptRecorder(rec))
+		}
+		if dl != nil {
+			srcOpts = append(srcOpts, sourceOptDeadLetter(dl))
+			dstOpts = append(dstOpts, destinationOptDeadLetter(dl))
+		}
+		src, err := s.createSource(sourceNatsUrls, conf, srcOpts)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		dst, err := s.createDestination(topic, conf, dstOpts)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		relay := NewMultipleSourceSingleDestinationRelay(topic, src, dst, conf.PrefixSize, conf.WorkerNum, s.opt.logger, topicClosers...)
 		relays = append(relays, relay)
 	}
 
+	pendingClosers = nil
 	return runRelays(ctx, s.opt.executor, s.opt.logger, relays)
 }
 
+// createSource returns Source of input if input is configured for topic
+func (s *DefaultServer) createSource(sourceNatsUrls []string, conf RelayClientConfig, srcOpts []SourceOptFunc) (Source, error) {
+	if conf.Input.Configured() != true {
+		return NewMultipleSource(sourceNatsUrls, s.opt.natsOpts, s.opt.logger, srcOpts...), nil
+	}
+	return newInputSource(conf.Input, s.opt.logger, srcOpts...)
+}
+
+// createDestination returns SinkDestination if sink is configured for topic
+func (s *DefaultServer) createDestination(topic string, conf RelayClientConfig, dstOpts []DestinationOptFunc) (Destination, error) {
+	if conf.Sink.Configured() != true {
+		return NewSingleDestination(s.opt.executor, s.opt.relayConf.NatsUrl, s.opt.natsOpts, s.opt.logger, dstOpts...), nil
+	}
+	factory, ok := s.opt.sinks[conf.Sink.Type]
+	if ok != true {
+		return nil, errors.Wrapf(ErrUnknownSink, "topic:%s type:%s", topic, conf.Sink.Type)
+	}
+	return NewSinkDestination(s.opt.executor, topic, conf.Sink, factory, s.opt.logger, dstOpts...), nil
+}
+
+// createDeadLetter opens dead-letter of topic,
+// messages dead-lettered before destination transforms are stored as the destination would receive
+func (s *DefaultServer) createDeadLetter(topic string, conf DeadLetterConfig, codec CodecConfig, encryption EncryptionConfig) (*deadLetter, error) {
+	transforms, err := newPayloadTransforms(codec, encryption)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dl := newDeadLetter(topic, conf, s.opt.relayConf.NatsUrl, s.opt.natsOpts, transforms, s.opt.logger, TopicMetrics(topic))
+	if err := dl.Open(); err != nil {
+		dl.Close()
+		return nil, errors.WithStack(err)
+	}
+	return dl, nil
+}
+
+// createTopicMiddlewares returns built-in middlewares configured by topic, dl is dead-letter of topic (nil if not configured)
+func (s *DefaultServer) createTopicMiddlewares(topic string, conf RelayClientConfig, dl *deadLetter) ([]Middleware, []io.Closer, error) {
+	middlewares := make([]Middleware, 0)
+	closers := make([]io.Closer, 0)
+
+	if conf.Aggregate.Configured() && conf.Aggregate.Mode == AggregateModeSplit {
+		// first middleware, combined messages are split before transforms
+		sp, err := newSplit(topic, conf, TopicMetrics(topic))
+		if err != nil {
+			return nil, closers, errors.WithStack(err)
+		}
+		middlewares = append(middlewares, sp.Middleware)
+		closers = append(closers, sp)
+	}
+	if conf.Wasm.Configured() {
+		w, err := newWasmTransform(topic, conf.Wasm, TopicMetrics(topic))
+		if err != nil {
+			return nil, closers, errors.WithStack(err)
+		}
+		middlewares = append(middlewares, w.Middleware)
+		closers = append(closers, w)
+	}
+	if conf.Schema.Configured() {
+		schemaDeadLetter := dl
+		if 0 < len(conf.Schema.DeadLetter) {
+			// dedicated dead-letter subject of invalid messages
+			_, _, codec, encryption := splitPayloadConfig(conf)
+			d, err := s.createDeadLetter(topic, DeadLetterConfig{Subject: conf.Schema.DeadLetter}, codec, encryption)
+			if err != nil {
+				return nil, closers, errors.WithStack(err)
+			}
+			closers = append(closers, d)
+			schemaDeadLetter = d
+		}
+		sv, err := newSchemaValidation(topic, conf.Schema, schemaDeadLetter, TopicMetrics(topic))
+		if err != nil {
+			return nil, closers, errors.WithStack(err)
+		}
+		middlewares = append(middlewares, sv.Middleware)
+	}
+	if conf.Script.Configured() {
+		st, err := newScriptTransform(topic, conf.Script, TopicMetrics(topic))
+		if err != nil {
+			return nil, closers, errors.WithStack(err)
+		}
+		middlewares = append(middlewares, st.Middleware)
+		closers = append(closers, st)
+
+		s.mutex.Lock()
+		s.scripts[topic] = st
+		s.mutex.Unlock()
+	}
+	if conf.Ordering.Configured() {
+		// reorders messages after transforms
+		o, err := newOrdering(topic, conf, s.opt.logger, TopicMetrics(topic))
+		if err != nil {
+			return nil, closers, errors.WithStack(err)
+		}
+		middlewares = append(middlewares, o.Middleware)
+		closers = append(closers, o)
+	}
+	if conf.Aggregate.Configured() && conf.Aggregate.Mode != AggregateModeSplit {
+		a, err := newAggregation(topic, conf, s.opt.logger, TopicMetrics(topic))
+		if err != nil {
+			return nil, closers, errors.WithStack(err)
+		}
+		middlewares = append(middlewares, a.Middleware)
+		closers = append(closers, a)
+	}
+	if conf.Delay.Configured() {
+		// last middleware, holds messages just before enqueue
+		d, err := newDelay(topic, conf.Delay, s.opt.logger, TopicMetrics(topic))
+		if err != nil {
+			return nil, closers, errors.WithStack(err)
+		}
+		middlewares = append(middlewares, d.Middleware)
+		closers = append(closers, d)
+	}
+	return middlewares, closers, nil
+}
+
+// Reload applies reloadable configurations (scripts) of running topics,
+// adding or removing topics requires restart
+func (s *DefaultServer) Reload(conf RelayConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for topic, c := range conf.Topics {
+		st, ok := s.scripts[topic]
+		if ok != true {
+			if c.Script.Configured() {
+				s.opt.logger.Printf("warn: script of topic %s is not running, restart required", topic)
+			}
+			continue
+		}
+		if c.Script.Configured() != true {
+			s.opt.logger.Printf("warn: script of topic %s is removed, restart required", topic)
+			continue
+		}
+		if err := st.Reload(c.Script); err != nil {
+			return errors.WithStack(err)
+		}
+		s.opt.logger.Printf("info: script of topic %s reloaded: %s", topic, c.Script.Path)
+	}
+	return nil
+}
+
+// SetTapEnabled toggles tap of topic at runtime
+func (s *DefaultServer) SetTapEnabled(topic string, enable bool) error {
+	t, ok := s.taps[topic]
+	if ok != true {
+		return errors.WithStack(ErrTapNotFound)
+	}
+	t.SetEnabled(enable)
+	return nil
+}
+
+// TopicStates returns relay position and statistics of topics summed over instances, requires state configured
+func (s *DefaultServer) TopicStates() (map[string]TopicState, error) {
+	s.mutex.Lock()
+	state := s.state
+	s.mutex.Unlock()
+
+	if state == nil {
+		return nil, errors.WithStack(ErrStateNotConfigured)
+	}
+	states, err := state.Aggregate()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return states, nil
+}
+
+// TapEnabled returns enable status of configured taps by topic
+func (s *DefaultServer) TapEnabled() map[string]bool {
+	status := make(map[string]bool, len(s.taps))
+	for topic, t := range s.taps {
+		status[topic] = t.Enabled()
+	}
+	return status
+}
+
 func NewDefaultServer(funcs ...ServerOptFunc) *DefaultServer {
 	opt := new(serverOpt)
 	for _, fn := range funcs {
 		fn(opt)
 	}
-	return &DefaultServer{opt}
+	if opt.sinks == nil {
+		opt.sinks = defaultSinkFactories()
+	}
+
+	taps := make(map[string]*tap)
+	for topic, conf := range opt.relayConf.Topics {
+		if conf.Tap.Configured() {
+			taps[topic] = newTap(topic, conf.Tap, opt.relayConf.NatsUrl, opt.natsOpts, opt.logger, TopicMetrics(topic))
+		}
+	}
+	return &DefaultServer{opt, taps, new(sync.Mutex), make(map[string]*scriptTransform), nil, nil}
 }
 
 func runRelays(ctx context.Context, executor *chanque.Executor, logger *log.Logger, relays []Relay) error {
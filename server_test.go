@@ -8,6 +8,7 @@ import (
 
 	"github.com/octu0/chanque"
 	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
 )
 
 type testServerRunRelays_RelayWithError struct {
@@ -109,3 +110,36 @@ func TestServerRunRelays(t *testing.T) {
 		}
 	})
 }
+
+func TestServerRunInvalidWorker(t *testing.T) {
+	conf := RelayConfig{
+		Topics: Topics(Topic("foo.>", WorkerNum(0))),
+	}
+	svr := NewDefaultServer(ServerOptRelayConfig(conf))
+	if err := svr.Run(context.TODO()); errors.Is(err, ErrInvalidWorkerNum) != true {
+		t.Errorf("must ErrInvalidWorkerNum: %+v", err)
+	}
+}
+
+func TestRelayConfigDefaultWorker(t *testing.T) {
+	data := []byte(`
+topic:
+  "foo.>":
+    prefix: 4
+  "bar.>":
+    worker: 0
+`)
+	conf := RelayConfig{}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	if v := conf.Topics["foo.>"].WorkerNum; v != 1 {
+		t.Errorf("omitted worker defaults to 1: %d", v)
+	}
+	if v := conf.Topics["foo.>"].PrefixSize; v != 4 {
+		t.Errorf("prefix must be read: %d", v)
+	}
+	if err := conf.Validate(); errors.Is(err, ErrInvalidWorkerNum) != true {
+		t.Errorf("explicit worker 0 must be rejected: %+v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package nrelay
+
+import (
+	"log"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+const (
+	SinkTypeWebhook   string = "webhook"
+	SinkTypeFile      string = "file"
+	SinkTypeMqtt      string = "mqtt"
+	SinkTypeWebsocket string = "websocket"
+)
+
+var (
+	ErrUnknownSink = errors.New("unknown sink type")
+)
+
+// Sink delivers messages of topic outside of NATS (e.g. Kafka, HTTP, file).
+// Write is called concurrently by destination workers with the batch dequeued at once,
+// errors marked by RetryableError are retried by the retry policy of topic
+type Sink interface {
+	Write(msgs []*nats.Msg) error
+	Close() error
+}
+
+// SinkFactory creates Sink of topic, registered by ServerOptSink with the name selected by SinkConfig.Type
+type SinkFactory func(topic string, conf SinkConfig) (Sink, error)
+
+func defaultSinkFactories() map[string]SinkFactory {
+	return map[string]SinkFactory{
+		SinkTypeWebhook: func(topic string, conf SinkConfig) (Sink, error) {
+			return newWebhookSink(conf)
+		},
+		SinkTypeFile: func(topic string, conf SinkConfig) (Sink, error) {
+			return newFileSink(conf)
+		},
+		SinkTypeMqtt: func(topic string, conf SinkConfig) (Sink, error) {
+			return newMqttSink(conf.Mqtt)
+		},
+		SinkTypeWebsocket: func(topic string, conf SinkConfig) (Sink, error) {
+			return newWebsocketSink(topic, conf.Websocket, TopicMetrics(topic))
+		},
+	}
+}
+
+// check interface
+var (
+	_ Destination = (*SinkDestination)(nil)
+)
+
+// SinkDestination relays messages distributed by Source to Sink instead of nats
+type SinkDestination struct {
+	executor *chanque.Executor
+	topic    string
+	conf     SinkConfig
+	factory  SinkFactory
+	logger   *log.Logger
+	opt      *destinationOpt
+	pipeline *destinationPipeline
+	sink     Sink
+	workers  []chanque.Worker
+}
+
+func (d *SinkDestination) Open(num int) error {
+	if err := d.pipeline.open(0); err != nil {
+		return errors.WithStack(err)
+	}
+
+	sink, err := d.factory(d.topic, d.conf)
+	if err != nil {
+		return errors.Wrapf(err, "sink: %s", d.conf.Type)
+	}
+	d.sink = sink
+	d.logger.Printf("debug: sink destination open %s type:%s", d.topic, d.conf.Type)
+
+	workers := make([]chanque.Worker, 0, num)
+	for i := 0; i < num; i += 1 {
+		workers = append(workers, d.createWorker())
+	}
+	d.workers = workers
+	return nil
+}
+
+func (d *SinkDestination) Close() error {
+	d.pipeline.stop()
+	for _, worker := range d.workers {
+		worker.CloseEnqueue()
+	}
+	for _, worker := range d.workers {
+		worker.ShutdownAndWait()
+	}
+	d.pipeline.close()
+	if d.sink != nil {
+		if err := d.sink.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (d *SinkDestination) Workers() []chanque.Worker {
+	return d.workers
+}
+
+// sinkBatch holds messages dequeued at once by a worker until its PostHook
+type sinkBatch struct {
+	msgs []*nats.Msg
+}
+
+func (d *SinkDestination) createWorker() chanque.Worker {
+	counted := new(countedWorker)
+	batch := &sinkBatch{make([]*nats.Msg, 0, d.opt.buffer.batchSize())}
+	handler := counted.Handler(d.createWorkerHandler(batch))
+	postHook := func() {
+		d.flush(batch)
+	}
+	if d.opt.buffer.Type == BufferTypeRing {
+		counted.Worker = newRingWorker(
+			d.executor,
+			handler,
+			postHook,
+			d.opt.buffer.capacity(),
+			d.opt.buffer.batchSize(),
+		)
+		return counted
+	}
+	counted.Worker = chanque.NewDefaultWorker(
+		handler,
+		chanque.WorkerExecutor(d.executor),
+		chanque.WorkerCapacity(d.opt.buffer.capacity()),
+		chanque.WorkerMaxDequeueSize(d.opt.buffer.batchSize()),
+		chanque.WorkerPostHook(postHook),
+		chanque.WorkerAbortQueueHandler(func(param interface{}) {
+			d.logger.Printf("error: sink queue aborted: %v", param)
+		}),
+	)
+	return counted
+}
+
+func (d *SinkDestination) createWorkerHandler(batch *sinkBatch) chanque.WorkerHandler {
+	return func(param interface{}) {
+		msg := param.(*nats.Msg)
+		if d.pipeline.prepare(msg) != true {
+			return
+		}
+		batch.msgs = append(batch.msgs, msg)
+	}
+}
+
+// flush writes batch to sink
+func (d *SinkDestination) flush(batch *sinkBatch) {
+	if len(batch.msgs) < 1 {
+		return
+	}
+	defer func() {
+		for i := range batch.msgs {
+			batch.msgs[i] = nil
+		}
+		batch.msgs = batch.msgs[:0]
+	}()
+
+	d.pipeline.deliver(batch.msgs, func() error {
+		return d.sink.Write(batch.msgs)
+	})
+}
+
+func NewSinkDestination(executor *chanque.Executor, topic string, conf SinkConfig, factory SinkFactory, logger *log.Logger, funcs ...DestinationOptFunc) *SinkDestination {
+	opt := new(destinationOpt)
+	for _, fn := range funcs {
+		fn(opt)
+	}
+	return &SinkDestination{executor, topic, conf, factory, logger, opt, newDestinationPipeline(logger, opt), nil, nil}
+}
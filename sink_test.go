@@ -0,0 +1,288 @@
+package nrelay
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type testSink struct {
+	mutex *sync.Mutex
+	msgs  []*nats.Msg
+	fails int
+}
+
+func (s *testSink) Write(msgs []*nats.Msg) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if 0 < s.fails {
+		s.fails -= 1
+		return RetryableError(errors.New("unavailable"))
+	}
+	s.msgs = append(s.msgs, msgs...)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+func (s *testSink) len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.msgs)
+}
+
+func testSinkEnqueue(t *testing.T, dst *SinkDestination, num int) {
+	for i, w := range dst.Workers() {
+		for j := 0; j < num; j += 1 {
+			msg := nats.NewMsg(fmt.Sprintf("test.%d.%d", i, j))
+			msg.Data = []byte(fmt.Sprintf("data-%d-%d", i, j))
+			if w.Enqueue(msg) != true {
+				t.Fatalf("must enqueue")
+			}
+		}
+	}
+}
+
+func TestSinkDestination(t *testing.T) {
+	e := chanque.NewExecutor(10, 10)
+	t.Cleanup(func() { e.Release() })
+
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+
+	t.Run("retry", func(tt *testing.T) {
+		sink := &testSink{mutex: new(sync.Mutex), fails: 2}
+		factory := func(topic string, conf SinkConfig) (Sink, error) {
+			return sink, nil
+		}
+		retry := NewRetryPolicy(RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond}, nil)
+		dst := NewSinkDestination(e, "test.>", SinkConfig{Type: "test"}, factory, lg, DestinationOptRetryPolicy(retry))
+		if err := dst.Open(2); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		testSinkEnqueue(tt, dst, 100)
+		if err := dst.Close(); err != nil {
+			tt.Errorf("must no error: %+v", err)
+		}
+		if n := sink.len(); n != 200 {
+			tt.Errorf("all messages written after retry: %d", n)
+		}
+	})
+	t.Run("failed/stats", func(tt *testing.T) {
+		sink := &testSink{mutex: new(sync.Mutex), fails: 1}
+		factory := func(topic string, conf SinkConfig) (Sink, error) {
+			return sink, nil
+		}
+		stats := newTopicStats("test.>")
+		dst := NewSinkDestination(e, "test.>", SinkConfig{Type: "test"}, factory, lg, destinationOptStats(stats))
+		if err := dst.Open(1); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		testSinkEnqueue(tt, dst, 10)
+		if err := dst.Close(); err != nil {
+			tt.Errorf("must no error: %+v", err)
+		}
+
+		s := stats.Snapshot()
+		if s.Relayed+s.Failed != 10 {
+			tt.Errorf("all messages counted: %+v", s)
+		}
+		if s.Failed < 1 {
+			tt.Errorf("first batch must fail without retry: %+v", s)
+		}
+		if uint64(sink.len()) != s.Relayed {
+			tt.Errorf("written %d relayed %d", sink.len(), s.Relayed)
+		}
+	})
+	t.Run("trace", func(tt *testing.T) {
+		sink := &testSink{mutex: new(sync.Mutex)}
+		factory := func(topic string, conf SinkConfig) (Sink, error) {
+			return sink, nil
+		}
+		sr := tracetest.NewSpanRecorder()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+		dst := NewSinkDestination(e, "test.>", SinkConfig{Type: "test"}, factory, lg, DestinationOptTracerProvider(tp))
+		if err := dst.Open(1); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		testSinkEnqueue(tt, dst, 3)
+		if err := dst.Close(); err != nil {
+			tt.Errorf("must no error: %+v", err)
+		}
+
+		published := 0
+		for _, span := range sr.Ended() {
+			if span.Name() == spanNamePublish {
+				published += 1
+			}
+		}
+		if published != 3 {
+			tt.Errorf("publish span for each message: %d", published)
+		}
+		for _, msg := range sink.msgs {
+			if (&natsHeaderCarrier{msg}).Get("traceparent") == "" {
+				tt.Errorf("trace context must be injected: %s", msg.Subject)
+			}
+		}
+	})
+}
+
+func TestWebhookSink(t *testing.T) {
+	t.Run("batch", func(tt *testing.T) {
+		received := make(chan []Record, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			records := make([]Record, 0)
+			if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			received <- records
+		}))
+		defer ts.Close()
+
+		sink, err := newWebhookSink(SinkConfig{Url: ts.URL, Headers: map[string]string{"Authorization": "Bearer secret"}})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer sink.Close()
+
+		m1 := nats.NewMsg("foo.1")
+		m1.Data = []byte("hello")
+		m1.Header.Set("X-Test", "1")
+		m2 := nats.NewMsg("foo.2")
+		m2.Data = []byte("world")
+		if err := sink.Write([]*nats.Msg{m1, m2}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		records := <-received
+		if len(records) != 2 {
+			tt.Fatalf("batch of 2: %d", len(records))
+		}
+		if records[0].Subject != "foo.1" || string(records[0].Data) != "hello" || records[0].Header.Get("X-Test") != "1" {
+			tt.Errorf("unexpected record: %+v", records[0])
+		}
+		if records[1].Subject != "foo.2" || string(records[1].Data) != "world" {
+			tt.Errorf("unexpected record: %+v", records[1])
+		}
+	})
+	t.Run("status", func(tt *testing.T) {
+		status := int32(http.StatusServiceUnavailable)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}))
+		defer ts.Close()
+
+		sink, err := newWebhookSink(SinkConfig{Url: ts.URL})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer sink.Close()
+
+		msgs := []*nats.Msg{nats.NewMsg("foo")}
+		if err := sink.Write(msgs); IsRetryableError(err) != true {
+			tt.Errorf("5xx must be retryable: %+v", err)
+		}
+		atomic.StoreInt32(&status, http.StatusBadRequest)
+		if err := sink.Write(msgs); err == nil || IsRetryableError(err) {
+			tt.Errorf("4xx must not be retryable: %+v", err)
+		}
+		atomic.StoreInt32(&status, http.StatusNoContent)
+		if err := sink.Write(msgs); err != nil {
+			tt.Errorf("must no error: %+v", err)
+		}
+	})
+	t.Run("url_required", func(tt *testing.T) {
+		if _, err := newWebhookSink(SinkConfig{}); errors.Is(err, ErrWebhookUrlRequired) != true {
+			tt.Errorf("url required: %+v", err)
+		}
+	})
+}
+
+func TestFileSink(t *testing.T) {
+	t.Run("rotate/size", func(tt *testing.T) {
+		path := filepath.Join(tt.TempDir(), "sink.ndjson")
+		unrelated := []string{path + ".bak", path + ".0000", path + ".20000101T000000.000000000.gz"}
+		for _, p := range unrelated {
+			if err := os.WriteFile(p, []byte("keep"), 0644); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+		}
+		sink, err := newFileSink(SinkConfig{Path: path, MaxSize: 256, MaxBackups: 2})
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer sink.Close()
+
+		for i := 0; i < 20; i += 1 {
+			msg := nats.NewMsg(fmt.Sprintf("foo.%d", i))
+			msg.Data = []byte("0123456789")
+			if err := sink.Write([]*nats.Msg{msg}); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+		}
+
+		backups, err := filepath.Glob(path + ".*")
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if len(backups) != 2+len(unrelated) {
+			tt.Errorf("max backups 2: %v", backups)
+		}
+		for _, p := range unrelated {
+			if _, err := os.Stat(p); err != nil {
+				tt.Errorf("unrelated file must be kept: %s", p)
+			}
+		}
+		records := testReadRecords(tt, path)
+		if len(records) < 1 {
+			tt.Fatalf("current file must have records")
+		}
+		if records[len(records)-1].Subject != "foo.19" {
+			tt.Errorf("last record: %+v", records[len(records)-1])
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if 256 < stat.Size() {
+			tt.Errorf("rotated by max size: %d", stat.Size())
+		}
+	})
+	t.Run("append", func(tt *testing.T) {
+		path := filepath.Join(tt.TempDir(), "sink.ndjson")
+		for i := 0; i < 2; i += 1 {
+			sink, err := newFileSink(SinkConfig{Path: path})
+			if err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			if err := sink.Write([]*nats.Msg{nats.NewMsg("foo"), nats.NewMsg("bar")}); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			sink.Close()
+		}
+		if records := testReadRecords(tt, path); len(records) != 4 {
+			tt.Errorf("appended to existing file: %d", len(records))
+		}
+	})
+}
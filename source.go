@@ -1,11 +1,16 @@
 package nrelay
 
 import (
+	"expvar"
 	"log"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/octu0/chanque"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Source interface {
@@ -15,17 +20,84 @@ type Source interface {
 	Unsubscribe() error
 }
 
+var (
+	errEnqueueFailed = errors.New("failed to enqueue, queue full or closed")
+)
+
+type SourceOptFunc func(*sourceOpt)
+
+type sourceOpt struct {
+	tracerProvider trace.TracerProvider
+	tap            *tap
+	recorder       *recorder
+	deadLetter     *deadLetter
+	middlewares    []Middleware
+	partition      PartitionConfig
+	queue          string
+}
+
+func SourceOptTracerProvider(tp trace.TracerProvider) SourceOptFunc {
+	return func(opt *sourceOpt) {
+		opt.tracerProvider = tp
+	}
+}
+
+func SourceOptMiddleware(middlewares ...Middleware) SourceOptFunc {
+	return func(opt *sourceOpt) {
+		opt.middlewares = append(opt.middlewares, middlewares...)
+	}
+}
+
+// SourceOptPartition chooses partition strategy of workers
+func SourceOptPartition(conf PartitionConfig) SourceOptFunc {
+	return func(opt *sourceOpt) {
+		opt.partition = conf
+	}
+}
+
+// SourceOptQueue subscribes by queue group, relay instances of the same group share messages
+func SourceOptQueue(group string) SourceOptFunc {
+	return func(opt *sourceOpt) {
+		opt.queue = group
+	}
+}
+
+func sourceOptTap(t *tap) SourceOptFunc {
+	return func(opt *sourceOpt) {
+		opt.tap = t
+	}
+}
+
+func sourceOptRecorder(r *recorder) SourceOptFunc {
+	return func(opt *sourceOpt) {
+		opt.recorder = r
+	}
+}
+
+func sourceOptDeadLetter(d *deadLetter) SourceOptFunc {
+	return func(opt *sourceOpt) {
+		opt.deadLetter = d
+	}
+}
+
 // check interface
 var (
 	_ (Source) = (*MultipleSource)(nil)
 )
 
 type MultipleSource struct {
-	natsUrls []string
-	natsOpts []nats.Option
-	logger   *log.Logger
-	conns    []*nats.Conn
-	subs     []*nats.Subscription
+	natsUrls    []string
+	natsOpts    []nats.Option
+	logger      *log.Logger
+	tracing     *tracing
+	tap         *tap
+	recorder    *recorder
+	deadLetter  *deadLetter
+	middlewares []Middleware
+	partition   PartitionConfig
+	queue       string
+	conns       []*nats.Conn
+	subs        []*nats.Subscription
 }
 
 func (s *MultipleSource) Open() error {
@@ -40,14 +112,26 @@ func (s *MultipleSource) Open() error {
 		conns[i] = conn
 	}
 	s.conns = conns
+
+	if s.tap != nil {
+		if err := s.tap.Open(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
 	return nil
 }
 
 func (s *MultipleSource) Subscribe(topic string, prefixSize int, workers []chanque.Worker) error {
-	dist := newDistribute(workers)
+	partitioner, err := NewPartitioner(s.partition, workers)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	dist := newDistributeWithPartitioner(workers, partitioner)
+	metrics := TopicMetrics(topic)
 	subs := make([]*nats.Subscription, len(s.conns))
 	for i, conn := range s.conns {
-		sub, err := conn.Subscribe(topic, s.createSubscribeHandler(prefixSize, dist))
+		handler := chainMiddleware(topic, s.createEnqueueHandler(s.natsUrls[i], prefixSize, dist, metrics), s.middlewares)
+		sub, err := s.subscribe(conn, topic, s.createSubscribeHandler(s.natsUrls[i], handler, metrics))
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -60,6 +144,14 @@ func (s *MultipleSource) Subscribe(topic string, prefixSize int, workers []chanq
 	return nil
 }
 
+// subscribe uses QueueSubscribe if queue group is configured
+func (s *MultipleSource) subscribe(conn *nats.Conn, topic string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	if 0 < len(s.queue) {
+		return conn.QueueSubscribe(topic, s.queue, handler)
+	}
+	return conn.Subscribe(topic, handler)
+}
+
 func (s *MultipleSource) Unsubscribe() error {
 	for _, sub := range s.subs {
 		if err := sub.Unsubscribe(); err != nil {
@@ -78,25 +170,88 @@ func (s *MultipleSource) Close() error {
 	for _, conn := range s.conns {
 		conn.Close()
 	}
+
+	if s.tap != nil {
+		if err := s.tap.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
 	return nil
 }
 
-func (s *MultipleSource) createSubscribeHandler(prefixSize int, dist *distribute) nats.MsgHandler {
+func (s *MultipleSource) createSubscribeHandler(url string, handler RelayHandler, metrics *expvar.Map) nats.MsgHandler {
 	return func(msg *nats.Msg) {
-		if 0 < prefixSize {
-			if ok := dist.Publish(msg.Subject[0:prefixSize], msg); ok != true {
-				s.logger.Printf("warn: failed to publish: %s", msg.Subject)
-			}
-			return
+		if s.tracing != nil {
+			// receive span covers middlewares, span context is handed over by msg headers
+			attrs := append(messagingAttributes(msg.Subject), attribute.String("messaging.url", url))
+			ctx, span := s.tracing.start(s.tracing.extract(msg), spanNameReceive, trace.SpanKindConsumer, attrs...)
+			defer span.End()
+
+			s.tracing.inject(ctx, msg)
+		}
+
+		if err := handler(msg); err != nil {
+			metrics.Add(metricMiddlewareErrors, 1)
+			s.logger.Printf("warn: middleware error subj:%s err:%+v", msg.Subject, err)
+		}
+	}
+}
+
+// createEnqueueHandler is the last handler of middlewares, distributes msg to destination workers
+func (s *MultipleSource) createEnqueueHandler(url string, prefixSize int, dist *distribute, metrics *expvar.Map) RelayHandler {
+	return func(msg *nats.Msg) error {
+		key := msg.Subject
+		if 0 < prefixSize && prefixSize <= len(msg.Subject) {
+			key = msg.Subject[0:prefixSize]
+		}
+		idx := dist.Index(key, msg)
+		receivedAt := time.Now()
+
+		if s.tap != nil {
+			s.tap.Mirror(url, idx, receivedAt, msg)
+		}
+		if s.recorder != nil {
+			s.recorder.Record(url, idx, receivedAt, msg)
+		}
+
+		if s.tracing != nil {
+			s.enqueueWithTrace(key, idx, dist, msg, metrics)
+			return nil
 		}
 
-		if ok := dist.Publish(msg.Subject, msg); ok != true {
-			s.logger.Printf("warn: failed to publish: %s", msg.Subject)
+		if ok := dist.Enqueue(idx, msg); ok != true {
+			s.enqueueFailed(msg, metrics)
 		}
-		return
+		return nil
 	}
 }
 
-func NewMultipleSource(urls []string, natsOpts []nats.Option, logger *log.Logger) *MultipleSource {
-	return &MultipleSource{urls, natsOpts, logger, nil, nil}
+// enqueueWithTrace continues the receive span,
+// enqueue span context is injected into msg headers and handed to the destination worker
+func (s *MultipleSource) enqueueWithTrace(key string, idx int, dist *distribute, msg *nats.Msg, metrics *expvar.Map) {
+	ctx, span := s.tracing.start(s.tracing.extract(msg), spanNameEnqueue, trace.SpanKindInternal, attribute.String("nrelay.key", key))
+	defer span.End()
+
+	s.tracing.inject(ctx, msg)
+	if ok := dist.Enqueue(idx, msg); ok != true {
+		span.SetStatus(codes.Error, "failed to enqueue")
+		s.enqueueFailed(msg, metrics)
+	}
+}
+
+// enqueueFailed handles msg that could not be enqueued (e.g. queue full)
+func (s *MultipleSource) enqueueFailed(msg *nats.Msg, metrics *expvar.Map) {
+	metrics.Add(metricEnqueueFailed, 1)
+	s.logger.Printf("warn: failed to publish: %s", msg.Subject)
+	if s.deadLetter != nil {
+		s.deadLetter.Send(DeadLetterReasonQueueFull, 0, msg, errEnqueueFailed)
+	}
+}
+
+func NewMultipleSource(urls []string, natsOpts []nats.Option, logger *log.Logger, funcs ...SourceOptFunc) *MultipleSource {
+	opt := new(sourceOpt)
+	for _, fn := range funcs {
+		fn(opt)
+	}
+	return &MultipleSource{urls, natsOpts, logger, newTracing(opt.tracerProvider), opt.tap, opt.recorder, opt.deadLetter, opt.middlewares, opt.partition, opt.queue, nil, nil}
 }
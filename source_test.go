@@ -222,3 +222,61 @@ func TestMultipleSource(t *testing.T) {
 		testPublish(tt, []string{url1, url2, url3}, 10)
 	})
 }
+
+func TestMultipleSourceQueue(t *testing.T) {
+	testReceived := func(tt *testing.T, queue string) int32 {
+		ns, ok := testNatsServerStart()
+		if ok != true {
+			tt.Skip("unable to start a NATS Server")
+		}
+		defer ns.Shutdown()
+
+		url := fmt.Sprintf("nats://%s", ns.Addr().String())
+		lg := log.New(&testDestinationLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+
+		// two relay replicas
+		workers := []*testDistributeWorker{new(testDistributeWorker), new(testDistributeWorker)}
+		srcs := make([]*MultipleSource, len(workers))
+		for i, w := range workers {
+			src := NewMultipleSource([]string{url}, nil, lg, SourceOptQueue(queue))
+			if err := src.Open(); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			if err := src.Subscribe("test.queue.>", 0, []chanque.Worker{w}); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			srcs[i] = src
+		}
+
+		nc, err := nats.Connect(url)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer nc.Close()
+
+		for i := 0; i < 1000; i += 1 {
+			nc.Publish(fmt.Sprintf("test.queue.%d", i), []byte(""))
+		}
+		nc.Flush()
+
+		<-time.After(100 * time.Millisecond)
+
+		for _, src := range srcs {
+			if err := src.Close(); err != nil {
+				tt.Errorf("must no error: %+v", err)
+			}
+		}
+		return workers[0].get() + workers[1].get()
+	}
+
+	t.Run("subscribe", func(tt *testing.T) {
+		if n := testReceived(tt, ""); n != 2000 {
+			tt.Errorf("each replica receives all msg: %d", n)
+		}
+	})
+	t.Run("queue", func(tt *testing.T) {
+		if n := testReceived(tt, "nrelay"); n != 1000 {
+			tt.Errorf("replicas must share msg without duplicates: %d", n)
+		}
+	})
+}
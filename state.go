@@ -0,0 +1,355 @@
+package nrelay
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultStateInterval time.Duration = 5 * time.Second
+)
+
+// TopicState is persisted relay position and statistics of topic
+type TopicState struct {
+	Topic         string    `json:"topic"`
+	Relayed       uint64    `json:"relayed"`
+	RelayedBytes  uint64    `json:"relayed_bytes"`
+	Failed        uint64    `json:"failed"`
+	LastRelayedAt time.Time `json:"last_relayed_at"`
+	LastMsgId     string    `json:"last_msg_id,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorAt   time.Time `json:"last_error_at"`
+}
+
+// topicStats counts relayed messages of topic, updated by destination workers concurrently
+type topicStats struct {
+	topic         string
+	relayed       uint64
+	relayedBytes  uint64
+	failed        uint64
+	lastRelayedAt int64
+	mutex         *sync.Mutex
+	lastMsgId     string
+	lastError     string
+	lastErrorAt   time.Time
+}
+
+// Relayed records msg published, last msg id is Nats-Msg-Id header
+func (t *topicStats) Relayed(msg *nats.Msg) {
+	atomic.AddUint64(&t.relayed, 1)
+	atomic.AddUint64(&t.relayedBytes, uint64(len(msg.Data)))
+	atomic.StoreInt64(&t.lastRelayedAt, time.Now().UnixNano())
+
+	if msg.Header == nil {
+		return
+	}
+	if id := msg.Header.Get(nats.MsgIdHdr); 0 < len(id) {
+		t.mutex.Lock()
+		t.lastMsgId = id
+		t.mutex.Unlock()
+	}
+}
+
+func (t *topicStats) Failed(err error) {
+	atomic.AddUint64(&t.failed, 1)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.lastError = strings.ReplaceAll(errors.Cause(err).Error(), "\n", " ")
+	t.lastErrorAt = time.Now()
+}
+
+func (t *topicStats) Snapshot() TopicState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	s := TopicState{
+		Topic:        t.topic,
+		Relayed:      atomic.LoadUint64(&t.relayed),
+		RelayedBytes: atomic.LoadUint64(&t.relayedBytes),
+		Failed:       atomic.LoadUint64(&t.failed),
+		LastMsgId:    t.lastMsgId,
+		LastError:    t.lastError,
+		LastErrorAt:  t.lastErrorAt,
+	}
+	if ns := atomic.LoadInt64(&t.lastRelayedAt); 0 < ns {
+		s.LastRelayedAt = time.Unix(0, ns)
+	}
+	return s
+}
+
+func (t *topicStats) restore(s TopicState) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	atomic.StoreUint64(&t.relayed, s.Relayed)
+	atomic.StoreUint64(&t.relayedBytes, s.RelayedBytes)
+	atomic.StoreUint64(&t.failed, s.Failed)
+	if s.LastRelayedAt.IsZero() != true {
+		atomic.StoreInt64(&t.lastRelayedAt, s.LastRelayedAt.UnixNano())
+	}
+	t.lastMsgId = s.LastMsgId
+	t.lastError = s.LastError
+	t.lastErrorAt = s.LastErrorAt
+}
+
+func newTopicStats(topic string) *topicStats {
+	return &topicStats{topic: topic, mutex: new(sync.Mutex)}
+}
+
+// stateStore persists topicStats in KV bucket, key is base64 of topic since wildcards are not valid for KV key.
+// Each instance saves to its own key(base64 of topic "." base64 of instance) unless instance is empty,
+// state of all instances are aggregated on read. Leader shares the key of topic without instance
+type stateStore struct {
+	conf     StateConfig
+	natsUrl  string
+	natsOpts []nats.Option
+	logger   *log.Logger
+	active   func() bool
+	instance string
+	conn     *nats.Conn
+	kv       nats.KeyValue
+	mutex    *sync.Mutex
+	topics   map[string]*topicStats
+}
+
+func stateKey(topic, instance string) string {
+	key := base64.RawURLEncoding.EncodeToString([]byte(topic))
+	if len(instance) < 1 {
+		return key
+	}
+	return key + "." + base64.RawURLEncoding.EncodeToString([]byte(instance))
+}
+
+// parseStateKey returns topic and instance of key
+func parseStateKey(key string) (string, string, error) {
+	topicKey, instanceKey := key, ""
+	if i := strings.IndexByte(key, '.'); 0 <= i {
+		topicKey, instanceKey = key[:i], key[i+1:]
+	}
+	topic, err := base64.RawURLEncoding.DecodeString(topicKey)
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+	instance, err := base64.RawURLEncoding.DecodeString(instanceKey)
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+	return string(topic), string(instance), nil
+}
+
+// mergeTopicState sums counts of a and b, last values are taken from the newer one
+func mergeTopicState(a, b TopicState) TopicState {
+	a.Relayed += b.Relayed
+	a.RelayedBytes += b.RelayedBytes
+	a.Failed += b.Failed
+	if a.LastRelayedAt.Before(b.LastRelayedAt) {
+		a.LastRelayedAt = b.LastRelayedAt
+		a.LastMsgId = b.LastMsgId
+	}
+	if a.LastErrorAt.Before(b.LastErrorAt) {
+		a.LastErrorAt = b.LastErrorAt
+		a.LastError = b.LastError
+	}
+	return a
+}
+
+func (s *stateStore) Open() error {
+	conn, err := nats.Connect(s.natsUrl, s.natsOpts...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return errors.WithStack(err)
+	}
+
+	kv, err := js.KeyValue(s.conf.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  s.conf.Bucket,
+			History: 1,
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return errors.WithStack(err)
+	}
+	s.conn = conn
+	s.kv = kv
+	return nil
+}
+
+func (s *stateStore) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	s.conn.Close()
+	s.conn = nil
+	return nil
+}
+
+// Topic returns stats of topic
+func (s *stateStore) Topic(topic string) *topicStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if t, ok := s.topics[topic]; ok {
+		return t
+	}
+	t := newTopicStats(topic)
+	s.topics[topic] = t
+	return t
+}
+
+// Restore loads persisted state of topics
+func (s *stateStore) Restore(topics []string) error {
+	for _, topic := range topics {
+		entry, err := s.kv.Get(stateKey(topic, s.instance))
+		if err != nil {
+			if errors.Is(err, nats.ErrKeyNotFound) {
+				continue
+			}
+			return errors.WithStack(err)
+		}
+		state := TopicState{}
+		if err := json.Unmarshal(entry.Value(), &state); err != nil {
+			return errors.Wrapf(err, "topic: %s", topic)
+		}
+		s.Topic(topic).restore(state)
+		s.logger.Printf("info: state restored topic:%s relayed:%d last_relayed_at:%s", topic, state.Relayed, state.LastRelayedAt)
+	}
+	return nil
+}
+
+// Save puts state of all topics while this instance is active(leader)
+func (s *stateStore) Save() error {
+	if s.active() != true {
+		return nil
+	}
+	for topic, state := range s.Snapshot() {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := s.kv.Put(stateKey(topic, s.instance), data); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (s *stateStore) Snapshot() map[string]TopicState {
+	s.mutex.Lock()
+	topics := make([]*topicStats, 0, len(s.topics))
+	for _, t := range s.topics {
+		topics = append(topics, t)
+	}
+	s.mutex.Unlock()
+
+	states := make(map[string]TopicState, len(topics))
+	for _, t := range topics {
+		states[t.topic] = t.Snapshot()
+	}
+	return states
+}
+
+// Aggregate returns state of topics summed over all instances,
+// state of this instance is taken from memory since it is newer than saved one
+func (s *stateStore) Aggregate() (map[string]TopicState, error) {
+	states := s.Snapshot()
+	if len(s.instance) < 1 {
+		return states, nil
+	}
+
+	keys, err := s.kv.Keys()
+	if err != nil {
+		if errors.Is(err, nats.ErrNoKeysFound) {
+			return states, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	for _, key := range keys {
+		topic, instance, err := parseStateKey(key)
+		if err != nil {
+			s.logger.Printf("warn: invalid state key %s: %+v", key, err)
+			continue
+		}
+		if len(instance) < 1 || instance == s.instance {
+			continue
+		}
+		entry, err := s.kv.Get(key)
+		if err != nil {
+			if errors.Is(err, nats.ErrKeyNotFound) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+		state := TopicState{}
+		if err := json.Unmarshal(entry.Value(), &state); err != nil {
+			return nil, errors.Wrapf(err, "topic:%s instance:%s", topic, instance)
+		}
+		if current, ok := states[topic]; ok {
+			states[topic] = mergeTopicState(current, state)
+		} else {
+			states[topic] = state
+		}
+	}
+	return states, nil
+}
+
+// run saves state every interval until ctx is done
+func (s *stateStore) run(ctx context.Context) {
+	interval := s.conf.Interval
+	if interval <= 0 {
+		interval = defaultStateInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				s.logger.Printf("warn: failed to save state: %+v", err)
+			}
+		}
+	}
+}
+
+// stateInstance returns instance id of state key, hostname by default
+func stateInstance(conf StateConfig) string {
+	if 0 < len(conf.Id) {
+		return conf.Id
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// newStateStore saves state to the key of instance, the key is shared by leaders if instance is empty
+func newStateStore(conf StateConfig, natsUrl string, natsOpts []nats.Option, logger *log.Logger, active func() bool, instance string) *stateStore {
+	return &stateStore{
+		conf:     conf,
+		natsUrl:  natsUrl,
+		natsOpts: natsOpts,
+		logger:   logger,
+		active:   active,
+		instance: instance,
+		mutex:    new(sync.Mutex),
+		topics:   make(map[string]*topicStats),
+	}
+}
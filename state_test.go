@@ -0,0 +1,170 @@
+package nrelay
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+func TestStateStore(t *testing.T) {
+	ns, ok := testJetStreamServerStart(t)
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer ns.Shutdown()
+
+	url := fmt.Sprintf("nats://%s", ns.Addr().String())
+	lg := log.New(&testAdminLogWriter{t}, t.Name()+"@", log.LstdFlags)
+	active := func() bool { return true }
+
+	t.Run("save/restore", func(tt *testing.T) {
+		conf := StateConfig{Bucket: "restore"}
+		s1 := newStateStore(conf, url, nil, lg, active, "")
+		if err := s1.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer s1.Close()
+
+		msg := nats.NewMsg("foo.bar")
+		msg.Data = []byte("hello")
+		msg.Header.Set(nats.MsgIdHdr, "id-1")
+
+		st := s1.Topic("foo.>")
+		st.Relayed(msg)
+		msg.Header.Set(nats.MsgIdHdr, "id-2")
+		st.Relayed(msg)
+		st.Failed(errors.New("publish failed"))
+
+		if err := s1.Save(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		s2 := newStateStore(conf, url, nil, lg, active, "")
+		if err := s2.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer s2.Close()
+
+		if err := s2.Restore([]string{"foo.>", "unknown.>"}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		states := s2.Snapshot()
+		if len(states) != 1 {
+			tt.Fatalf("restored topic only: %v", states)
+		}
+		s := states["foo.>"]
+		if s.Relayed != 2 {
+			tt.Errorf("relayed 2: %d", s.Relayed)
+		}
+		if s.RelayedBytes != 10 {
+			tt.Errorf("relayed bytes 10: %d", s.RelayedBytes)
+		}
+		if s.Failed != 1 {
+			tt.Errorf("failed 1: %d", s.Failed)
+		}
+		if s.LastMsgId != "id-2" {
+			tt.Errorf("last msg id: %s", s.LastMsgId)
+		}
+		if s.LastError != "publish failed" {
+			tt.Errorf("last error: %s", s.LastError)
+		}
+		if s.LastRelayedAt.IsZero() {
+			tt.Errorf("last relayed at must be restored")
+		}
+
+		// counts continue from restored state
+		s2.Topic("foo.>").Relayed(msg)
+		if n := s2.Snapshot()["foo.>"].Relayed; n != 3 {
+			tt.Errorf("relayed 3: %d", n)
+		}
+	})
+	t.Run("standby/no_save", func(tt *testing.T) {
+		conf := StateConfig{Bucket: "standby"}
+		s1 := newStateStore(conf, url, nil, lg, func() bool { return false }, "")
+		if err := s1.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer s1.Close()
+
+		s1.Topic("foo.>").Relayed(nats.NewMsg("foo.bar"))
+		if err := s1.Save(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if _, err := s1.kv.Get(stateKey("foo.>", "")); errors.Is(err, nats.ErrKeyNotFound) != true {
+			tt.Errorf("standby must not save state: %+v", err)
+		}
+	})
+	t.Run("instances/aggregate", func(tt *testing.T) {
+		conf := StateConfig{Bucket: "instances"}
+		s1 := newStateStore(conf, url, nil, lg, active, "relay-1")
+		if err := s1.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer s1.Close()
+		s2 := newStateStore(conf, url, nil, lg, active, "relay-2")
+		if err := s2.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer s2.Close()
+
+		msg := nats.NewMsg("foo.bar")
+		msg.Data = []byte("hello")
+		s1.Topic("foo.>").Relayed(msg)
+		s1.Topic("foo.>").Relayed(msg)
+		msg.Header.Set(nats.MsgIdHdr, "id-last")
+		s2.Topic("foo.>").Relayed(msg)
+		s2.Topic("foo.>").Failed(errors.New("publish failed"))
+		if err := s1.Save(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if err := s2.Save(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		states, err := s1.Aggregate()
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		s := states["foo.>"]
+		if s.Relayed != 3 || s.RelayedBytes != 15 || s.Failed != 1 {
+			tt.Errorf("summed over instances: %+v", s)
+		}
+		if s.LastMsgId != "id-last" || s.LastError != "publish failed" {
+			tt.Errorf("last values of newer instance: %+v", s)
+		}
+
+		// each instance restores its own state
+		s3 := newStateStore(conf, url, nil, lg, active, "relay-1")
+		if err := s3.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer s3.Close()
+		if err := s3.Restore([]string{"foo.>"}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if n := s3.Snapshot()["foo.>"].Relayed; n != 2 {
+			tt.Errorf("restored own state: %d", n)
+		}
+	})
+}
+
+func TestAdminStateNotConfigured(t *testing.T) {
+	svr := NewDefaultServer(ServerOptRelayConfig(RelayConfig{}))
+	ts := httptest.NewServer(NewAdminHandler(svr))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/state")
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("not configured: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,217 @@
+package nrelay
+
+import (
+	"bufio"
+	"expvar"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	HeaderTapSubject    string = "Nrelay-Tap-Subject"
+	HeaderTapSource     string = "Nrelay-Tap-Source"
+	HeaderTapReceivedAt string = "Nrelay-Tap-Received-At"
+	HeaderTapWorker     string = "Nrelay-Tap-Worker"
+)
+
+const (
+	defaultTapFileQueueSize int = 1024
+)
+
+const (
+	metricTapDropped string = "tap_dropped"
+)
+
+// tap mirrors sampled messages to debug subject or local file,
+// file is written by another goroutine and records are dropped while its queue is full
+type tap struct {
+	topic    string
+	conf     TapConfig
+	natsUrl  string
+	natsOpts []nats.Option
+	logger   *log.Logger
+	metrics  *expvar.Map
+	enabled  int32
+	counter  uint64
+	mutex    *sync.RWMutex
+	conn     *nats.Conn
+	file     *os.File
+	records  chan Record
+	done     chan struct{}
+}
+
+func (t *tap) Open() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if 0 < len(t.conf.Subject) {
+		conn, err := nats.Connect(t.natsUrl, t.natsOpts...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		t.logger.Printf("debug: tap connect %s", t.natsUrl)
+		t.conn = conn
+	}
+	if 0 < len(t.conf.File) {
+		f, err := os.OpenFile(t.conf.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		t.file = f
+		t.records = make(chan Record, defaultTapFileQueueSize)
+		t.done = make(chan struct{})
+		go t.writeFile(f, t.records, t.done)
+	}
+	return nil
+}
+
+// writeFile writes queued records until records is closed, buffer is flushed when the queue is empty
+func (t *tap) writeFile(f *os.File, records chan Record, done chan struct{}) {
+	defer close(done)
+
+	w := bufio.NewWriter(f)
+	enc := NewRecordWriter(w)
+	for r := range records {
+		if err := enc.Write(r); err != nil {
+			t.logger.Printf("warn: failed to tap subj:%s err:%+v", r.Subject, err)
+		}
+		if len(records) < 1 {
+			if err := w.Flush(); err != nil {
+				t.logger.Printf("warn: failed to flush tap %s: %+v", t.conf.File, err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.logger.Printf("warn: failed to flush tap %s: %+v", t.conf.File, err)
+	}
+}
+
+func (t *tap) Close() error {
+	t.mutex.Lock()
+	conn, file, records, done := t.conn, t.file, t.records, t.done
+	t.conn, t.file, t.records, t.done = nil, nil, nil, nil
+	t.mutex.Unlock()
+
+	if conn != nil {
+		conn.Flush()
+		conn.Close()
+	}
+	if records != nil {
+		close(records)
+		<-done
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (t *tap) Enabled() bool {
+	return atomic.LoadInt32(&t.enabled) == 1
+}
+
+func (t *tap) SetEnabled(enable bool) {
+	if enable {
+		atomic.StoreInt32(&t.enabled, 1)
+	} else {
+		atomic.StoreInt32(&t.enabled, 0)
+	}
+	t.logger.Printf("info: tap %s enable:%v", t.topic, enable)
+}
+
+func (t *tap) sampled() bool {
+	if 0 < t.conf.Every {
+		return atomic.AddUint64(&t.counter, 1)%uint64(t.conf.Every) == 0
+	}
+	if 0 < t.conf.Percent {
+		return rand.Float64()*100 < t.conf.Percent
+	}
+	return true
+}
+
+// Mirror copies msg when tap is enabled and msg is sampled
+func (t *tap) Mirror(url string, worker int, receivedAt time.Time, msg *nats.Msg) {
+	if t.Enabled() != true {
+		return
+	}
+	if t.sampled() != true {
+		return
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.conn != nil {
+		if err := t.conn.PublishMsg(t.tapMsg(url, worker, receivedAt, msg)); err != nil {
+			t.logger.Printf("warn: failed to tap subj:%s err:%+v", msg.Subject, err)
+		}
+	}
+	if t.records != nil {
+		r := Record{
+			Subject:    msg.Subject,
+			Header:     copyHeader(msg.Header),
+			Data:       append([]byte(nil), msg.Data...), // msg is reused after relay
+			Source:     url,
+			ReceivedAt: receivedAt,
+			Worker:     worker,
+		}
+		select {
+		case t.records <- r:
+		default:
+			t.metrics.Add(metricTapDropped, 1)
+		}
+	}
+}
+
+func (t *tap) tapMsg(url string, worker int, receivedAt time.Time, msg *nats.Msg) *nats.Msg {
+	header := copyHeader(msg.Header)
+	if header == nil {
+		header = nats.Header{}
+	}
+	header.Set(HeaderTapSubject, msg.Subject)
+	header.Set(HeaderTapSource, url)
+	header.Set(HeaderTapReceivedAt, receivedAt.Format(time.RFC3339Nano))
+	header.Set(HeaderTapWorker, strconv.Itoa(worker))
+	return &nats.Msg{
+		Subject: t.conf.Subject,
+		Header:  header,
+		Data:    msg.Data,
+	}
+}
+
+func copyHeader(h nats.Header) nats.Header {
+	if h == nil {
+		return nil
+	}
+	c := make(nats.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+func newTap(topic string, conf TapConfig, natsUrl string, natsOpts []nats.Option, logger *log.Logger, metrics *expvar.Map) *tap {
+	t := &tap{
+		topic:    topic,
+		conf:     conf,
+		natsUrl:  natsUrl,
+		natsOpts: natsOpts,
+		logger:   logger,
+		metrics:  metrics,
+		mutex:    new(sync.RWMutex),
+	}
+	if conf.Enable {
+		t.enabled = 1
+	}
+	return t
+}
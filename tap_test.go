@@ -0,0 +1,183 @@
+package nrelay
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type testTapLogWriter struct {
+	t *testing.T
+}
+
+func (w *testTapLogWriter) Write(p []byte) (int, error) {
+	if testing.Verbose() {
+		w.t.Logf("%s", p)
+	}
+	return len(p), nil
+}
+
+func TestTapSampled(t *testing.T) {
+	t.Run("every", func(tt *testing.T) {
+		lg := log.New(&testTapLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+		tp := newTap("test.>", TapConfig{File: "dummy", Every: 3}, "", nil, lg, new(expvar.Map).Init())
+		count := 0
+		for i := 0; i < 9; i += 1 {
+			if tp.sampled() {
+				count += 1
+			}
+		}
+		if count != 3 {
+			tt.Errorf("every 3rd msg must be sampled: %d", count)
+		}
+	})
+	t.Run("percent/100", func(tt *testing.T) {
+		lg := log.New(&testTapLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+		tp := newTap("test.>", TapConfig{File: "dummy", Percent: 100}, "", nil, lg, new(expvar.Map).Init())
+		for i := 0; i < 100; i += 1 {
+			if tp.sampled() != true {
+				tt.Errorf("all msg must be sampled")
+			}
+		}
+	})
+	t.Run("default/all", func(tt *testing.T) {
+		lg := log.New(&testTapLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+		tp := newTap("test.>", TapConfig{File: "dummy"}, "", nil, lg, new(expvar.Map).Init())
+		for i := 0; i < 100; i += 1 {
+			if tp.sampled() != true {
+				tt.Errorf("all msg must be sampled")
+			}
+		}
+	})
+}
+
+func TestTapMirror(t *testing.T) {
+	t.Run("file", func(tt *testing.T) {
+		path := filepath.Join(tt.TempDir(), "tap.ndjson")
+		lg := log.New(&testTapLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+		tp := newTap("test.>", TapConfig{File: path}, "", nil, lg, new(expvar.Map).Init())
+		if err := tp.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		now := time.Now()
+		tp.Mirror("nats://src1", 1, now, &nats.Msg{Subject: "test.1", Data: []byte("disabled")})
+		tp.SetEnabled(true)
+		tp.Mirror("nats://src1", 1, now, &nats.Msg{Subject: "test.1", Data: []byte("a")})
+		tp.Mirror("nats://src2", 2, now, &nats.Msg{Subject: "test.2", Data: []byte("b")})
+		tp.SetEnabled(false)
+		tp.Mirror("nats://src1", 1, now, &nats.Msg{Subject: "test.1", Data: []byte("disabled")})
+
+		if err := tp.Close(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer f.Close()
+
+		records := make([]Record, 0)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			r := Record{}
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			records = append(records, r)
+		}
+		if len(records) != 2 {
+			tt.Fatalf("only enabled msg mirrored: %d", len(records))
+		}
+		if records[0].Subject != "test.1" || string(records[0].Data) != "a" || records[0].Source != "nats://src1" || records[0].Worker != 1 {
+			tt.Errorf("unexpected record: %+v", records[0])
+		}
+		if records[1].Subject != "test.2" || string(records[1].Data) != "b" || records[1].Source != "nats://src2" || records[1].Worker != 2 {
+			tt.Errorf("unexpected record: %+v", records[1])
+		}
+	})
+	t.Run("file/close", func(tt *testing.T) {
+		path := filepath.Join(tt.TempDir(), "tap.ndjson")
+		lg := log.New(&testTapLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+		tp := newTap("test.>", TapConfig{File: path, Enable: true}, "", nil, lg, new(expvar.Map).Init())
+		if err := tp.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		wg := new(sync.WaitGroup)
+		for i := 0; i < 4; i += 1 {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for j := 0; j < 1000; j += 1 {
+					tp.Mirror("nats://src1", worker, time.Now(), &nats.Msg{Subject: "test.1", Data: []byte("a")})
+				}
+			}(i)
+		}
+		time.Sleep(time.Millisecond)
+		if err := tp.Close(); err != nil {
+			tt.Errorf("must no error: %+v", err)
+		}
+		wg.Wait()
+	})
+	t.Run("subject", func(tt *testing.T) {
+		ns, ok := testNatsServerStart()
+		if ok != true {
+			tt.Skip("unable to start a NATS Server")
+		}
+		defer ns.Shutdown()
+
+		url := fmt.Sprintf("nats://%s", ns.Addr().String())
+		nc, err := nats.Connect(url)
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer nc.Close()
+
+		sub, err := nc.SubscribeSync("debug.test")
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		nc.Flush()
+
+		lg := log.New(&testTapLogWriter{tt}, tt.Name()+"@", log.LstdFlags)
+		tp := newTap("test.>", TapConfig{Subject: "debug.test", Enable: true}, url, nil, lg, new(expvar.Map).Init())
+		if err := tp.Open(); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		defer tp.Close()
+
+		tp.Mirror("nats://src1", 3, time.Now(), &nats.Msg{Subject: "test.1", Data: []byte("hello")})
+		tp.conn.Flush()
+
+		msg, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			tt.Fatalf("tap msg not received: %+v", err)
+		}
+		if string(msg.Data) != "hello" {
+			tt.Errorf("payload must be mirrored: %s", msg.Data)
+		}
+		if msg.Header.Get(HeaderTapSubject) != "test.1" {
+			tt.Errorf("original subject: %s", msg.Header.Get(HeaderTapSubject))
+		}
+		if msg.Header.Get(HeaderTapSource) != "nats://src1" {
+			tt.Errorf("source url: %s", msg.Header.Get(HeaderTapSource))
+		}
+		if msg.Header.Get(HeaderTapWorker) != "3" {
+			tt.Errorf("worker index: %s", msg.Header.Get(HeaderTapWorker))
+		}
+		if _, err := time.Parse(time.RFC3339Nano, msg.Header.Get(HeaderTapReceivedAt)); err != nil {
+			tt.Errorf("received at: %s", msg.Header.Get(HeaderTapReceivedAt))
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package nrelay
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName string = "github.com/octu0/nats-relay"
+)
+
+const (
+	spanNameReceive string = "nrelay.receive"
+	spanNameEnqueue string = "nrelay.enqueue"
+	spanNamePublish string = "nrelay.publish"
+)
+
+// check interface
+var (
+	_ propagation.TextMapCarrier = (*natsHeaderCarrier)(nil)
+)
+
+// natsHeaderCarrier adapts *nats.Msg headers to propagation.TextMapCarrier,
+// header map is allocated only when a value is actually injected
+type natsHeaderCarrier struct {
+	msg *nats.Msg
+}
+
+func (c *natsHeaderCarrier) Get(key string) string {
+	if c.msg.Header == nil {
+		return ""
+	}
+	if values, ok := c.msg.Header[key]; ok && 0 < len(values) {
+		return values[0]
+	}
+	for k, values := range c.msg.Header {
+		if strings.EqualFold(k, key) && 0 < len(values) {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+func (c *natsHeaderCarrier) Set(key, value string) {
+	if c.msg.Header == nil {
+		c.msg.Header = nats.Header{}
+	}
+	for k := range c.msg.Header {
+		if k != key && strings.EqualFold(k, key) {
+			delete(c.msg.Header, k)
+		}
+	}
+	c.msg.Header[key] = []string{value}
+}
+
+func (c *natsHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.msg.Header))
+	for k := range c.msg.Header {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+type tracing struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (t *tracing) extract(msg *nats.Msg) context.Context {
+	return t.propagator.Extract(context.Background(), &natsHeaderCarrier{msg})
+}
+
+func (t *tracing) inject(ctx context.Context, msg *nats.Msg) {
+	t.propagator.Inject(ctx, &natsHeaderCarrier{msg})
+}
+
+func (t *tracing) start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+func messagingAttributes(subject string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", "nats"),
+		attribute.String("messaging.destination", subject),
+	}
+}
+
+// newTracing returns nil when tp is nil, tracing is disabled
+func newTracing(tp trace.TracerProvider) *tracing {
+	if tp == nil {
+		return nil
+	}
+	return &tracing{
+		tracer:     tp.Tracer(tracerName, trace.WithInstrumentationVersion(Version)),
+		propagator: propagation.TraceContext{},
+	}
+}
@@ -0,0 +1,144 @@
+package nrelay
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNatsHeaderCarrier(t *testing.T) {
+	t.Run("nil/header", func(tt *testing.T) {
+		msg := &nats.Msg{Subject: "test"}
+		c := &natsHeaderCarrier{msg}
+		if c.Get("traceparent") != "" {
+			tt.Errorf("nil header must empty")
+		}
+		if len(c.Keys()) != 0 {
+			tt.Errorf("nil header has no keys")
+		}
+		c.Set("traceparent", "value")
+		if msg.Header == nil {
+			tt.Errorf("header must allocated")
+		}
+		if c.Get("traceparent") != "value" {
+			tt.Errorf("expect:value actual:%s", c.Get("traceparent"))
+		}
+	})
+	t.Run("case/insensitive", func(tt *testing.T) {
+		msg := &nats.Msg{Subject: "test", Header: nats.Header{}}
+		msg.Header["Traceparent"] = []string{"old"}
+		c := &natsHeaderCarrier{msg}
+		if c.Get("traceparent") != "old" {
+			tt.Errorf("expect:old actual:%s", c.Get("traceparent"))
+		}
+		c.Set("traceparent", "new")
+		if len(msg.Header) != 1 {
+			tt.Errorf("must be replaced: %v", msg.Header)
+		}
+		if c.Get("traceparent") != "new" {
+			tt.Errorf("expect:new actual:%s", c.Get("traceparent"))
+		}
+	})
+}
+
+func TestTracingPropagation(t *testing.T) {
+	srcNs, ok := testNatsServerStart()
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer srcNs.Shutdown()
+	dstNs, ok := testNatsServerStart()
+	if ok != true {
+		t.Skip("unable to start a NATS Server")
+	}
+	defer dstNs.Shutdown()
+
+	e := chanque.NewExecutor(10, 10)
+	t.Cleanup(func() { e.Release() })
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	srcUrl := fmt.Sprintf("nats://%s", srcNs.Addr().String())
+	dstUrl := fmt.Sprintf("nats://%s", dstNs.Addr().String())
+	lg := log.New(&testDestinationLogWriter{t}, t.Name()+"@", log.LstdFlags)
+
+	dstNc, err := nats.Connect(dstUrl)
+	if err != nil {
+		t.Fatalf("destination connect failed: %+v", err)
+	}
+	defer dstNc.Close()
+
+	sub, err := dstNc.SubscribeSync("test.trace.>")
+	if err != nil {
+		t.Fatalf("destination subscribe failed: %+v", err)
+	}
+	dstNc.Flush()
+
+	src := NewMultipleSource([]string{srcUrl}, nil, lg, SourceOptTracerProvider(tp))
+	dst := NewSingleDestination(e, dstUrl, nil, lg, DestinationOptTracerProvider(tp))
+	if err := src.Open(); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	if err := dst.Open(1); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	if err := src.Subscribe("test.trace.>", 0, dst.Workers()); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+
+	srcNc, err := nats.Connect(srcUrl)
+	if err != nil {
+		t.Fatalf("source connect failed: %+v", err)
+	}
+	defer srcNc.Close()
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parent := "00-" + traceID + "-00f067aa0ba902b7-01"
+	out := nats.NewMsg("test.trace.1")
+	out.Header.Set("traceparent", parent)
+	out.Data = []byte("hello")
+	if err := srcNc.PublishMsg(out); err != nil {
+		t.Fatalf("publish failed: %+v", err)
+	}
+	srcNc.Flush()
+
+	relayed, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("relayed message not received: %+v", err)
+	}
+
+	src.Close()
+	dst.Close()
+
+	if string(relayed.Data) != "hello" {
+		t.Errorf("payload must be relayed as is: %s", relayed.Data)
+	}
+	relayedParent := (&natsHeaderCarrier{relayed}).Get("traceparent")
+	if strings.Contains(relayedParent, traceID) != true {
+		t.Errorf("trace id must be continued: %s", relayedParent)
+	}
+	if relayedParent == parent {
+		t.Errorf("parent span must be replaced by publish span: %s", relayedParent)
+	}
+
+	names := make(map[string]struct{})
+	for _, span := range sr.Ended() {
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("span %s must be in trace %s", span.Name(), traceID)
+		}
+		names[span.Name()] = struct{}{}
+	}
+	for _, name := range []string{spanNameReceive, spanNameEnqueue, spanNamePublish} {
+		if _, ok := names[name]; ok != true {
+			t.Errorf("span %s not recorded", name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package nrelay
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/octu0/chanque"
+	"github.com/pkg/errors"
+)
+
+const (
+	InputFormatRaw    string = "raw"
+	InputFormatSyslog string = "syslog"
+)
+
+const (
+	udpSourceBufferSize int = 64 * 1024
+)
+
+var (
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	syslogSeverities = []string{
+		"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+	}
+)
+
+// check interface
+var (
+	_ (Source) = (*UDPSource)(nil)
+)
+
+// UDPSource publishes each datagram to subject,
+// syslog format (RFC3164/RFC5424) appends facility and severity of PRI ("<subject>.local0.err")
+type UDPSource struct {
+	*ingest
+	conf InputConfig
+	conn net.PacketConn
+	done chan struct{}
+	wg   *sync.WaitGroup
+	once *sync.Once
+}
+
+func (s *UDPSource) Open() error {
+	if err := s.ingest.open(); err != nil {
+		return errors.WithStack(err)
+	}
+	conn, err := net.ListenPacket("udp", s.conf.Listen)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.logger.Printf("debug: udp source listen %s", conn.LocalAddr().String())
+	s.conn = conn
+	return nil
+}
+
+func (s *UDPSource) Subscribe(topic string, prefixSize int, workers []chanque.Worker) error {
+	if err := s.ingest.subscribe(topic, s.conf.Subject, prefixSize, workers); err != nil {
+		return errors.WithStack(err)
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+// Unsubscribe stops receiving, closing conn unblocks reading
+func (s *UDPSource) Unsubscribe() error {
+	s.once.Do(func() {
+		close(s.done)
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	})
+	s.wg.Wait()
+	return nil
+}
+
+func (s *UDPSource) Close() error {
+	if err := s.Unsubscribe(); err != nil {
+		return errors.WithStack(err)
+	}
+	return s.ingest.close()
+}
+
+// Addr returns listening address
+func (s *UDPSource) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *UDPSource) serve() {
+	defer s.wg.Done()
+
+	buf := make([]byte, udpSourceBufferSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			s.logger.Printf("error: udp source stopped: %+v", err)
+			return
+		}
+		s.receive(buf[:n], addr)
+	}
+}
+
+func (s *UDPSource) receive(data []byte, addr net.Addr) {
+	data = bytes.TrimRight(data, "\r\n\x00")
+	if len(data) < 1 {
+		return
+	}
+
+	subject := s.subjectOf()
+	if s.conf.Format == InputFormatSyslog {
+		facility, severity, ok := parseSyslogPriority(data)
+		if ok != true {
+			s.metrics.Add(metricIngestErrors, 1)
+			s.logger.Printf("debug: invalid syslog priority from %s", addr.String())
+		} else {
+			subject = s.subjectOf(syslogFacilities[facility], syslogSeverities[severity])
+		}
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = append(make([]byte, 0, len(data)), data...)
+	msg.Header.Set(HeaderRemoteAddr, addr.String())
+	if err := s.publish(msg); err != nil {
+		s.logger.Printf("warn: failed to ingest datagram from %s: %+v", addr.String(), err)
+	}
+}
+
+// parseSyslogPriority parses "<PRI>" of syslog message
+func parseSyslogPriority(data []byte) (int, int, bool) {
+	if len(data) < 3 || data[0] != '<' {
+		return 0, 0, false
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 2 || 4 < end {
+		return 0, 0, false
+	}
+	pri, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || pri < 0 || 191 < pri {
+		return 0, 0, false
+	}
+	return pri / 8, pri % 8, true
+}
+
+func NewUDPSource(conf InputConfig, logger *log.Logger, funcs ...SourceOptFunc) *UDPSource {
+	return &UDPSource{
+		ingest: newIngest("udp://"+conf.Listen, logger, funcs...),
+		conf:   conf,
+		done:   make(chan struct{}),
+		wg:     new(sync.WaitGroup),
+		once:   new(sync.Once),
+	}
+}
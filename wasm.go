@@ -0,0 +1,285 @@
+package nrelay
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+//
+// WASM transform ABI
+// ------------------
+// exports:
+//   memory
+//   nrelay_alloc(size i32) i32                  returns pointer to write input of size bytes
+//   nrelay_transform(ptr i32, len i32) i64      returns (out_ptr << 32 | out_len), out_len 0 drops the message
+//   nrelay_reset()                              frees all memory allocated since the last reset, called after every message
+//
+// input and output are JSON: {"subject":"foo.bar","header":{"Key":["value"]},"data":"<base64>"}
+//
+
+const (
+	wasmExportAlloc     string = "nrelay_alloc"
+	wasmExportTransform string = "nrelay_transform"
+	wasmExportReset     string = "nrelay_reset"
+)
+
+const (
+	defaultWasmTimeout time.Duration = 50 * time.Millisecond
+)
+
+const (
+	metricWasmCalls    string = "wasm_calls"
+	metricWasmDropped  string = "wasm_dropped"
+	metricWasmErrors   string = "wasm_errors"
+	metricWasmTimeouts string = "wasm_timeouts"
+	metricWasmExecUs   string = "wasm_exec_us"
+)
+
+var (
+	ErrWasmExportNotFound = errors.New("wasm export not found")
+	ErrWasmMemory         = errors.New("wasm memory out of range")
+	ErrWasmTimeout        = errors.New("wasm execution timeout")
+)
+
+type wasmMessage struct {
+	Subject string      `json:"subject"`
+	Header  nats.Header `json:"header,omitempty"`
+	Data    []byte      `json:"data"`
+}
+
+type wasmInstance struct {
+	mod       api.Module
+	alloc     api.Function
+	transform api.Function
+	reset     api.Function
+}
+
+// wasmTransform runs a WASM module per message, module instances are pooled
+// since an instance is not safe for concurrent use
+type wasmTransform struct {
+	topic     string
+	timeout   time.Duration
+	runtime   wazero.Runtime
+	compiled  wazero.CompiledModule
+	instances chan *wasmInstance
+	metrics   *expvar.Map
+}
+
+func (w *wasmTransform) instantiate(ctx context.Context) (*wasmInstance, error) {
+	mod, err := w.runtime.InstantiateModule(ctx, w.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"),
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	alloc := mod.ExportedFunction(wasmExportAlloc)
+	if alloc == nil {
+		mod.Close(ctx)
+		return nil, errors.Wrapf(ErrWasmExportNotFound, "export: %s", wasmExportAlloc)
+	}
+	transform := mod.ExportedFunction(wasmExportTransform)
+	if transform == nil {
+		mod.Close(ctx)
+		return nil, errors.Wrapf(ErrWasmExportNotFound, "export: %s", wasmExportTransform)
+	}
+	reset := mod.ExportedFunction(wasmExportReset)
+	if reset == nil {
+		mod.Close(ctx)
+		return nil, errors.Wrapf(ErrWasmExportNotFound, "export: %s", wasmExportReset)
+	}
+	return &wasmInstance{mod, alloc, transform, reset}, nil
+}
+
+// acquire returns pooled instance, nil slot is instantiated lazily
+func (w *wasmTransform) acquire(ctx context.Context) (*wasmInstance, error) {
+	var inst *wasmInstance
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ErrWasmTimeout, "no instance available: %s", w.timeout)
+	case inst = <-w.instances:
+	}
+	if inst != nil {
+		return inst, nil
+	}
+
+	inst, err := w.instantiate(ctx)
+	if err != nil {
+		w.instances <- nil
+		return nil, errors.WithStack(err)
+	}
+	return inst, nil
+}
+
+func (w *wasmTransform) release(inst *wasmInstance) {
+	w.instances <- inst
+}
+
+// discard closes broken instance (e.g. closed by timeout), the slot is re-instantiated on next acquire
+func (w *wasmTransform) discard(inst *wasmInstance) {
+	inst.mod.Close(context.Background())
+	w.instances <- nil
+}
+
+// call returns nil if msg is dropped
+func (w *wasmTransform) call(msg *nats.Msg) (*wasmMessage, error) {
+	in, err := json.Marshal(wasmMessage{msg.Subject, msg.Header, msg.Data})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+
+	inst, err := w.acquire(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	start := time.Now()
+	defer func() {
+		w.metrics.Add(metricWasmExecUs, time.Since(start).Microseconds())
+	}()
+
+	out, err := w.exec(ctx, inst, in)
+	if err != nil {
+		if ctx.Err() != nil {
+			w.metrics.Add(metricWasmTimeouts, 1)
+			w.discard(inst)
+			return nil, errors.Wrapf(ErrWasmTimeout, "timeout: %s", w.timeout)
+		}
+		w.discard(inst)
+		return nil, errors.WithStack(err)
+	}
+	w.release(inst)
+	return out, nil
+}
+
+// exec invokes transform and resets memory of instance so that pooled instance does not grow
+func (w *wasmTransform) exec(ctx context.Context, inst *wasmInstance, in []byte) (*wasmMessage, error) {
+	out, err := w.invoke(ctx, inst, in)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := inst.reset.Call(ctx); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return out, nil
+}
+
+func (w *wasmTransform) invoke(ctx context.Context, inst *wasmInstance, in []byte) (*wasmMessage, error) {
+	res, err := inst.alloc.Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ptr := uint32(res[0])
+	if inst.mod.Memory().Write(ptr, in) != true {
+		return nil, errors.Wrapf(ErrWasmMemory, "write ptr:%d len:%d", ptr, len(in))
+	}
+
+	res, err = inst.transform.Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	if outLen == 0 {
+		return nil, nil // drop
+	}
+
+	data, ok := inst.mod.Memory().Read(outPtr, outLen)
+	if ok != true {
+		return nil, errors.Wrapf(ErrWasmMemory, "read ptr:%d len:%d", outPtr, outLen)
+	}
+	out := new(wasmMessage)
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return out, nil
+}
+
+func (w *wasmTransform) Middleware(topic string, next RelayHandler) RelayHandler {
+	return func(msg *nats.Msg) error {
+		w.metrics.Add(metricWasmCalls, 1)
+		out, err := w.call(msg)
+		if err != nil {
+			w.metrics.Add(metricWasmErrors, 1)
+			return errors.WithStack(err)
+		}
+		if out == nil {
+			w.metrics.Add(metricWasmDropped, 1)
+			return nil
+		}
+
+		msg.Subject = out.Subject
+		msg.Header = out.Header
+		msg.Data = out.Data
+		return next(msg)
+	}
+}
+
+func (w *wasmTransform) Close() error {
+	if err := w.runtime.Close(context.Background()); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func newWasmTransform(topic string, conf WasmConfig, metrics *expvar.Map) (*wasmTransform, error) {
+	bin, err := os.ReadFile(conf.Path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultWasmTimeout
+	}
+	size := conf.Instances
+	if size < 1 {
+		size = runtime.NumCPU()
+	}
+
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, errors.WithStack(err)
+	}
+	compiled, err := r.CompileModule(ctx, bin)
+	if err != nil {
+		r.Close(ctx)
+		return nil, errors.WithStack(err)
+	}
+
+	w := &wasmTransform{
+		topic:     topic,
+		timeout:   timeout,
+		runtime:   r,
+		compiled:  compiled,
+		instances: make(chan *wasmInstance, size),
+		metrics:   metrics,
+	}
+
+	// instantiate one to validate exports at startup
+	inst, err := w.instantiate(ctx)
+	if err != nil {
+		r.Close(ctx)
+		return nil, errors.WithStack(err)
+	}
+	w.instances <- inst
+	for i := 1; i < size; i += 1 {
+		w.instances <- nil
+	}
+	return w, nil
+}
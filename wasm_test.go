@@ -0,0 +1,184 @@
+package nrelay
+
+import (
+	"expvar"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// hand assembled modules, alloc always returns 1024 and reset does nothing unless noted
+var (
+	// nrelay_transform returns input as is
+	testWasmIdentity = []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0f, 0x03, 0x60,
+		0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x60, 0x00,
+		0x00, 0x03, 0x04, 0x03, 0x00, 0x01, 0x02, 0x05, 0x03, 0x01, 0x00, 0x01,
+		0x07, 0x3b, 0x04, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00,
+		0x0c, 0x6e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x61, 0x6c, 0x6c, 0x6f,
+		0x63, 0x00, 0x00, 0x10, 0x6e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x74,
+		0x72, 0x61, 0x6e, 0x73, 0x66, 0x6f, 0x72, 0x6d, 0x00, 0x01, 0x0c, 0x6e,
+		0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x72, 0x65, 0x73, 0x65, 0x74, 0x00,
+		0x02, 0x0a, 0x17, 0x03, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0b, 0x0c, 0x00,
+		0x20, 0x00, 0xad, 0x42, 0x20, 0x86, 0x20, 0x01, 0xad, 0x84, 0x0b, 0x02,
+		0x00, 0x0b,
+	}
+	// nrelay_transform returns 0
+	testWasmDrop = []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0f, 0x03, 0x60,
+		0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x60, 0x00,
+		0x00, 0x03, 0x04, 0x03, 0x00, 0x01, 0x02, 0x05, 0x03, 0x01, 0x00, 0x01,
+		0x07, 0x3b, 0x04, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00,
+		0x0c, 0x6e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x61, 0x6c, 0x6c, 0x6f,
+		0x63, 0x00, 0x00, 0x10, 0x6e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x74,
+		0x72, 0x61, 0x6e, 0x73, 0x66, 0x6f, 0x72, 0x6d, 0x00, 0x01, 0x0c, 0x6e,
+		0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x72, 0x65, 0x73, 0x65, 0x74, 0x00,
+		0x02, 0x0a, 0x0f, 0x03, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0b, 0x04, 0x00,
+		0x42, 0x00, 0x0b, 0x02, 0x00, 0x0b,
+	}
+	// nrelay_transform never returns
+	testWasmLoop = []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0f, 0x03, 0x60,
+		0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x60, 0x00,
+		0x00, 0x03, 0x04, 0x03, 0x00, 0x01, 0x02, 0x05, 0x03, 0x01, 0x00, 0x01,
+		0x07, 0x3b, 0x04, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00,
+		0x0c, 0x6e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x61, 0x6c, 0x6c, 0x6f,
+		0x63, 0x00, 0x00, 0x10, 0x6e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x74,
+		0x72, 0x61, 0x6e, 0x73, 0x66, 0x6f, 0x72, 0x6d, 0x00, 0x01, 0x0c, 0x6e,
+		0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x72, 0x65, 0x73, 0x65, 0x74, 0x00,
+		0x02, 0x0a, 0x14, 0x03, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0b, 0x09, 0x00,
+		0x03, 0x40, 0x0c, 0x00, 0x0b, 0x42, 0x00, 0x0b, 0x02, 0x00, 0x0b,
+	}
+	// nrelay_alloc bumps offset from 1024 by size, nrelay_reset rewinds it to 1024
+	testWasmBump = []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0f, 0x03, 0x60,
+		0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x60, 0x00,
+		0x00, 0x03, 0x04, 0x03, 0x00, 0x01, 0x02, 0x05, 0x03, 0x01, 0x00, 0x01,
+		0x06, 0x07, 0x01, 0x7f, 0x01, 0x41, 0x80, 0x08, 0x0b, 0x07, 0x3b, 0x04,
+		0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x0c, 0x6e, 0x72,
+		0x65, 0x6c, 0x61, 0x79, 0x5f, 0x61, 0x6c, 0x6c, 0x6f, 0x63, 0x00, 0x00,
+		0x10, 0x6e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x74, 0x72, 0x61, 0x6e,
+		0x73, 0x66, 0x6f, 0x72, 0x6d, 0x00, 0x01, 0x0c, 0x6e, 0x72, 0x65, 0x6c,
+		0x61, 0x79, 0x5f, 0x72, 0x65, 0x73, 0x65, 0x74, 0x00, 0x02, 0x0a, 0x22,
+		0x03, 0x0b, 0x00, 0x23, 0x00, 0x23, 0x00, 0x20, 0x00, 0x6a, 0x24, 0x00,
+		0x0b, 0x0c, 0x00, 0x20, 0x00, 0xad, 0x42, 0x20, 0x86, 0x20, 0x01, 0xad,
+		0x84, 0x0b, 0x07, 0x00, 0x41, 0x80, 0x08, 0x24, 0x00, 0x0b,
+	}
+	// identity without nrelay_reset
+	testWasmNoReset = []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0c, 0x02, 0x60,
+		0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x03, 0x03,
+		0x02, 0x00, 0x01, 0x05, 0x03, 0x01, 0x00, 0x01, 0x07, 0x2c, 0x03, 0x06,
+		0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x0c, 0x6e, 0x72, 0x65,
+		0x6c, 0x61, 0x79, 0x5f, 0x61, 0x6c, 0x6c, 0x6f, 0x63, 0x00, 0x00, 0x10,
+		0x6e, 0x72, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x74, 0x72, 0x61, 0x6e, 0x73,
+		0x66, 0x6f, 0x72, 0x6d, 0x00, 0x01, 0x0a, 0x14, 0x02, 0x05, 0x00, 0x41,
+		0x80, 0x08, 0x0b, 0x0c, 0x00, 0x20, 0x00, 0xad, 0x42, 0x20, 0x86, 0x20,
+		0x01, 0xad, 0x84, 0x0b,
+	}
+)
+
+func testWasmTransform(t *testing.T, bin []byte, timeout time.Duration) (*wasmTransform, *expvar.Map) {
+	path := filepath.Join(t.TempDir(), "test.wasm")
+	if err := os.WriteFile(path, bin, 0644); err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	m := new(expvar.Map).Init()
+	w, err := newWasmTransform("test.>", WasmConfig{Path: path, Timeout: timeout, Instances: 2}, m)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w, m
+}
+
+func TestWasmTransform(t *testing.T) {
+	t.Run("identity", func(tt *testing.T) {
+		w, _ := testWasmTransform(tt, testWasmIdentity, time.Second)
+
+		relayed := make([]*nats.Msg, 0)
+		h := w.Middleware("test.>", func(msg *nats.Msg) error {
+			relayed = append(relayed, msg)
+			return nil
+		})
+		for i := 0; i < 10; i += 1 {
+			msg := &nats.Msg{Subject: "test.wasm", Header: nats.Header{}, Data: []byte("hello")}
+			msg.Header.Set("X-Test", "1")
+			if err := h(msg); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+		}
+		if len(relayed) != 10 {
+			tt.Fatalf("all msg must be relayed: %d", len(relayed))
+		}
+		for _, msg := range relayed {
+			if msg.Subject != "test.wasm" || string(msg.Data) != "hello" || msg.Header.Get("X-Test") != "1" {
+				tt.Errorf("msg must be kept: %+v", msg)
+			}
+		}
+	})
+	t.Run("drop", func(tt *testing.T) {
+		w, m := testWasmTransform(tt, testWasmDrop, time.Second)
+		h := w.Middleware("test.>", func(msg *nats.Msg) error {
+			tt.Errorf("must be dropped")
+			return nil
+		})
+		if err := h(&nats.Msg{Subject: "test.wasm", Data: []byte("hello")}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if v := m.Get(metricWasmDropped).(*expvar.Int).Value(); v != 1 {
+			tt.Errorf("dropped count expect:1 actual:%d", v)
+		}
+	})
+	t.Run("timeout", func(tt *testing.T) {
+		w, m := testWasmTransform(tt, testWasmLoop, 10*time.Millisecond)
+		h := w.Middleware("test.>", func(msg *nats.Msg) error {
+			tt.Errorf("must not be relayed")
+			return nil
+		})
+		for i := 0; i < 3; i += 1 {
+			if err := h(&nats.Msg{Subject: "test.wasm", Data: []byte("hello")}); errors.Is(err, ErrWasmTimeout) != true {
+				tt.Errorf("must ErrWasmTimeout: %+v", err)
+			}
+		}
+		if v := m.Get(metricWasmTimeouts).(*expvar.Int).Value(); v != 3 {
+			tt.Errorf("timeout count expect:3 actual:%d", v)
+		}
+	})
+	t.Run("reset", func(tt *testing.T) {
+		w, _ := testWasmTransform(tt, testWasmBump, time.Second)
+		h := w.Middleware("test.>", func(msg *nats.Msg) error {
+			return nil
+		})
+		data := make([]byte, 1024)
+		// allocations of all messages exceed 1 page(64KiB) unless memory is reset
+		for i := 0; i < 100; i += 1 {
+			if err := h(&nats.Msg{Subject: "test.wasm", Data: data}); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+		}
+	})
+	t.Run("reset/required", func(tt *testing.T) {
+		path := filepath.Join(tt.TempDir(), "noreset.wasm")
+		if err := os.WriteFile(path, testWasmNoReset, 0644); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		_, err := newWasmTransform("test.>", WasmConfig{Path: path}, new(expvar.Map).Init())
+		if errors.Is(err, ErrWasmExportNotFound) != true {
+			tt.Errorf("must ErrWasmExportNotFound: %+v", err)
+		}
+	})
+	t.Run("invalid", func(tt *testing.T) {
+		path := filepath.Join(tt.TempDir(), "invalid.wasm")
+		if err := os.WriteFile(path, []byte("not wasm"), 0644); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if _, err := newWasmTransform("test.>", WasmConfig{Path: path}, new(expvar.Map).Init()); err == nil {
+			tt.Errorf("must error")
+		}
+	})
+}
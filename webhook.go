@@ -0,0 +1,96 @@
+package nrelay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWebhookTimeout time.Duration = 10 * time.Second
+)
+
+var (
+	ErrWebhookUrlRequired = errors.New("webhook url required")
+)
+
+// check interface
+var (
+	_ Sink = (*webhookSink)(nil)
+)
+
+// webhookSink POSTs batch of messages as JSON array of Record
+type webhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (s *webhookSink) Write(msgs []*nats.Msg) error {
+	now := time.Now()
+	records := make([]Record, len(msgs))
+	for i, msg := range msgs {
+		records[i] = Record{
+			Subject:    msg.Subject,
+			Header:     msg.Header,
+			Data:       msg.Data,
+			ReceivedAt: now,
+		}
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// connection refused, timeout, etc.
+		return errors.WithStack(RetryableError(err))
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook %s responded %d", s.url, resp.StatusCode)
+	if resp.StatusCode == http.StatusTooManyRequests || 500 <= resp.StatusCode {
+		return errors.WithStack(RetryableError(err))
+	}
+	return errors.WithStack(err)
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func newWebhookSink(conf SinkConfig) (*webhookSink, error) {
+	if len(conf.Url) < 1 {
+		return nil, errors.WithStack(ErrWebhookUrlRequired)
+	}
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return &webhookSink{
+		url:     conf.Url,
+		headers: conf.Headers,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
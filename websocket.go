@@ -0,0 +1,466 @@
+package nrelay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	WebsocketOpSubscribe   string = "subscribe"
+	WebsocketOpUnsubscribe string = "unsubscribe"
+	WebsocketOpMsg         string = "msg"
+	WebsocketOpOk          string = "ok"
+	WebsocketOpError       string = "error"
+)
+
+const (
+	defaultWebsocketPath         string        = "/"
+	defaultWebsocketBufferSize   int           = 256
+	defaultWebsocketWriteTimeout time.Duration = 10 * time.Second
+	websocketPingInterval        time.Duration = 30 * time.Second
+	websocketPongWait            time.Duration = 60 * time.Second
+	websocketMaxRequestSize      int64         = 4096
+)
+
+const (
+	metricWebsocketClients         string = "ws_clients"
+	metricWebsocketSent            string = "ws_sent"
+	metricWebsocketSlowDisconnects string = "ws_slow_disconnects"
+)
+
+var (
+	ErrWebsocketListenRequired      = errors.New("websocket listen required")
+	ErrWebsocketSubjectNotPermitted = errors.New("subject not permitted")
+)
+
+// websocketMessage is JSON text frame between sink and clients,
+// data is UTF-8 string or base64 with encoding "base64" for binary payload
+type websocketMessage struct {
+	Op       string      `json:"op"`
+	Subject  string      `json:"subject,omitempty"`
+	Header   nats.Header `json:"header,omitempty"`
+	Data     string      `json:"data,omitempty"`
+	Encoding string      `json:"encoding,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+func encodeWebsocketMsg(msg *nats.Msg) ([]byte, error) {
+	m := websocketMessage{
+		Op:      WebsocketOpMsg,
+		Subject: msg.Subject,
+		Header:  msg.Header,
+	}
+	if utf8.Valid(msg.Data) {
+		m.Data = string(msg.Data)
+	} else {
+		m.Data = base64.StdEncoding.EncodeToString(msg.Data)
+		m.Encoding = "base64"
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
+
+// subjectMatch returns true if subject matches pattern of NATS wildcards
+func subjectMatch(pattern, subject string) bool {
+	pts := strings.Split(pattern, ".")
+	sts := strings.Split(subject, ".")
+	for i, pt := range pts {
+		if pt == ">" {
+			return i < len(sts)
+		}
+		if len(sts) <= i {
+			return false
+		}
+		if pt != "*" && pt != sts[i] {
+			return false
+		}
+	}
+	return len(pts) == len(sts)
+}
+
+// subjectSubset returns true if all subjects matching pattern also match allowed
+func subjectSubset(pattern, allowed string) bool {
+	pts := strings.Split(pattern, ".")
+	ats := strings.Split(allowed, ".")
+	for i, at := range ats {
+		if at == ">" {
+			return i < len(pts)
+		}
+		if len(pts) <= i {
+			return false
+		}
+		switch pts[i] {
+		case ">":
+			return false
+		case "*":
+			if at != "*" {
+				return false
+			}
+		default:
+			if at != "*" && at != pts[i] {
+				return false
+			}
+		}
+	}
+	return len(pts) == len(ats)
+}
+
+func validSubjectPattern(pattern string) bool {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		if token == ">" {
+			if i != len(tokens)-1 {
+				return false
+			}
+			continue
+		}
+		if token == "*" {
+			continue
+		}
+		if validSubjectToken(token) != true {
+			return false
+		}
+	}
+	return true
+}
+
+type websocketClient struct {
+	conn     *websocket.Conn
+	send     chan []byte
+	mutex    *sync.Mutex
+	subjects map[string]struct{}
+	done     chan struct{}
+	once     *sync.Once
+}
+
+func (c *websocketClient) Subscribe(pattern string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.subjects[pattern] = struct{}{}
+}
+
+func (c *websocketClient) Unsubscribe(pattern string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.subjects, pattern)
+}
+
+func (c *websocketClient) Subscribed(subject string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for pattern := range c.subjects {
+		if subjectMatch(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enqueue returns false if buffer of client is full
+func (c *websocketClient) Enqueue(data []byte) bool {
+	select {
+	case <-c.done:
+		return true
+	case c.send <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *websocketClient) Close(code int, text string) {
+	c.once.Do(func() {
+		close(c.done)
+		deadline := time.Now().Add(time.Second)
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+		c.conn.Close()
+	})
+}
+
+func newWebsocketClient(conn *websocket.Conn, bufferSize int) *websocketClient {
+	return &websocketClient{
+		conn:     conn,
+		send:     make(chan []byte, bufferSize),
+		mutex:    new(sync.Mutex),
+		subjects: make(map[string]struct{}),
+		done:     make(chan struct{}),
+		once:     new(sync.Once),
+	}
+}
+
+// check interface
+var (
+	_ Sink = (*websocketSink)(nil)
+)
+
+// websocketSink serves WebSocket endpoint and fans out messages to clients subscribing matched subjects.
+// Clients subscribe patterns permitted by config by "subject" query or subscribe requests,
+// clients whose buffer is full are disconnected
+type websocketSink struct {
+	conf     WebsocketConfig
+	allow    []string
+	metrics  *expvar.Map
+	upgrader *websocket.Upgrader
+	listener net.Listener
+	server   *http.Server
+	mutex    *sync.RWMutex
+	clients  map[*websocketClient]struct{}
+}
+
+func (s *websocketSink) Write(msgs []*nats.Msg) error {
+	s.mutex.RLock()
+	clients := make([]*websocketClient, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mutex.RUnlock()
+
+	if len(clients) < 1 {
+		return nil
+	}
+	for _, msg := range msgs {
+		var data []byte
+		for _, c := range clients {
+			if c.Subscribed(msg.Subject) != true {
+				continue
+			}
+			if data == nil {
+				d, err := encodeWebsocketMsg(msg)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				data = d
+			}
+			if c.Enqueue(data) != true {
+				s.metrics.Add(metricWebsocketSlowDisconnects, 1)
+				s.unregister(c)
+				c.Close(websocket.ClosePolicyViolation, "slow client")
+				continue
+			}
+			s.metrics.Add(metricWebsocketSent, 1)
+		}
+	}
+	return nil
+}
+
+func (s *websocketSink) Close() error {
+	s.mutex.Lock()
+	clients := s.clients
+	s.clients = make(map[*websocketClient]struct{})
+	s.mutex.Unlock()
+
+	for c := range clients {
+		s.metrics.Add(metricWebsocketClients, -1)
+		c.Close(websocket.CloseGoingAway, "shutdown")
+	}
+	if err := s.server.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Addr returns listening address
+func (s *websocketSink) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// permitted returns true if pattern is within allowed patterns
+func (s *websocketSink) permitted(pattern string) bool {
+	if validSubjectPattern(pattern) != true {
+		return false
+	}
+	for _, allowed := range s.allow {
+		if subjectSubset(pattern, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *websocketSink) register(c *websocketClient) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.clients[c] = struct{}{}
+	s.metrics.Add(metricWebsocketClients, 1)
+}
+
+func (s *websocketSink) unregister(c *websocketClient) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		s.metrics.Add(metricWebsocketClients, -1)
+	}
+}
+
+func (s *websocketSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	subjects := r.URL.Query()["subject"]
+	for _, subject := range subjects {
+		if s.permitted(subject) != true {
+			http.Error(w, ErrWebsocketSubjectNotPermitted.Error()+": "+subject, http.StatusForbidden)
+			return
+		}
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // upgrader responded error
+	}
+	c := newWebsocketClient(conn, s.conf.bufferSize())
+	for _, subject := range subjects {
+		c.Subscribe(subject)
+	}
+	s.register(c)
+
+	go s.writeLoop(c)
+	s.readLoop(c)
+}
+
+// readLoop handles subscribe/unsubscribe requests until client disconnects
+func (s *websocketSink) readLoop(c *websocketClient) {
+	defer func() {
+		s.unregister(c)
+		c.Close(websocket.CloseNormalClosure, "")
+	}()
+
+	c.conn.SetReadLimit(websocketMaxRequestSize)
+	c.conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		req := websocketMessage{}
+		if err := json.Unmarshal(data, &req); err != nil {
+			s.reply(c, websocketMessage{Op: WebsocketOpError, Error: "invalid request"})
+			continue
+		}
+		switch req.Op {
+		case WebsocketOpSubscribe:
+			if s.permitted(req.Subject) != true {
+				s.reply(c, websocketMessage{Op: WebsocketOpError, Subject: req.Subject, Error: ErrWebsocketSubjectNotPermitted.Error()})
+				continue
+			}
+			c.Subscribe(req.Subject)
+		case WebsocketOpUnsubscribe:
+			c.Unsubscribe(req.Subject)
+		default:
+			s.reply(c, websocketMessage{Op: WebsocketOpError, Error: "unknown op: " + req.Op})
+			continue
+		}
+		s.reply(c, websocketMessage{Op: WebsocketOpOk, Subject: req.Subject})
+	}
+}
+
+func (s *websocketSink) reply(c *websocketClient, m websocketMessage) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if c.Enqueue(data) != true {
+		s.metrics.Add(metricWebsocketSlowDisconnects, 1)
+		s.unregister(c)
+		c.Close(websocket.ClosePolicyViolation, "slow client")
+	}
+}
+
+// writeLoop writes buffered messages and pings, the only writer of conn except control frames
+func (s *websocketSink) writeLoop(c *websocketClient) {
+	ticker := time.NewTicker(websocketPingInterval)
+	defer ticker.Stop()
+
+	timeout := s.conf.writeTimeout()
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(timeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				s.unregister(c)
+				c.Close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(timeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				s.unregister(c)
+				c.Close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		}
+	}
+}
+
+// checkOrigin allows origins of config, "*" allows all, same origin is allowed by default
+func (s *websocketSink) checkOrigin(r *http.Request) bool {
+	if len(s.conf.Origins) < 1 {
+		origin := r.Header.Get("Origin")
+		if len(origin) < 1 {
+			return true
+		}
+		return strings.HasSuffix(origin, "://"+r.Host)
+	}
+	origin := r.Header.Get("Origin")
+	for _, o := range s.conf.Origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func newWebsocketSink(topic string, conf WebsocketConfig, metrics *expvar.Map) (*websocketSink, error) {
+	if len(conf.Listen) < 1 {
+		return nil, errors.WithStack(ErrWebsocketListenRequired)
+	}
+	allow := conf.Allow
+	if len(allow) < 1 {
+		allow = []string{topic}
+	}
+	path := conf.Path
+	if len(path) < 1 {
+		path = defaultWebsocketPath
+	}
+
+	ln, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &websocketSink{
+		conf:    conf,
+		allow:   allow,
+		metrics: metrics,
+		mutex:   new(sync.RWMutex),
+		clients: make(map[*websocketClient]struct{}),
+	}
+	s.upgrader = &websocket.Upgrader{CheckOrigin: s.checkOrigin}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, s)
+	s.listener = ln
+	s.server = &http.Server{Handler: mux}
+	go s.server.Serve(ln)
+	return s, nil
+}
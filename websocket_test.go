@@ -0,0 +1,211 @@
+package nrelay
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+func TestSubjectMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		expect  bool
+	}{
+		{"foo.bar", "foo.bar", true},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo.bar.baz", false},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{"*.bar", "foo.bar", true},
+		{"foo.bar", "foo.baz", false},
+	}
+	for _, tc := range tests {
+		if subjectMatch(tc.pattern, tc.subject) != tc.expect {
+			t.Errorf("%s %s: expect %v", tc.pattern, tc.subject, tc.expect)
+		}
+	}
+}
+
+func TestSubjectSubset(t *testing.T) {
+	tests := []struct {
+		pattern string
+		allowed string
+		expect  bool
+	}{
+		{"foo.bar", "foo.>", true},
+		{"foo.*.baz", "foo.>", true},
+		{"foo.>", "foo.>", true},
+		{"foo.>", "foo.*", false},
+		{"foo", "foo.>", false},
+		{"foo.*", "foo.*", true},
+		{"foo.bar", "foo.*", true},
+		{"foo.*", "foo.bar", false},
+		{"bar.baz", "foo.>", false},
+		{">", "foo.>", false},
+	}
+	for _, tc := range tests {
+		if subjectSubset(tc.pattern, tc.allowed) != tc.expect {
+			t.Errorf("%s in %s: expect %v", tc.pattern, tc.allowed, tc.expect)
+		}
+	}
+}
+
+func testWebsocketSink(t *testing.T, conf WebsocketConfig) (*websocketSink, *expvar.Map) {
+	metrics := new(expvar.Map).Init()
+	conf.Listen = "127.0.0.1:0"
+	sink, err := newWebsocketSink("dash.>", conf, metrics)
+	if err != nil {
+		t.Fatalf("must no error: %+v", err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	return sink, metrics
+}
+
+func testWebsocketDial(t *testing.T, sink *websocketSink, query string) (*websocket.Conn, *http.Response, error) {
+	url := fmt.Sprintf("ws://%s/%s", sink.Addr().String(), query)
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func testWebsocketWaitClients(t *testing.T, sink *websocketSink, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sink.mutex.RLock()
+		size := len(sink.clients)
+		sink.mutex.RUnlock()
+		if size == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expect %d clients", n)
+}
+
+func TestWebsocketSink(t *testing.T) {
+	t.Run("fanout", func(tt *testing.T) {
+		sink, metrics := testWebsocketSink(tt, WebsocketConfig{})
+		c1, _, err := testWebsocketDial(tt, sink, "?subject=dash.a.*")
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		c2, _, err := testWebsocketDial(tt, sink, "?subject=dash.>")
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		testWebsocketWaitClients(tt, sink, 2)
+
+		m1 := nats.NewMsg("dash.a.cpu")
+		m1.Data = []byte("42")
+		m2 := nats.NewMsg("dash.b.mem")
+		m2.Data = []byte{0xff, 0x00}
+		if err := sink.Write([]*nats.Msg{m1, m2}); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+
+		r1 := websocketMessage{}
+		c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := c1.ReadJSON(&r1); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if r1.Op != WebsocketOpMsg || r1.Subject != "dash.a.cpu" || r1.Data != "42" {
+			tt.Errorf("matched msg: %+v", r1)
+		}
+
+		c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got := []websocketMessage{}
+		for i := 0; i < 2; i += 1 {
+			r := websocketMessage{}
+			if err := c2.ReadJSON(&r); err != nil {
+				tt.Fatalf("must no error: %+v", err)
+			}
+			got = append(got, r)
+		}
+		if got[1].Subject != "dash.b.mem" || got[1].Encoding != "base64" || got[1].Data != "/wA=" {
+			tt.Errorf("binary payload is base64: %+v", got[1])
+		}
+		if n := metrics.Get(metricWebsocketSent).String(); n != "3" {
+			tt.Errorf("sent 3: %s", n)
+		}
+	})
+	t.Run("permission", func(tt *testing.T) {
+		sink, _ := testWebsocketSink(tt, WebsocketConfig{Allow: []string{"dash.public.>"}})
+		_, resp, err := testWebsocketDial(tt, sink, "?subject=dash.private.x")
+		if err == nil {
+			tt.Fatalf("not permitted subject must be rejected")
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			tt.Errorf("forbidden: %+v", resp)
+		}
+
+		conn, _, err := testWebsocketDial(tt, sink, "")
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		conn.WriteJSON(websocketMessage{Op: WebsocketOpSubscribe, Subject: "dash.>"})
+		r := websocketMessage{}
+		if err := conn.ReadJSON(&r); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if r.Op != WebsocketOpError {
+			tt.Errorf("wider pattern must be rejected: %+v", r)
+		}
+
+		conn.WriteJSON(websocketMessage{Op: WebsocketOpSubscribe, Subject: "dash.public.*"})
+		if err := conn.ReadJSON(&r); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if r.Op != WebsocketOpOk {
+			tt.Errorf("subscribed: %+v", r)
+		}
+
+		sink.Write([]*nats.Msg{nats.NewMsg("dash.private.x"), nats.NewMsg("dash.public.x")})
+		if err := conn.ReadJSON(&r); err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		if r.Subject != "dash.public.x" {
+			tt.Errorf("permitted subject only: %+v", r)
+		}
+	})
+	t.Run("slow_client", func(tt *testing.T) {
+		sink, metrics := testWebsocketSink(tt, WebsocketConfig{BufferSize: 1})
+		conn, _, err := testWebsocketDial(tt, sink, "?subject=dash.>")
+		if err != nil {
+			tt.Fatalf("must no error: %+v", err)
+		}
+		testWebsocketWaitClients(tt, sink, 1)
+
+		// client does not read until socket buffers are full
+		payload := bytes.Repeat([]byte("x"), 1024)
+		for i := 0; i < 10000; i += 1 {
+			msg := nats.NewMsg("dash.slow")
+			msg.Data = payload
+			sink.Write([]*nats.Msg{msg})
+		}
+		testWebsocketWaitClients(tt, sink, 0)
+		if n := metrics.Get(metricWebsocketSlowDisconnects).String(); n != "1" {
+			tt.Errorf("slow client disconnected: %s", n)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if websocket.IsCloseError(err, websocket.ClosePolicyViolation) != true {
+					tt.Logf("closed: %+v", err)
+				}
+				break
+			}
+		}
+	})
+}